@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bensallen/sqlios/nagios"
+)
+
+// Nagios plugin exit codes.
+const (
+	checkOK = iota
+	checkWarning
+	checkCritical
+	checkUnknown
+)
+
+var checkStates = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// checkValue is a single value checked against thresholds and reported as
+// perfdata.
+type checkValue struct {
+	label      string
+	value      float64
+	uom        string
+	warn, crit *nagios.Range
+	min, max   string
+}
+
+// state returns the plugin state of the value against its thresholds.
+func (v checkValue) state() int {
+	switch {
+	case v.crit != nil && v.crit.Alert(v.value):
+		return checkCritical
+	case v.warn != nil && v.warn.Alert(v.value):
+		return checkWarning
+	}
+	return checkOK
+}
+
+func (v checkValue) perfData() string {
+	var warn, crit string
+	if v.warn != nil {
+		warn = v.warn.String()
+	}
+	if v.crit != nil {
+		crit = v.crit.String()
+	}
+	value := strconv.FormatFloat(v.value, 'f', -1, 64)
+	return fmt.Sprintf("%s=%s%s;%s;%s;%s;%s", v.label, value, v.uom, warn, crit, v.min, v.max)
+}
+
+// parseThresholds parses a comma separated list of ranges for the age,
+// backlog and error rate, any of which may be left empty.
+func parseThresholds(s string) ([]*nagios.Range, error) {
+	var ranges = make([]*nagios.Range, 3)
+
+	parts := strings.Split(s, ",")
+	if len(parts) > len(ranges) {
+		return nil, fmt.Errorf("too many thresholds in %q, expected age,backlog,error_rate", s)
+	}
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		r, err := nagios.ParseRange(part)
+		if err != nil {
+			return nil, err
+		}
+		ranges[i] = r
+	}
+	return ranges, nil
+}
+
+// fetchStatus reads the status of a running SQLios from its status endpoint.
+func fetchStatus(url string, timeout time.Duration) (*status, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	var st status
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, fmt.Errorf("decoding %s: %s", url, err)
+	}
+	return &st, nil
+}
+
+// runCheck implements sqlios check, a Nagios plugin checking a running
+// SQLios, and returns its exit code.
+func runCheck() int {
+	unknown := func(format string, a ...interface{}) int {
+		fmt.Printf("SQLIOS UNKNOWN - "+format+"\n", a...)
+		return checkUnknown
+	}
+
+	warn, err := parseThresholds(*checkWarningRange)
+	if err != nil {
+		return unknown("--warning: %s", err)
+	}
+	crit, err := parseThresholds(*checkCriticalRange)
+	if err != nil {
+		return unknown("--critical: %s", err)
+	}
+
+	var st *status
+	if *checkCheckpoint != "" {
+		cp, err := nagios.LoadCheckpoint(*checkCheckpoint)
+		if err != nil {
+			return unknown("%s", err)
+		}
+		st = &status{LastCreated: cp.Created}
+	} else {
+		if st, err = fetchStatus(*checkURL, *checkTimeout); err != nil {
+			return unknown("%s", err)
+		}
+	}
+	if st.LastCreated == 0 {
+		return unknown("no status.dat has been ingested yet")
+	}
+
+	age := time.Since(time.Unix(st.LastCreated, 0)).Seconds()
+	if age < 0 {
+		age = 0
+	}
+	var values = []checkValue{
+		{label: "age", value: float64(int64(age)), uom: "s", warn: warn[0], crit: crit[0], min: "0"},
+	}
+	var summary = []string{fmt.Sprintf("last status.dat ingested %ds ago", int64(age))}
+	if *checkCheckpoint == "" {
+		values = append(values,
+			checkValue{label: "backlog", value: float64(st.Backlog), uom: "B", warn: warn[1], crit: crit[1], min: "0"},
+			checkValue{label: "error_rate", value: st.ErrorRate, warn: warn[2], crit: crit[2], min: "0", max: "1"},
+		)
+		summary = append(summary,
+			fmt.Sprintf("backlog %d bytes", st.Backlog),
+			fmt.Sprintf("error rate %.2f", st.ErrorRate),
+		)
+	}
+
+	var state = checkOK
+	var perfData = make([]string, 0, len(values))
+	for _, v := range values {
+		if s := v.state(); s > state {
+			state = s
+		}
+		perfData = append(perfData, v.perfData())
+	}
+
+	fmt.Printf("SQLIOS %s - %s | %s\n", checkStates[state], strings.Join(summary, ", "), strings.Join(perfData, " "))
+	return state
+}
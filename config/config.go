@@ -0,0 +1,460 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/bensallen/sqlios/nagios"
+	"github.com/bensallen/sqlios/sink"
+	"gopkg.in/yaml.v2"
+)
+
+// Input types
+const (
+	// StatusInput is a Nagios status.dat that is re-read each time it is
+	// replaced.
+	StatusInput = "status"
+	// PerfdataInput is a spool directory of perfdata files, written by the
+	// Nagios process-*-perfdata-file commands, that are claimed one by one.
+	PerfdataInput = "perfdata"
+	// CheckResultInput is a spool directory of check result files, in the
+	// format Nagios queues in its check_result_path, such as those written
+	// by NRDP. They are claimed like perfdata files.
+	CheckResultInput = "checkresult"
+	// LogInput is a growing, line oriented log such as nagios.log that is
+	// followed as it is appended to.
+	LogInput = "log"
+)
+
+// Ways of noticing that an input was replaced
+const (
+	// AutoWatch uses fsnotify, falling back to polling if the watch can't
+	// be added.
+	AutoWatch   = "auto"
+	NotifyWatch = "fsnotify"
+	// PollWatch stats the input every PollInterval, for filesystems such as
+	// NFS where inotify events never fire.
+	PollWatch = "poll"
+)
+
+// Sink types
+const (
+	InfluxSink  = "influxdb"
+	Influx2Sink = "influxdb2"
+	SQLSink     = "sql"
+	ExportSink  = "export"
+)
+
+// Config is the top level of a SQLios configuration file.
+type Config struct {
+	Inputs []Input `yaml:"inputs"`
+	Sinks  []Sink  `yaml:"sinks"`
+
+	// Tags lists, per block type, the fields that are moved into point tags.
+	Tags map[string][]string `yaml:"tags"`
+	// Schema sets the type of fields whose type can't be guessed reliably.
+	Schema Schema `yaml:"schema"`
+	// Filters selects what is ingested.
+	Filters Filters `yaml:"filters"`
+	// Timestamps chooses the time of the points from each block type.
+	Timestamps Timestamps `yaml:"timestamps"`
+	// Relabel rewrites fields, applied before tags, schema and filters.
+	Relabel []Relabel `yaml:"relabel"`
+
+	Batch           Batch         `yaml:"batch"`
+	Spool           Spool         `yaml:"spool"`
+	Retry           Retry         `yaml:"retry"`
+	DeadLetter      string        `yaml:"dead_letter"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// Listen is the address to serve metrics and health checks on, empty
+	// disables the HTTP server.
+	Listen string `yaml:"listen"`
+}
+
+// Input is a single Nagios instance to read from.
+type Input struct {
+	// Name is added to every point from this input as the instance tag.
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+	// Tags are added to every point from this input.
+	Tags map[string]string `yaml:"tags"`
+	// Checkpoint is the file the created time of the last read status.dat,
+	// or for a log input the offset reached, is saved to.
+	Checkpoint string `yaml:"checkpoint"`
+	// OnStart loads the file on start rather than waiting for it to change.
+	OnStart bool `yaml:"onstart"`
+	// Watch is how the input being replaced is noticed, one of auto,
+	// fsnotify or poll.
+	Watch        string        `yaml:"watch"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+
+	// WorkDir is where a perfdata or checkresult input moves the files it
+	// claims, by default .work inside Path. It must be on the same
+	// filesystem as Path.
+	WorkDir string `yaml:"work_dir"`
+	// ArchiveDir is where a perfdata or checkresult input moves files once
+	// they are written to every sink, they are deleted if it is empty.
+	ArchiveDir string `yaml:"archive_dir"`
+}
+
+// Sink is a destination for points. Which fields apply depends on Type.
+type Sink struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+
+	// InfluxDB
+	URL      string `yaml:"url"`
+	Database string `yaml:"database"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// InfluxDB 2.x, also URL
+	Token        string `yaml:"token"`
+	Org          string `yaml:"org"`
+	Bucket       string `yaml:"bucket"`
+	CreateBucket bool   `yaml:"create_bucket"`
+
+	// SQL
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+	Schema string `yaml:"schema"`
+	Table  string `yaml:"table"`
+
+	// Export
+	Dir    string `yaml:"dir"`
+	Format string `yaml:"format"`
+	// Window buffers points to write a file per window rather than per
+	// status.dat.
+	Window time.Duration `yaml:"window"`
+
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Schema sets field types by field name, one of int, float, bool or string.
+type Schema struct {
+	Fields map[string]string `yaml:"fields"`
+	// Integers writes the fields known to be integers as integers rather
+	// than as floats, as earlier versions did.
+	Integers bool `yaml:"integers"`
+	// Checkpoint is the file the types other fields were first seen with are
+	// saved to, so they are kept across restarts.
+	Checkpoint string `yaml:"checkpoint"`
+}
+
+// Filters selects what is ingested.
+type Filters struct {
+	// Blocks lists the status.dat block types to ingest, empty means all.
+	Blocks []string `yaml:"blocks"`
+	// Fields selects the fields kept from each block type.
+	Fields map[string]FieldFilter `yaml:"fields"`
+
+	// Include keeps only the blocks matching one of its entries, Exclude
+	// drops those matching any. An entry maps fields such as host_name,
+	// check_command, hostgroup or a custom variable to a glob or regexp
+	// between slashes, all of which must match.
+	Include []map[string]string `yaml:"include"`
+	Exclude []map[string]string `yaml:"exclude"`
+	// ObjectsCache lists the objects.cache files that hostgroup members are
+	// read from.
+	ObjectsCache []string `yaml:"objects_cache"`
+}
+
+// FieldFilter keeps the fields matching Include, or every field if it is
+// empty, that don't match Exclude. Each is a glob such as last_* or a
+// regexp between slashes.
+type FieldFilter struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// Relabel rewrites the fields of a block before they reach any sink, in the
+// order the rules are given.
+type Relabel struct {
+	// Block is the block type the rule applies to, empty for all.
+	Block string `yaml:"block"`
+	// Action is one of rename, drop, tag or replace.
+	Action string `yaml:"action"`
+	Source string `yaml:"source"`
+	// Target defaults to Source.
+	Target string `yaml:"target"`
+	// Regex must match the whole value of Source, by default anything.
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+}
+
+// Timestamps chooses the time of the points from each block type.
+type Timestamps struct {
+	// Blocks sets the field used per block type, one of last_check,
+	// last_update, created, entry_time, start_time or ingest for the time
+	// the block is read.
+	Blocks map[string]string `yaml:"blocks"`
+	// Zero is what is done with blocks whose field is 0, such as services
+	// that were never checked: skip them, or use the ingest or created time.
+	Zero string `yaml:"zero"`
+}
+
+// Spool configures the on-disk buffer in front of each sink.
+type Spool struct {
+	// Dir holds one spool per sink, named after the sink. Empty disables
+	// spooling.
+	Dir     string        `yaml:"dir"`
+	MaxSize int64         `yaml:"max_size"`
+	MaxAge  time.Duration `yaml:"max_age"`
+}
+
+// Batch sizes the batches of points written to the sinks, by count and by
+// the time the first point of a batch waits.
+type Batch struct {
+	Size     int           `yaml:"size"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Retry configures how failed writes are retried.
+type Retry struct {
+	Retries    int           `yaml:"retries"`
+	Backoff    time.Duration `yaml:"backoff"`
+	BackoffMax time.Duration `yaml:"backoff_max"`
+}
+
+// Load reads and validates the configuration file at path.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// Parse parses and validates a YAML configuration.
+func Parse(b []byte) (*Config, error) {
+	var c Config
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return nil, err
+	}
+	c.SetDefaults()
+	if len(c.Inputs) == 0 {
+		return nil, fmt.Errorf("config: no inputs")
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// SetDefaults fills in any unset values.
+func (c *Config) SetDefaults() {
+	for i := range c.Inputs {
+		in := &c.Inputs[i]
+		if in.Type == "" {
+			in.Type = StatusInput
+		}
+		if in.Watch == "" {
+			in.Watch = AutoWatch
+		}
+		if in.PollInterval == 0 {
+			in.PollInterval = 5 * time.Second
+		}
+	}
+	for i := range c.Sinks {
+		s := &c.Sinks[i]
+		if s.Name == "" {
+			s.Name = s.Type
+		}
+		switch s.Type {
+		case InfluxSink, Influx2Sink:
+			if s.URL == "" {
+				s.URL = "http://localhost:8086"
+			}
+		case SQLSink:
+			if s.Driver == "" {
+				s.Driver = "postgres"
+			}
+			if s.Schema == "" {
+				s.Schema = sink.JSONSchema
+			}
+			if s.Table == "" {
+				s.Table = "nagios"
+			}
+		case ExportSink:
+			if s.Format == "" {
+				s.Format = sink.CSVFormat
+			}
+		}
+	}
+	if c.Batch.Size == 0 {
+		c.Batch.Size = 5000
+	}
+	if c.Batch.Interval == 0 {
+		c.Batch.Interval = time.Second
+	}
+	if c.Retry.Retries == 0 {
+		c.Retry.Retries = 5
+	}
+	if c.Retry.Backoff == 0 {
+		c.Retry.Backoff = 500 * time.Millisecond
+	}
+	if c.Retry.BackoffMax == 0 {
+		c.Retry.BackoffMax = 30 * time.Second
+	}
+	if c.Spool.MaxSize == 0 {
+		c.Spool.MaxSize = 1 << 30
+	}
+	if c.Spool.MaxAge == 0 {
+		c.Spool.MaxAge = 24 * time.Hour
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 30 * time.Second
+	}
+	if c.Timestamps.Zero == "" {
+		c.Timestamps.Zero = "skip"
+	}
+}
+
+// Validate checks that the configuration is complete and consistent. It
+// doesn't require any inputs, replay brings its own.
+func (c *Config) Validate() error {
+	if len(c.Sinks) == 0 {
+		return fmt.Errorf("config: no sinks")
+	}
+
+	names := make(map[string]bool)
+	for i, in := range c.Inputs {
+		switch in.Type {
+		case StatusInput, PerfdataInput, CheckResultInput, LogInput:
+		default:
+			return fmt.Errorf("config: input %d: unknown type %q", i, in.Type)
+		}
+		if in.Path == "" {
+			return fmt.Errorf("config: input %d: no path", i)
+		}
+		switch in.Watch {
+		case AutoWatch, NotifyWatch, PollWatch:
+		default:
+			return fmt.Errorf("config: input %d: unknown watch %q", i, in.Watch)
+		}
+		if names[in.Name] {
+			return fmt.Errorf("config: input %d: duplicate name %q", i, in.Name)
+		}
+		names[in.Name] = true
+	}
+
+	names = make(map[string]bool)
+	for i, s := range c.Sinks {
+		switch s.Type {
+		case InfluxSink:
+			if s.Database == "" {
+				return fmt.Errorf("config: sink %q: no database", s.Name)
+			}
+		case Influx2Sink:
+			if s.Bucket == "" {
+				return fmt.Errorf("config: sink %q: no bucket", s.Name)
+			}
+			if s.CreateBucket && s.Org == "" {
+				return fmt.Errorf("config: sink %q: create_bucket needs an org", s.Name)
+			}
+		case SQLSink:
+			if s.DSN == "" {
+				return fmt.Errorf("config: sink %q: no dsn", s.Name)
+			}
+			if s.Driver != "postgres" && s.Driver != "sqlite3" {
+				return fmt.Errorf("config: sink %q: unknown driver %q", s.Name, s.Driver)
+			}
+			if s.Schema != sink.JSONSchema && s.Schema != sink.NormalizedSchema {
+				return fmt.Errorf("config: sink %q: unknown schema %q", s.Name, s.Schema)
+			}
+		case ExportSink:
+			if s.Dir == "" {
+				return fmt.Errorf("config: sink %q: no dir", s.Name)
+			}
+			if s.Format != sink.CSVFormat && s.Format != sink.ParquetFormat {
+				return fmt.Errorf("config: sink %q: unknown format %q", s.Name, s.Format)
+			}
+			if s.Window < 0 {
+				return fmt.Errorf("config: sink %q: negative window", s.Name)
+			}
+		default:
+			return fmt.Errorf("config: sink %d: unknown type %q", i, s.Type)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("config: sink %d: duplicate name %q", i, s.Name)
+		}
+		names[s.Name] = true
+	}
+
+	for field, typ := range c.Schema.Fields {
+		switch typ {
+		case "int", "float", "bool", "string":
+		default:
+			return fmt.Errorf("config: schema: field %q has unknown type %q", field, typ)
+		}
+	}
+
+	for i, entry := range append(c.Filters.Include, c.Filters.Exclude...) {
+		if len(entry) == 0 {
+			return fmt.Errorf("config: filters: entry %d is empty", i)
+		}
+		for field, pattern := range entry {
+			if _, err := nagios.CompilePattern(pattern); err != nil {
+				return fmt.Errorf("config: filters: %s: %s", field, err)
+			}
+			if field == "hostgroup" && len(c.Filters.ObjectsCache) == 0 {
+				return fmt.Errorf("config: filters: hostgroup needs objects_cache")
+			}
+		}
+	}
+
+	for block, filter := range c.Filters.Fields {
+		for _, pattern := range append(filter.Include, filter.Exclude...) {
+			if _, err := nagios.CompilePattern(pattern); err != nil {
+				return fmt.Errorf("config: filters: fields: %s: %s", block, err)
+			}
+		}
+	}
+
+	for i, r := range c.Relabel {
+		if r.Source == "" {
+			return fmt.Errorf("config: relabel %d: no source", i)
+		}
+		switch r.Action {
+		case "rename":
+			if r.Target == "" {
+				return fmt.Errorf("config: relabel %d: rename needs a target", i)
+			}
+		case "drop", "tag", "replace":
+		default:
+			return fmt.Errorf("config: relabel %d: unknown action %q", i, r.Action)
+		}
+		if _, err := nagios.CompileRegex(r.Regex); err != nil {
+			return fmt.Errorf("config: relabel %d: %s", i, err)
+		}
+	}
+
+	for block, field := range c.Timestamps.Blocks {
+		switch field {
+		case "last_check", "last_update", "created", "entry_time", "start_time", "ingest":
+		default:
+			return fmt.Errorf("config: timestamps: block %q has unknown field %q", block, field)
+		}
+	}
+	switch c.Timestamps.Zero {
+	case "skip", "ingest", "created":
+	default:
+		return fmt.Errorf("config: timestamps: unknown zero %q", c.Timestamps.Zero)
+	}
+	if c.Batch.Size < 0 || c.Batch.Interval < 0 {
+		return fmt.Errorf("config: batch: size and interval must be positive")
+	}
+	if c.Retry.Retries < 0 || c.Retry.Backoff < 0 || c.Retry.BackoffMax < 0 {
+		return fmt.Errorf("config: retry: retries and backoff must be positive")
+	}
+	if c.Spool.MaxSize < 0 || c.Spool.MaxAge < 0 {
+		return fmt.Errorf("config: spool: max_size and max_age must be positive")
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("config: shutdown_timeout must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bensallen/sqlios/sink"
+)
+
+func TestLoad(t *testing.T) {
+	c, err := Load("../example_data/sqlios.yml")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(c.Inputs) != 4 || c.Inputs[0].Type != StatusInput || c.Inputs[0].Tags["site"] != "dc1" || !c.Inputs[1].OnStart || c.Inputs[2].Type != PerfdataInput || c.Inputs[3].Type != LogInput {
+		t.Errorf("Load() inputs = %#v", c.Inputs)
+	}
+	if len(c.Sinks) != 2 || c.Sinks[1].Driver != "postgres" || c.Sinks[1].Schema != sink.NormalizedSchema {
+		t.Errorf("Load() sinks = %#v", c.Sinks)
+	}
+	if want := []string{"host_name", "service_description", "site"}; !reflect.DeepEqual(c.Tags["servicestatus"], want) {
+		t.Errorf("Load() tags = %v, want %v", c.Tags["servicestatus"], want)
+	}
+	if c.Spool.MaxAge != 24*time.Hour || c.ShutdownTimeout != 30*time.Second || c.Batch.Interval != 2*time.Second {
+		t.Errorf("Load() durations = %v, %v, %v", c.Spool.MaxAge, c.ShutdownTimeout, c.Batch.Interval)
+	}
+	if c.Batch.Size != 5000 {
+		t.Errorf("Load() batch size = %d, want 5000", c.Batch.Size)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr bool
+	}{
+		{
+			name: "Minimal",
+			yaml: "inputs: [{path: status.dat}]\nsinks: [{type: influxdb, database: nagios}]",
+		},
+		{
+			name:    "No inputs",
+			yaml:    "sinks: [{type: influxdb, database: nagios}]",
+			wantErr: true,
+		},
+		{
+			name:    "No sinks",
+			yaml:    "inputs: [{path: status.dat}]",
+			wantErr: true,
+		},
+		{
+			name:    "Unknown sink type",
+			yaml:    "inputs: [{path: status.dat}]\nsinks: [{type: carbon}]",
+			wantErr: true,
+		},
+		{
+			name: "InfluxDB 2",
+			yaml: "inputs: [{path: status.dat}]\nsinks: [{type: influxdb2, org: ops, bucket: nagios, token: secret, create_bucket: true}]",
+		},
+		{
+			name:    "InfluxDB 2 without bucket",
+			yaml:    "inputs: [{path: status.dat}]\nsinks: [{type: influxdb2, org: ops, token: secret}]",
+			wantErr: true,
+		},
+		{
+			name: "Normalized SQL schema",
+			yaml: "inputs: [{path: status.dat}]\nsinks: [{type: sql, dsn: postgres://localhost/nagios, schema: normalized}]",
+		},
+		{
+			name:    "Unknown SQL schema",
+			yaml:    "inputs: [{path: status.dat}]\nsinks: [{type: sql, dsn: postgres://localhost/nagios, schema: star}]",
+			wantErr: true,
+		},
+		{
+			name: "SQLite",
+			yaml: "inputs: [{path: status.dat}]\nsinks: [{type: sql, driver: sqlite3, dsn: nagios.db, schema: normalized}]",
+		},
+		{
+			name:    "Unknown SQL driver",
+			yaml:    "inputs: [{path: status.dat}]\nsinks: [{type: sql, driver: mysql, dsn: nagios}]",
+			wantErr: true,
+		},
+		{
+			name: "Parquet export",
+			yaml: "inputs: [{path: status.dat}]\nsinks: [{type: export, dir: /var/lib/sqlios/export, format: parquet, window: 1h}]",
+		},
+		{
+			name:    "Unknown export format",
+			yaml:    "inputs: [{path: status.dat}]\nsinks: [{type: export, dir: /var/lib/sqlios/export, format: orc}]",
+			wantErr: true,
+		},
+		{
+			name:    "Duplicate sink names",
+			yaml:    "inputs: [{path: status.dat}]\nsinks: [{type: influxdb, database: a}, {type: influxdb, database: b}]",
+			wantErr: true,
+		},
+		{
+			name:    "Duplicate input names",
+			yaml:    "inputs: [{name: a, path: 1.dat}, {name: a, path: 2.dat}]\nsinks: [{type: influxdb, database: nagios}]",
+			wantErr: true,
+		},
+		{
+			name:    "Unknown field type",
+			yaml:    "inputs: [{path: status.dat}]\nsinks: [{type: influxdb, database: nagios}]\nschema: {fields: {x: decimal}}",
+			wantErr: true,
+		},
+		{
+			name: "Poll watch",
+			yaml: "inputs: [{path: status.dat, watch: poll, poll_interval: 10s}]\nsinks: [{type: influxdb, database: nagios}]",
+		},
+		{
+			name: "Perfdata spool",
+			yaml: "inputs: [{type: perfdata, path: /var/spool/sqlios, archive_dir: /var/spool/sqlios/done}]\nsinks: [{type: influxdb, database: nagios}]",
+		},
+		{
+			name: "Check result spool",
+			yaml: "inputs: [{type: checkresult, path: /var/spool/nagios/checkresults}]\nsinks: [{type: influxdb, database: nagios}]",
+		},
+		{
+			name:    "Unknown watch",
+			yaml:    "inputs: [{path: status.dat, watch: kqueue}]\nsinks: [{type: influxdb, database: nagios}]",
+			wantErr: true,
+		},
+		{
+			name:    "Unknown timestamp field",
+			yaml:    "inputs: [{path: status.dat}]\nsinks: [{type: influxdb, database: nagios}]\ntimestamps: {blocks: {hoststatus: next_check}}",
+			wantErr: true,
+		},
+		{
+			name: "Field filters and relabel",
+			yaml: "inputs: [{path: status.dat}]\nsinks: [{type: influxdb, database: nagios}]\nfilters: {fields: {servicestatus: {include: [current_*, /^performance_data/]}}}\nrelabel: [{action: tag, source: check_command}]",
+		},
+		{
+			name:    "Bad field pattern",
+			yaml:    "inputs: [{path: status.dat}]\nsinks: [{type: influxdb, database: nagios}]\nfilters: {fields: {servicestatus: {exclude: [\"/(/\"]}}}",
+			wantErr: true,
+		},
+		{
+			name:    "Rename without target",
+			yaml:    "inputs: [{path: status.dat}]\nsinks: [{type: influxdb, database: nagios}]\nrelabel: [{action: rename, source: plugin_output}]",
+			wantErr: true,
+		},
+		{
+			name: "Host filters",
+			yaml: "inputs: [{path: status.dat}]\nsinks: [{type: influxdb, database: nagios}]\nfilters: {include: [{host_name: prod-*}, {check_command: /^check_mk-/}], exclude: [{_ENVIRONMENT: dev}]}",
+		},
+		{
+			name:    "Hostgroup without objects_cache",
+			yaml:    "inputs: [{path: status.dat}]\nsinks: [{type: influxdb, database: nagios}]\nfilters: {include: [{hostgroup: linux}]}",
+			wantErr: true,
+		},
+		{
+			name:    "Negative batch size",
+			yaml:    "inputs: [{path: status.dat}]\nsinks: [{type: influxdb, database: nagios}]\nbatch: {size: -1}",
+			wantErr: true,
+		},
+		{
+			name:    "Negative retries",
+			yaml:    "inputs: [{path: status.dat}]\nsinks: [{type: influxdb, database: nagios}]\nretry: {retries: -1}",
+			wantErr: true,
+		},
+		{
+			name:    "Unknown key",
+			yaml:    "inputs: [{path: status.dat, colour: red}]\nsinks: [{type: influxdb, database: nagios}]",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse([]byte(tt.yaml)); (err != nil) != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
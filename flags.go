@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/alecthomas/units"
+	"github.com/bensallen/sqlios/config"
+	"github.com/bensallen/sqlios/sink"
+)
+
+// pipelineFlags are the flags shared by the commands writing to sinks.
+type pipelineFlags struct {
+	configFile *string
+	cpus       *int
+
+	host     *string
+	username *string
+	password *string
+	database *string
+
+	sqlite *string
+
+	batchSize     *int
+	batchInterval *time.Duration
+
+	spoolDir  *string
+	spoolSize *units.Base2Bytes
+	spoolAge  *time.Duration
+
+	retries         *int
+	retryBackoff    *time.Duration
+	retryBackoffMax *time.Duration
+	deadLetterFile  *string
+
+	shutdownTimeout *time.Duration
+	listen          *string
+}
+
+func addPipelineFlags(cmd *kingpin.CmdClause) *pipelineFlags {
+	return &pipelineFlags{
+		configFile: cmd.Flag("config", "YAML configuration file, any other flags given override it").Short('f').String(),
+		cpus:       cmd.Flag("cpus", "Max number of CPUs to use").Short('c').Int(),
+
+		host:     cmd.Flag("host", "InfluxDB host to connect to").Default("http://localhost:8086").Short('h').String(),
+		username: cmd.Flag("username", "InfluxDB user name to authenticate as").Default("root").Short('u').String(),
+		password: cmd.Flag("password", "Password to authenticate with").Default("root").Short('p').String(),
+		database: cmd.Flag("database", "InfluxDB database to connect to").Short('D').String(),
+
+		sqlite: cmd.Flag("sqlite", "SQLite file to write the normalized schema to, instead of InfluxDB unless InfluxDB flags are given too").String(),
+
+		batchSize:     cmd.Flag("batch-size", "Number of points written to the sinks at a time").Default("5000").Int(),
+		batchInterval: cmd.Flag("batch-interval", "Longest time points wait to be written while a batch fills").Default("1s").Duration(),
+
+		spoolDir:  cmd.Flag("spool", "Directory to buffer points on disk in, one spool per sink, while sinks are unavailable").String(),
+		spoolSize: cmd.Flag("spool-max-size", "Maximum size of the spool, oldest points are dropped beyond this").Default("1GB").Bytes(),
+		spoolAge:  cmd.Flag("spool-max-age", "Maximum age of points in the spool, older points are dropped").Default("24h").Duration(),
+
+		retries:         cmd.Flag("retries", "Number of times to retry a failed write before giving up").Default("5").Int(),
+		retryBackoff:    cmd.Flag("retry-backoff", "Initial delay between retries of a failed write, doubled each retry").Default("500ms").Duration(),
+		retryBackoffMax: cmd.Flag("retry-backoff-max", "Maximum delay between retries of a failed write").Default("30s").Duration(),
+		deadLetterFile:  cmd.Flag("dead-letter", "File to record points that are permanently rejected by a sink").String(),
+
+		shutdownTimeout: cmd.Flag("shutdown-timeout", "How long to wait for points to be flushed after SIGINT or SIGTERM").Default("30s").Duration(),
+		listen:          cmd.Flag("listen", "Address to serve /metrics, /status, /healthz and /readyz on, e.g. :9273").String(),
+	}
+}
+
+// flagsSet returns the names of the flags given on the command line, as
+// opposed to those left at their default.
+func flagsSet() map[string]bool {
+	set := make(map[string]bool)
+
+	ctx, err := kingpin.CommandLine.ParseContext(os.Args[1:])
+	if err != nil {
+		return set
+	}
+	for _, element := range ctx.Elements {
+		if flag, ok := element.Clause.(*kingpin.FlagClause); ok {
+			set[flag.Model().Name] = true
+		}
+	}
+	return set
+}
+
+// loadConfig reads the configuration file if one was given, and applies any
+// flags on top of it. Without a configuration file the flags describe a
+// single InfluxDB sink. Inputs are left as configured.
+func (f *pipelineFlags) loadConfig() (*config.Config, error) {
+	var cfg = &config.Config{}
+
+	if *f.configFile != "" {
+		var err error
+		cfg, err = config.Load(*f.configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	set := flagsSet()
+	// override reports whether a flag should replace the configuration,
+	// without a configuration file even defaults do.
+	override := func(name string) bool {
+		return *f.configFile == "" || set[name]
+	}
+
+	influxFlags := set["host"] || set["username"] || set["password"] || set["database"]
+	var haveInflux bool
+	for i := range cfg.Sinks {
+		s := &cfg.Sinks[i]
+		if s.Type != config.InfluxSink {
+			continue
+		}
+		haveInflux = true
+		if set["host"] {
+			s.URL = *f.host
+		}
+		if set["username"] {
+			s.Username = *f.username
+		}
+		if set["password"] {
+			s.Password = *f.password
+		}
+		if set["database"] {
+			s.Database = *f.database
+		}
+	}
+	if !haveInflux && ((*f.configFile == "" && *f.sqlite == "") || influxFlags) {
+		cfg.Sinks = append(cfg.Sinks, config.Sink{
+			Name:     config.InfluxSink,
+			Type:     config.InfluxSink,
+			URL:      *f.host,
+			Username: *f.username,
+			Password: *f.password,
+			Database: *f.database,
+		})
+	}
+
+	if *f.sqlite != "" {
+		cfg.Sinks = append(cfg.Sinks, config.Sink{
+			Name:   "sqlite",
+			Type:   config.SQLSink,
+			Driver: "sqlite3",
+			DSN:    *f.sqlite,
+			Schema: sink.NormalizedSchema,
+		})
+	}
+
+	if override("batch-size") {
+		// Left at 0 the default would quietly replace it
+		if *f.batchSize < 1 {
+			return nil, fmt.Errorf("--batch-size must be at least 1")
+		}
+		cfg.Batch.Size = *f.batchSize
+	}
+	if override("batch-interval") {
+		cfg.Batch.Interval = *f.batchInterval
+	}
+	if override("spool") {
+		cfg.Spool.Dir = *f.spoolDir
+	}
+	if override("spool-max-size") {
+		cfg.Spool.MaxSize = int64(*f.spoolSize)
+	}
+	if override("spool-max-age") {
+		cfg.Spool.MaxAge = *f.spoolAge
+	}
+	if override("retries") {
+		cfg.Retry.Retries = *f.retries
+	}
+	if override("retry-backoff") {
+		cfg.Retry.Backoff = *f.retryBackoff
+	}
+	if override("retry-backoff-max") {
+		cfg.Retry.BackoffMax = *f.retryBackoffMax
+	}
+	if override("dead-letter") {
+		cfg.DeadLetter = *f.deadLetterFile
+	}
+	if override("shutdown-timeout") {
+		cfg.ShutdownTimeout = *f.shutdownTimeout
+	}
+	if override("listen") {
+		cfg.Listen = *f.listen
+	}
+
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadIngestConfig is loadConfig for ingest, which also takes its inputs
+// from the flags.
+func loadIngestConfig() (*config.Config, error) {
+	cfg, err := ingestFlags.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	set := flagsSet()
+	if *input != "" {
+		cfg.Inputs = []config.Input{{
+			Type:         config.StatusInput,
+			Path:         *input,
+			Checkpoint:   *checkpointFile,
+			OnStart:      *loadOnStart,
+			Watch:        *watchMode,
+			PollInterval: *pollInterval,
+		}}
+	} else {
+		if set["checkpoint"] {
+			if len(cfg.Inputs) != 1 {
+				return nil, fmt.Errorf("--checkpoint can only be used with a single input, set checkpoint per input in %s", *ingestFlags.configFile)
+			}
+			cfg.Inputs[0].Checkpoint = *checkpointFile
+		}
+		for i := range cfg.Inputs {
+			if set["onstart"] {
+				cfg.Inputs[i].OnStart = *loadOnStart
+			}
+			if set["watch"] {
+				cfg.Inputs[i].Watch = *watchMode
+			}
+			if set["poll-interval"] {
+				cfg.Inputs[i].PollInterval = *pollInterval
+			}
+		}
+	}
+	if len(cfg.Inputs) == 0 {
+		return nil, fmt.Errorf("no input given, use --input or --config")
+	}
+	// The inputs from flags are checked as those of a configuration file
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
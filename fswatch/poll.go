@@ -0,0 +1,90 @@
+package fswatch
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bensallen/sqlios/nagios"
+)
+
+// fileState is what Poller compares to notice that the input was replaced.
+type fileState struct {
+	info    os.FileInfo
+	created int64
+}
+
+// changed reports whether the file was replaced or rewritten, by its inode,
+// size, modification time or info created time.
+func (s fileState) changed(other fileState) bool {
+	return !os.SameFile(s.info, other.info) ||
+		s.info.Size() != other.info.Size() ||
+		!s.info.ModTime().Equal(other.info.ModTime()) ||
+		s.created != other.created
+}
+
+// Poller checks the input file every interval, for filesystems such as NFS
+// where inotify events never fire, and sends it to filec each time it is
+// replaced. Like Watcher it does not send the file as it is when started.
+// Poller runs until ctx is done, and does not send to filec after it returns.
+func Poller(ctx context.Context, input *string, interval time.Duration, filec chan io.ReadCloser, errc chan error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last *fileState
+	// lastErr keeps a missing or unreadable input from being reported
+	// every interval
+	var lastErr string
+
+	for {
+		file, state, err := poll(*input)
+		if err != nil {
+			if err.Error() != lastErr {
+				errc <- err
+				lastErr = err.Error()
+			}
+		} else {
+			lastErr = ""
+			if last != nil && state.changed(*last) {
+				select {
+				case filec <- file:
+					file = nil
+				case <-ctx.Done():
+				}
+			}
+			last = &state
+			if file != nil {
+				file.Close()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll opens the input and returns it with its current state.
+func poll(input string) (*os.File, fileState, error) {
+	file, err := os.Open(input)
+	if err != nil {
+		return nil, fileState{}, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fileState{}, err
+	}
+	created, err := nagios.ScanCreated(file, input)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fileState{}, err
+	}
+	return file, fileState{info: info, created: created}, nil
+}
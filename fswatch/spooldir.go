@@ -0,0 +1,186 @@
+package fswatch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SpoolDir is a directory other programs drop files into, such as the
+// perfdata files moved there by the Nagios process-*-perfdata-file commands.
+// Each file is claimed by renaming it into WorkDir, which must be on the same
+// filesystem, and stays there until it is acknowledged or released.
+type SpoolDir struct {
+	Dir string
+	// WorkDir holds claimed files, by default .work inside Dir.
+	WorkDir string
+	// ArchiveDir is where acknowledged files are moved to, they are deleted
+	// if it is empty.
+	ArchiveDir string
+	// Interval is how often Dir is scanned, on top of when fsnotify reports
+	// a change.
+	Interval time.Duration
+	// Poll only scans every Interval, for filesystems such as NFS where
+	// inotify events never fire.
+	Poll bool
+	// Once makes Run return after claiming what is there when it starts.
+	Once bool
+	// Ready, if set, is the suffix of the empty file marking another as
+	// complete, such as the .ok of Nagios check result files. A file is
+	// only claimed once its marker exists, and the marker is removed with
+	// the claim.
+	Ready string
+}
+
+// Claim is a file claimed from a SpoolDir.
+type Claim struct {
+	// Path is where the claimed file is, in WorkDir.
+	Path string
+	// Recovered is set for files left claimed by a previous run.
+	Recovered bool
+}
+
+// Init creates WorkDir and ArchiveDir if needed.
+func (s *SpoolDir) Init() error {
+	if s.WorkDir == "" {
+		s.WorkDir = filepath.Join(s.Dir, ".work")
+	}
+	if err := os.MkdirAll(s.WorkDir, 0755); err != nil {
+		return err
+	}
+	if s.ArchiveDir != "" {
+		return os.MkdirAll(s.ArchiveDir, 0755)
+	}
+	return nil
+}
+
+// Ack removes a file once it has been processed, or moves it to ArchiveDir.
+func (s *SpoolDir) Ack(c *Claim) error {
+	if s.ArchiveDir == "" {
+		return os.Remove(c.Path)
+	}
+	return os.Rename(c.Path, filepath.Join(s.ArchiveDir, filepath.Base(c.Path)))
+}
+
+// Release hands a file that could not be processed back to Dir, to be
+// claimed again by a later scan.
+func (s *SpoolDir) Release(c *Claim) error {
+	return os.Rename(c.Path, filepath.Join(s.Dir, filepath.Base(c.Path)))
+}
+
+// files lists the regular files in dir oldest first. Hidden files, which
+// are usually still being written, are left alone.
+func files(dir string) ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []os.FileInfo
+	for _, info := range infos {
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+			found = append(found, info)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].ModTime().Before(found[j].ModTime())
+	})
+	return found, nil
+}
+
+// Run first sends the files left in WorkDir by a previous run to claimc, then
+// claims and sends each file that appears in Dir. It closes claimc once ctx
+// is done, or after the first scan when Once is set.
+func (s *SpoolDir) Run(ctx context.Context, claimc chan *Claim, errc chan error) {
+	defer close(claimc)
+
+	send := func(c *Claim) bool {
+		select {
+		case claimc <- c:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	leftover, err := files(s.WorkDir)
+	if err != nil {
+		errc <- err
+	}
+	for _, info := range leftover {
+		if !send(&Claim{Path: filepath.Join(s.WorkDir, info.Name()), Recovered: true}) {
+			return
+		}
+	}
+
+	// Without fsnotify, the directory is only scanned every Interval
+	var events chan struct{}
+	if !s.Once && !s.Poll {
+		if watcher, err := watch(s.Dir); err == nil {
+			defer watcher.Close()
+			events = make(chan struct{}, 1)
+			go func() {
+				for range watcher.Events {
+					select {
+					case events <- struct{}{}:
+					default:
+					}
+				}
+			}()
+		}
+	}
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		found, err := files(s.Dir)
+		if err != nil {
+			errc <- err
+		}
+		for _, info := range found {
+			var ready string
+			if s.Ready != "" {
+				if strings.HasSuffix(info.Name(), s.Ready) {
+					continue
+				}
+				ready = filepath.Join(s.Dir, info.Name()+s.Ready)
+				if _, err := os.Stat(ready); err != nil {
+					continue
+				}
+			}
+			c := &Claim{Path: filepath.Join(s.WorkDir, info.Name())}
+			// Another process may have claimed the file first
+			if err := os.Rename(filepath.Join(s.Dir, info.Name()), c.Path); err != nil {
+				if !os.IsNotExist(err) {
+					errc <- err
+				}
+				continue
+			}
+			if ready != "" {
+				if err := os.Remove(ready); err != nil && !os.IsNotExist(err) {
+					errc <- err
+				}
+			}
+			if !send(c) {
+				return
+			}
+		}
+
+		if s.Once {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+			// Give whatever is creating files a moment to finish
+			time.Sleep(quietPeriod)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package fswatch
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxTailBatch is roughly how many bytes of lines Tailer hands over at once.
+const maxTailBatch = 1 << 20
+
+// TailState is how far a Tailer got through its file.
+type TailState struct {
+	// Offset is just past the last line that was handled.
+	Offset int64 `json:"offset"`
+	// FirstLine is a hash of the first line of the file, which tells the
+	// file the offset belongs to from one that replaced it while stopped.
+	FirstLine string `json:"first_line"`
+}
+
+// LoadTailState reads a TailState from path. A missing file is not an error,
+// an empty TailState is returned instead.
+func LoadTailState(path string) (*TailState, error) {
+	var state TailState
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Save atomically writes the state to path.
+func (s *TailState) Save(path string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// hashLine returns the hash of a line as saved in TailState.
+func hashLine(line string) string {
+	sum := sha256.Sum256([]byte(line))
+	return hex.EncodeToString(sum[:])
+}
+
+// firstLine returns the hash of the first line in file, or "" if it has no
+// complete line yet.
+func firstLine(file *os.File) (string, error) {
+	line, err := bufio.NewReader(io.NewSectionReader(file, 0, maxTailBatch)).ReadString('\n')
+	if err == io.EOF {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return hashLine(line), nil
+}
+
+// Tailer follows a growing, line oriented file such as nagios.log.
+type Tailer struct {
+	Path string
+	// StatePath is where the TailState is saved after each batch of lines,
+	// empty to not save it.
+	StatePath string
+	// Interval is how often Path is checked for new lines, rotation and
+	// truncation, on top of when fsnotify reports a change.
+	Interval time.Duration
+	// Poll only checks every Interval, for filesystems such as NFS where
+	// inotify events never fire.
+	Poll bool
+	// Once makes Run return once it has reached the end of the file.
+	Once bool
+
+	file  *os.File
+	state *TailState
+}
+
+// Run passes complete lines, without their newline, to handle in batches. The
+// offset only moves past a batch once handle returns nil, a batch that fails
+// is handed over again on the next check, so lines are neither lost nor
+// repeated across restarts. Should SQLios be killed before the state is
+// saved, the last batch is handled again.
+// A file that was rotated is read to the end before the new one is opened,
+// and a file that was truncated is read again from the start.
+// Run returns once ctx is done, or at the end of the file when Once is set.
+func (t *Tailer) Run(ctx context.Context, handle func(lines []string) error, errc chan error) {
+	t.state = &TailState{}
+	if t.StatePath != "" {
+		state, err := LoadTailState(t.StatePath)
+		if err != nil {
+			errc <- err
+		} else {
+			t.state = state
+		}
+	}
+	defer func() {
+		if t.file != nil {
+			t.file.Close()
+		}
+	}()
+
+	// Without fsnotify, the file is only checked every Interval
+	var events chan struct{}
+	if !t.Once && !t.Poll {
+		if watcher, err := watch(filepath.Dir(t.Path)); err == nil {
+			defer watcher.Close()
+			events = make(chan struct{}, 1)
+			go func() {
+				for range watcher.Events {
+					select {
+					case events <- struct{}{}:
+					default:
+					}
+				}
+			}()
+		}
+	}
+
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+
+	// lastErr keeps a missing or unreadable file from being reported every
+	// interval
+	var lastErr string
+	for {
+		if err := t.check(handle); err != nil {
+			if err.Error() != lastErr {
+				errc <- err
+				lastErr = err.Error()
+			}
+		} else {
+			lastErr = ""
+		}
+
+		if t.Once {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+		case <-ticker.C:
+		}
+	}
+}
+
+// check opens the file if needed, hands over the lines appended since the
+// last check, and then follows a rotation or truncation.
+func (t *Tailer) check(handle func(lines []string) error) error {
+	if t.file == nil {
+		if err := t.open(); err != nil {
+			return err
+		}
+	}
+	if err := t.read(handle, false); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(t.Path)
+	if os.IsNotExist(err) {
+		// Rotated away and not replaced yet
+		return nil
+	} else if err != nil {
+		return err
+	}
+	current, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !os.SameFile(info, current):
+		// Lines may have been written between the read and the rotation,
+		// and the last one can no longer be finished
+		if err := t.read(handle, true); err != nil {
+			return err
+		}
+		log.Printf("%s was rotated, following the new file", t.Path)
+		t.file.Close()
+		t.file = nil
+		t.reset()
+		return t.open()
+	case current.Size() < t.state.Offset:
+		log.Printf("Warning, %s was truncated, reading it from the start", t.Path)
+		t.reset()
+	}
+	return nil
+}
+
+// open opens the file, carrying on from the saved offset if its first line
+// is the one the offset belongs to.
+func (t *Tailer) open() error {
+	file, err := os.Open(t.Path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	hash, err := firstLine(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if t.state.Offset > 0 && (hash != t.state.FirstLine || info.Size() < t.state.Offset) {
+		log.Printf("Warning, %s was replaced while stopped, reading it from the start", t.Path)
+		t.reset()
+	}
+	t.file = file
+	return nil
+}
+
+// reset starts the state over for a new file.
+func (t *Tailer) reset() {
+	t.state.Offset = 0
+	t.state.FirstLine = ""
+	t.save()
+}
+
+func (t *Tailer) save() {
+	if t.StatePath == "" {
+		return
+	}
+	if err := t.state.Save(t.StatePath); err != nil {
+		log.Printf("Error, saving tail state: %s", err)
+	}
+}
+
+// read hands over the complete lines from the offset to the end of the file,
+// and with final set a last line without a newline as well.
+func (t *Tailer) read(handle func(lines []string) error, final bool) error {
+	for {
+		buf := bufio.NewReader(io.NewSectionReader(t.file, t.state.Offset, 1<<62))
+		var lines []string
+		var n int64
+		var first string
+		for n < maxTailBatch {
+			line, err := buf.ReadString('\n')
+			if err == io.EOF && (!final || line == "") {
+				break
+			} else if err != nil && err != io.EOF {
+				return err
+			}
+			n += int64(len(line))
+			if t.state.Offset == 0 && len(lines) == 0 {
+				first = hashLine(line)
+			}
+			lines = append(lines, strings.TrimRight(line, "\r\n"))
+		}
+		if len(lines) == 0 {
+			return nil
+		}
+
+		if err := handle(lines); err != nil {
+			return err
+		}
+		if first != "" {
+			t.state.FirstLine = first
+		}
+		t.state.Offset += n
+		t.save()
+	}
+}
@@ -1,106 +1,105 @@
 package fswatch
 
 import (
+	"context"
+	"io"
 	"log"
 	"os"
-	"path"
-	"regexp"
+	"path/filepath"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
-// Watch watches a given path for file system events. It can filter the events it returns based
-// on a regex filter.
-func watch(path string, filter string, eventc chan *fsnotify.Event, errc chan error) {
+// quietPeriod is how long the input must go without events before it is
+// considered replaced, so a burst of events leads to a single read.
+const quietPeriod = 500 * time.Millisecond
 
-	fileInfo, err := os.Stat(path)
+// watch returns a watcher on dir.
+func watch(dir string) (*fsnotify.Watcher, error) {
+	fileInfo, err := os.Stat(dir)
 	if err != nil {
-		errc <- err
-		return
+		return nil, err
 	}
-	isDir := fileInfo.IsDir()
-
-	re, err := regexp.Compile(filter)
-	if err != nil {
-		errc <- err
-		return
+	if !fileInfo.IsDir() {
+		return nil, &os.PathError{Op: "watch", Path: dir, Err: os.ErrInvalid}
 	}
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		errc <- err
-		return
+		return nil, err
 	}
-
-	go func() {
-		for {
-			select {
-			case event := <-watcher.Events:
-				if filter != "" && re.MatchString(event.Name) {
-					//log.Println("event:", event)
-					eventc <- &event
-				} else if filter == "" {
-					//log.Println("event:", event)
-					eventc <- &event
-				}
-				if event.Op&fsnotify.Remove == fsnotify.Remove && isDir == false {
-					for {
-						err = watcher.Add(path)
-						if err == nil {
-							break
-						}
-						log.Print(err)
-						time.Sleep(1 * time.Second)
-					}
-				}
-			case err := <-watcher.Errors:
-				//errc <- err
-				log.Print(err)
-			}
-		}
-	}()
-
-	err = watcher.Add(path)
-	if err != nil {
-		errc <- err
-		return
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, err
 	}
-	return
+	return watcher, nil
 }
 
-// Watcher watches the input file using inotify, knotifyd, etc for CREATE events.
-// Nagios does atomic updates of status.dat by writting out to a temporary file,
-// removing status.dat and moving the temporary file to status.dat. The last
-// event seen in this process is a CREATE, so we use that to kick off reading.
-// Watcher waits on the done chan forever.
-func Watcher(input *string, filec chan *os.File, done chan bool, errc chan error) {
+// replaced reports whether event means input was replaced or written to.
+// Nagios 3 removes status.dat and renames a temporary file over it, Nagios 4,
+// Naemon and Icinga only rename, both of which end in a Create of input.
+func replaced(event fsnotify.Event, input string) bool {
+	return filepath.Clean(event.Name) == input && event.Op&(fsnotify.Create|fsnotify.Write) != 0
+}
 
-	path := path.Dir(*input)
+// Watcher watches the directory of the input file using inotify, kqueue, etc
+// and sends the input to filec once it has been replaced or written to and
+// then left alone for quietPeriod. The directory is watched rather than the
+// file, as a watch on the file is lost when it is replaced.
+// If the watch can't be added and pollInterval is non-zero, Watcher falls back
+// to Poller.
+// Watcher runs until ctx is done, and does not send to filec after it returns.
+func Watcher(ctx context.Context, input *string, pollInterval time.Duration, filec chan io.ReadCloser, errc chan error) {
 
-	dir, err := os.Stat(path)
+	name := filepath.Clean(*input)
 
-	if err != nil || !dir.IsDir() {
-		log.Fatalf("Parent directory of input: %s, could not stat or is not a directory, watcher bailing!", path)
+	watcher, err := watch(filepath.Dir(name))
+	if err != nil {
+		if pollInterval == 0 {
+			errc <- err
+			<-ctx.Done()
+			return
+		}
+		log.Printf("Warning, could not watch %s, polling it every %s instead: %s", filepath.Dir(name), pollInterval, err)
+		Poller(ctx, input, pollInterval, filec, errc)
+		return
 	}
-
-	var eventc = make(chan *fsnotify.Event, 128)
-
-	go func() {
-		for event := range eventc {
-			// TODO: What does this notation actually mean?
-			if event.Op&fsnotify.Create == fsnotify.Create {
-				file, err := os.Open(*input)
-				if err != nil {
-					errc <- err
-				}
-				filec <- file
+	defer watcher.Close()
+
+	// quiet fires once the input has had no events for quietPeriod, it is
+	// nil while there are none pending
+	var quiet <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if replaced(event, name) {
+				quiet = time.After(quietPeriod)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			errc <- err
+		case <-quiet:
+			quiet = nil
+			file, err := os.Open(name)
+			if err != nil {
+				errc <- err
+				continue
+			}
+			select {
+			case filec <- file:
+			case <-ctx.Done():
+				file.Close()
+				return
 			}
 		}
-	}()
-
-	watch(path, *input, eventc, errc)
-
-	//Wait until someone tells us we're done
-	<-done
+	}
 }
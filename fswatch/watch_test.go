@@ -0,0 +1,328 @@
+package fswatch
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestPoller(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fswatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "status.dat")
+	// replace writes a new status.dat the way Nagios does, to a temporary
+	// file renamed over the old one
+	replace := func(created string) {
+		tmp := filepath.Join(dir, "status.tmp")
+		if err := ioutil.WriteFile(tmp, []byte("info {\n\tcreated="+created+"\n\t}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, input); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replace("100")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var filec = make(chan io.ReadCloser)
+	var errc = make(chan error, 10)
+	go Poller(ctx, &input, 10*time.Millisecond, filec, errc)
+
+	select {
+	case file := <-filec:
+		file.Close()
+		t.Fatal("Poller() sent the input before it was replaced")
+	case err := <-errc:
+		t.Fatalf("Poller() error = %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	replace("200")
+	select {
+	case file := <-filec:
+		b, _ := ioutil.ReadAll(file)
+		file.Close()
+		if want := "info {\n\tcreated=200\n\t}\n"; string(b) != want {
+			t.Errorf("Poller() sent %q, want %q", b, want)
+		}
+	case err := <-errc:
+		t.Fatalf("Poller() error = %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("Poller() did not send the replaced input")
+	}
+}
+
+func Test_replaced(t *testing.T) {
+	tests := []struct {
+		name  string
+		event fsnotify.Event
+		want  bool
+	}{
+		{"Renamed over", fsnotify.Event{Name: "/var/nagios/status.dat", Op: fsnotify.Create}, true},
+		{"Written", fsnotify.Event{Name: "/var/nagios/status.dat", Op: fsnotify.Write}, true},
+		{"Unclean path", fsnotify.Event{Name: "/var/nagios//status.dat", Op: fsnotify.Create}, true},
+		{"Removed", fsnotify.Event{Name: "/var/nagios/status.dat", Op: fsnotify.Remove}, false},
+		{"Renamed away", fsnotify.Event{Name: "/var/nagios/status.dat", Op: fsnotify.Rename}, false},
+		{"Temporary file", fsnotify.Event{Name: "/var/nagios/status.dat.tmp", Op: fsnotify.Create}, false},
+		{"Not a regexp", fsnotify.Event{Name: "/var/nagios/statusXdat", Op: fsnotify.Create}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replaced(tt.event, "/var/nagios/status.dat"); got != tt.want {
+				t.Errorf("replaced() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fswatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "status.dat")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var filec = make(chan io.ReadCloser, 10)
+	var errc = make(chan error, 10)
+	go Watcher(ctx, &input, 0, filec, errc)
+	time.Sleep(50 * time.Millisecond)
+
+	// A burst of replacements, and writes to other files, is read once
+	for i := 0; i < 5; i++ {
+		tmp := filepath.Join(dir, "status.dat.tmp")
+		if err := ioutil.WriteFile(tmp, []byte("info {\n\t}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, input); err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(filepath.Join(dir, "statusXdat"), nil, 0644)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case file := <-filec:
+		file.Close()
+	case err := <-errc:
+		t.Fatalf("Watcher() error = %v", err)
+	case <-time.After(5 * quietPeriod):
+		t.Fatal("Watcher() did not send the replaced input")
+	}
+	select {
+	case file := <-filec:
+		file.Close()
+		t.Error("Watcher() sent the input more than once for a burst of events")
+	case <-time.After(2 * quietPeriod):
+	}
+}
+
+func TestSpoolDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fswatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool := &SpoolDir{Dir: dir, ArchiveDir: filepath.Join(dir, "archive"), Interval: 10 * time.Millisecond}
+	if err := spool.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// One file left claimed by a previous run, one waiting and one still
+	// being written
+	for _, path := range []string{filepath.Join(spool.WorkDir, "old"), filepath.Join(dir, "new"), filepath.Join(dir, ".partial")} {
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var claimc = make(chan *Claim)
+	var errc = make(chan error, 10)
+	go spool.Run(ctx, claimc, errc)
+
+	next := func() *Claim {
+		select {
+		case c := <-claimc:
+			return c
+		case err := <-errc:
+			t.Fatalf("Run() error = %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("Run() did not claim a file")
+		}
+		return nil
+	}
+
+	if c := next(); c.Path != filepath.Join(spool.WorkDir, "old") || !c.Recovered {
+		t.Errorf("Run() first claim = %+v, want the recovered file", c)
+	}
+
+	c := next()
+	if c.Path != filepath.Join(spool.WorkDir, "new") || c.Recovered {
+		t.Fatalf("Run() second claim = %+v, want new", c)
+	}
+	// Released files are claimed again
+	if err := spool.Release(c); err != nil {
+		t.Fatal(err)
+	}
+	c = next()
+	if err := spool.Ack(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(spool.ArchiveDir, "new")); err != nil {
+		t.Errorf("Ack() did not archive the file: %v", err)
+	}
+
+	select {
+	case c := <-claimc:
+		t.Errorf("Run() claimed %s", c.Path)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSpoolDir_ready(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fswatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool := &SpoolDir{Dir: dir, Interval: time.Second, Once: true, Ready: ".ok"}
+	if err := spool.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// Only the file with its marker is complete
+	for _, name := range []string{"done", "done.ok", "partial"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var claimc = make(chan *Claim, 10)
+	var errc = make(chan error, 10)
+	spool.Run(context.Background(), claimc, errc)
+	var claimed []string
+	for c := range claimc {
+		claimed = append(claimed, filepath.Base(c.Path))
+	}
+	if want := []string{"done"}; !reflect.DeepEqual(claimed, want) {
+		t.Errorf("Run() claimed %v, want %v", claimed, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "done.ok")); !os.IsNotExist(err) {
+		t.Errorf("Run() left the marker of the claimed file, Stat() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partial")); err != nil {
+		t.Errorf("Run() claimed the file without a marker: %v", err)
+	}
+}
+
+func TestTailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fswatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "nagios.log")
+	state := filepath.Join(dir, "nagios.log.state")
+	appendTo := func(path, s string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(s)
+		f.Close()
+	}
+	// once runs a new Tailer to the end of the file, as after a restart
+	once := func(fail bool) []string {
+		var got []string
+		var errc = make(chan error, 10)
+		tailer := &Tailer{Path: path, StatePath: state, Interval: time.Second, Once: true}
+		tailer.Run(context.Background(), func(lines []string) error {
+			got = append(got, lines...)
+			if fail {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}, errc)
+		if len(errc) > 0 && !fail {
+			t.Fatalf("Run() error = %v", <-errc)
+		}
+		return got
+	}
+
+	steps := []struct {
+		name   string
+		append string
+		fail   bool
+		want   []string
+	}{
+		{"Start", "a\nb\n", false, []string{"a", "b"}},
+		{"Partial line", "c\nd", false, []string{"c"}},
+		{"Line finished", "\n", false, []string{"d"}},
+		{"Handler fails", "e\n", true, []string{"e"}},
+		{"Retried", "", false, []string{"e"}},
+		{"Nothing new", "", false, nil},
+	}
+	for _, step := range steps {
+		appendTo(path, step.append)
+		if got := once(step.fail); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: Run() lines = %q, want %q", step.name, got, step.want)
+		}
+	}
+
+	// Replaced while stopped by a file with a different first line
+	if err := ioutil.WriteFile(path, []byte("x\ny\nz\nzz\nzzz\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := once(false), []string{"x", "y", "z", "zz", "zzz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Replaced: Run() lines = %q, want %q", got, want)
+	}
+
+	// Rotated while running, with a line written to the old file late
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var linec = make(chan string, 10)
+	var errc = make(chan error, 10)
+	tailer := &Tailer{Path: path, StatePath: state, Interval: 10 * time.Millisecond, Poll: true}
+	go tailer.Run(ctx, func(lines []string) error {
+		for _, line := range lines {
+			linec <- line
+		}
+		return nil
+	}, errc)
+
+	time.Sleep(50 * time.Millisecond)
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendTo(path+".1", "late\n")
+	appendTo(path, "new\n")
+	for _, want := range []string{"late", "new"} {
+		select {
+		case got := <-linec:
+			if got != want {
+				t.Errorf("Rotated: Run() line = %q, want %q", got, want)
+			}
+		case err := <-errc:
+			t.Fatalf("Run() error = %v", err)
+		case <-time.After(time.Second):
+			t.Fatalf("Rotated: Run() did not send %q", want)
+		}
+	}
+}
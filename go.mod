@@ -3,10 +3,12 @@ module github.com/bensallen/sqlios
 require (
 	github.com/alecthomas/kingpin v2.2.6+incompatible
 	github.com/alecthomas/template v0.0.0-20160405071501-a0175ee3bccc // indirect
-	github.com/alecthomas/units v0.0.0-20151022065526-2efee857e7cf // indirect
+	github.com/alecthomas/units v0.0.0-20151022065526-2efee857e7cf
 	github.com/fsnotify/fsnotify v1.4.7
 	github.com/influxdata/influxdb v1.6.0
-	github.com/jprichardson/readline-go v0.0.0-20141125135210-69d39989b17e
+	github.com/lib/pq v1.0.0
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/pkg/profile v1.2.1
 	golang.org/x/sys v0.0.0-20180727230415-bd9dbc187b6e // indirect
+	gopkg.in/yaml.v2 v2.2.1
 )
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bensallen/sqlios/config"
+	"github.com/bensallen/sqlios/nagios"
+	"github.com/bensallen/sqlios/sink"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// pipeline is what ingest and replay share: the block parsers and Uploaders,
+// and the supervisor running the outputs behind them. Blocks are fed to
+// blockc.
+type pipeline struct {
+	cfg *config.Config
+	sup *supervisor
+
+	blockc chan nagios.Block
+	pointc chan *client.Point
+	//Reader pushes a true to this channel at the end of each file. Uploader
+	//consumes it to know when to print off the count of uploaded points
+	endOfFile chan bool
+	errc      chan error
+	sigc      chan os.Signal
+
+	// ctx is cancelled on SIGINT or SIGTERM to stop taking in new files.
+	// drainCtx is cancelled once the shutdown timeout passes after that,
+	// abandoning whatever has not been flushed by then.
+	ctx         context.Context
+	cancel      context.CancelFunc
+	drainCtx    context.Context
+	drainCancel context.CancelFunc
+
+	deadLetter     *sink.DeadLetter
+	wgUploaders    sync.WaitGroup
+	wgBlockParsers sync.WaitGroup
+}
+
+// startPipeline starts the outputs described by cfg, and the block parsers
+// and Uploaders feeding them.
+func startPipeline(f *pipelineFlags, cfg *config.Config) *pipeline {
+	var NCPU = runtime.NumCPU()
+	runtime.GOMAXPROCS(NCPU)
+	var numUploaders = NCPU * 2
+	var numBlockParsers = NCPU * 2
+
+	if *f.cpus != 0 {
+		runtime.GOMAXPROCS(*f.cpus)
+		numUploaders = *f.cpus * 2
+		numBlockParsers = *f.cpus * 2
+	}
+
+	p := &pipeline{
+		cfg:       cfg,
+		blockc:    make(chan nagios.Block, 100),
+		pointc:    make(chan *client.Point, 100),
+		endOfFile: make(chan bool),
+		errc:      make(chan error, 10),
+		sigc:      make(chan os.Signal, 1),
+	}
+
+	var err error
+	if cfg.DeadLetter != "" {
+		p.deadLetter, err = sink.OpenDeadLetter(cfg.DeadLetter)
+		if err != nil {
+			log.Fatalf("sink.OpenDeadLetter: %s", err)
+		}
+	}
+
+	// Startup an err channel handler
+	go func() {
+		for err := range p.errc {
+			log.Printf("Error, %s", err)
+		}
+	}()
+
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.drainCtx, p.drainCancel = context.WithCancel(context.Background())
+
+	signal.Notify(p.sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	queueLength.Set("blocks", func() float64 { return float64(len(p.blockc)) })
+	queueLength.Set("points", func() float64 { return float64(len(p.pointc)) })
+
+	p.sup = newSupervisor(p.ctx, p.drainCtx, p.blockc, p.endOfFile, p.errc, p.deadLetter)
+	if cfg.Schema.Checkpoint != "" {
+		if p.sup.schema, err = nagios.LoadSchema(cfg.Schema.Checkpoint); err != nil {
+			log.Fatalf("nagios.LoadSchema: %s", err)
+		}
+	}
+	if cfg.Listen != "" {
+		serveHTTP(cfg.Listen, p.sup)
+	}
+	if err := p.sup.apply(cfg); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	// Startup the Uploaders
+	p.wgUploaders.Add(numUploaders)
+	for i := 0; i < numUploaders; i++ {
+		go func() {
+			nagios.Uploader(p.drainCtx, nagios.Batch{Size: cfg.Batch.Size, Interval: cfg.Batch.Interval}, p.sup.write, p.pointc, p.endOfFile, p.errc)
+			p.wgUploaders.Done()
+		}()
+	}
+
+	// Startup the Block parsers
+	p.wgBlockParsers.Add(numBlockParsers)
+	for i := 0; i < numBlockParsers; i++ {
+		go func() {
+			nagios.ParseBlock(p.drainCtx, p.sup.rules, p.blockc, p.pointc, p.errc)
+			p.wgBlockParsers.Done()
+		}()
+	}
+
+	return p
+}
+
+// shutdown starts the shutdown timeout after sig.
+func (p *pipeline) shutdown(sig os.Signal) {
+	log.Printf("Received %s, finishing the current file and flushing", sig)
+	time.AfterFunc(p.cfg.ShutdownTimeout, p.drainCancel)
+}
+
+// stop stops taking in new files, waits for stopInputs to return once the
+// inputs have finished with the file they are on, and flushes everything
+// read to the sinks. If the shutdown timeout passes first whatever hasn't
+// been written is abandoned, left in the spools if there are any, and stop
+// returns false once the outputs are closed. Writes in progress then still
+// get the shutdown timeout again to finish before stop gives up on them
+// too, leaving the outputs open. Once the outputs are closed stop closes the
+// dead letter file and errc, otherwise they are left open for the writes
+// still in progress until the process exits.
+func (p *pipeline) stop(stopInputs func()) bool {
+	p.cancel()
+
+	drained := make(chan struct{})
+	go func() {
+		//The following needs to be in this specfic order of closes and waits to
+		//avoid panics from emitting or reading from a closed channel
+
+		//Stop the Watchers and wait for the Readers to finish their current file
+		stopInputs()
+
+		//Close blockc so influxios.ParseBlock will exit
+		close(p.blockc)
+		p.wgBlockParsers.Wait()
+
+		//Close seriesc so influxios.Uploader will exit
+		close(p.pointc)
+		p.wgUploaders.Wait()
+
+		//Close the spools so the drainers exit once they have replayed what they can
+		p.sup.stopOutputs()
+		close(drained)
+	}()
+
+	flushed := true
+	select {
+	case <-drained:
+	case <-p.drainCtx.Done():
+		log.Printf("Error, shutdown timeout of %s passed before all points were flushed, not saving checkpoints", p.cfg.ShutdownTimeout)
+		flushed = false
+		select {
+		case <-drained:
+		case <-time.After(p.cfg.ShutdownTimeout):
+			log.Printf("Error, writes in progress didn't finish, exiting without closing the sinks")
+			p.drainCancel()
+			return false
+		}
+	}
+	p.drainCancel()
+
+	if p.deadLetter != nil {
+		p.deadLetter.Close()
+	}
+	//Finally close errc so the error handler exits
+	close(p.errc)
+	return flushed
+}
+
+// runIngest reads the inputs as they are updated until SIGINT or SIGTERM, or
+// once when running with --oneshot. Checkpoints are only saved if everything
+// read was flushed to the sinks, otherwise the next run reads it again.
+func runIngest() int {
+	cfg, err := loadIngestConfig()
+	if err != nil {
+		log.Fatalf("loadConfig: %s", err)
+	}
+
+	p := startPipeline(ingestFlags, cfg)
+
+	// When running once the inputs finish on their own
+	var inputsDone = make(chan struct{})
+	if *oneshot {
+		go func() {
+			p.sup.wait()
+			close(inputsDone)
+		}()
+	}
+
+	// Wait for the inputs to finish or a signal to stop, reloading the
+	// configuration on SIGHUP in the meantime
+run:
+	for {
+		select {
+		case <-inputsDone:
+			break run
+		case sig := <-p.sigc:
+			if sig != syscall.SIGHUP {
+				p.shutdown(sig)
+				break run
+			}
+
+			log.Printf("Received %s, reloading configuration", sig)
+			newCfg, err := loadIngestConfig()
+			if err != nil {
+				log.Printf("Error, reloading configuration, keeping the running one: %s", err)
+				continue
+			}
+			if err := p.sup.apply(newCfg); err != nil {
+				log.Printf("Error, applying the configuration, keeping the running one: %s", err)
+				continue
+			}
+			p.cfg = newCfg
+		}
+	}
+
+	if p.stop(p.sup.stopInputs) {
+		p.sup.saveCheckpoints()
+	}
+	return 0
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bensallen/sqlios/config"
+	"github.com/bensallen/sqlios/nagios"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// readPoints parses the status.dat at path, which may be compressed, passing
+// any errors to errFn.
+func readPoints(path string, rules *nagios.Rules, tags map[string]string, errFn func(error)) ([]*client.Point, error) {
+	file, err := nagios.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return nagios.ParseFile(file, rules, tags, errFn), nil
+}
+
+// jsonPoint is how parse prints a point as JSON.
+type jsonPoint struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        time.Time              `json:"time"`
+}
+
+// runParse prints the points parsed from a status.dat, one per line.
+func runParse() int {
+	var rules = &nagios.Rules{Schema: nagios.NewSchema(), Floats: true}
+	if *parseConfig != "" {
+		cfg, err := config.Load(*parseConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error, %s\n", err)
+			return 1
+		}
+		if rules, err = newRules(cfg, rules.Schema); err != nil {
+			fmt.Fprintf(os.Stderr, "Error, %s\n", err)
+			return 1
+		}
+	}
+
+	var failed bool
+	points, err := readPoints(*parseFile, rules, nil, func(err error) {
+		fmt.Fprintf(os.Stderr, "Error, %s\n", err)
+		failed = true
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error, %s\n", err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, point := range points {
+		if *parseFormat == "line" {
+			fmt.Println(point.String())
+			continue
+		}
+		fields, err := point.Fields()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error, %s\n", err)
+			failed = true
+			continue
+		}
+		enc.Encode(jsonPoint{
+			Measurement: point.Name(),
+			Tags:        point.Tags(),
+			Fields:      fields,
+			Time:        point.Time().UTC(),
+		})
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// runValidate reports every error parsing the given files in line order,
+// and fails if there were any.
+func runValidate() int {
+	var errors int
+	for _, path := range *validateFiles {
+		var errs []error
+		_, err := readPoints(path, nil, nil, func(err error) {
+			errs = append(errs, err)
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		// Errors come from the Reader and the block parsers as they are
+		// found, those without a line number go first
+		line := func(err error) int {
+			if e, ok := err.(*nagios.ParseError); ok {
+				return e.Line
+			}
+			return 0
+		}
+		sort.SliceStable(errs, func(i, j int) bool { return line(errs[i]) < line(errs[j]) })
+
+		for _, err := range errs {
+			if e, ok := err.(*nagios.ParseError); ok {
+				fmt.Printf("%s:%d: %s: %s\n", path, e.Line, e.Block, e.Err)
+			} else {
+				fmt.Printf("%s: %s\n", path, err)
+			}
+		}
+		errors += len(errs)
+	}
+
+	if errors > 0 {
+		fmt.Printf("%d errors\n", errors)
+		return 1
+	}
+	return 0
+}
+
+// pointKey identifies a point across snapshots by its measurement and tags.
+func pointKey(point *client.Point) string {
+	tags := point.Tags()
+	var keys = make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var key = point.Name()
+	for _, k := range keys {
+		key += "," + k + "=" + tags[k]
+	}
+	return key
+}
+
+// snapshot parses path into its points' fields by pointKey. Points with the
+// same key, such as several comments on a host, are numbered in file order.
+func snapshot(path string) (map[string]map[string]interface{}, error) {
+	var errs []string
+	points, err := readPoints(path, nil, nil, func(err error) {
+		errs = append(errs, err.Error())
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s: %s", path, strings.Join(errs, ", "))
+	}
+
+	var snap = make(map[string]map[string]interface{}, len(points))
+	var seen = make(map[string]int)
+	for _, point := range points {
+		key := pointKey(point)
+		if n := seen[key]; n > 0 {
+			seen[key]++
+			key = fmt.Sprintf("%s#%d", key, n+1)
+		} else {
+			seen[key] = 1
+		}
+		fields, err := point.Fields()
+		if err != nil {
+			return nil, err
+		}
+		// The key changes with the time of each check
+		delete(fields, nagios.KeyField)
+		snap[key] = fields
+	}
+	return snap, nil
+}
+
+func sortedFields(m map[string]interface{}) []string {
+	var keys = make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// runDiff prints the points added, removed and changed between two
+// snapshots, and fails if there were any.
+func runDiff() int {
+	from, err := snapshot(*diffFrom)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error, %s\n", err)
+		return 2
+	}
+	to, err := snapshot(*diffTo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error, %s\n", err)
+		return 2
+	}
+
+	var keys []string
+	for key := range from {
+		keys = append(keys, key)
+	}
+	for key := range to {
+		if _, ok := from[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var changed bool
+	for _, key := range keys {
+		oldFields, inFrom := from[key]
+		newFields, inTo := to[key]
+		switch {
+		case !inFrom:
+			fmt.Printf("+ %s\n", key)
+			changed = true
+		case !inTo:
+			fmt.Printf("- %s\n", key)
+			changed = true
+		default:
+			var lines []string
+			for _, field := range sortedFields(oldFields) {
+				newValue, ok := newFields[field]
+				if !ok {
+					lines = append(lines, fmt.Sprintf("    - %s: %v", field, oldFields[field]))
+				} else if fmt.Sprint(newValue) != fmt.Sprint(oldFields[field]) {
+					lines = append(lines, fmt.Sprintf("    %s: %v -> %v", field, oldFields[field], newValue))
+				}
+			}
+			for _, field := range sortedFields(newFields) {
+				if _, ok := oldFields[field]; !ok {
+					lines = append(lines, fmt.Sprintf("    + %s: %v", field, newFields[field]))
+				}
+			}
+			if len(lines) > 0 {
+				fmt.Printf("~ %s\n%s\n", key, strings.Join(lines, "\n"))
+				changed = true
+			}
+		}
+	}
+
+	if changed {
+		return 1
+	}
+	return 0
+}
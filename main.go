@@ -1,49 +1,77 @@
 package main
 
 import (
+	"io/ioutil"
 	"log"
 	"os"
-	"runtime"
-	"sync"
 
 	"github.com/alecthomas/kingpin"
-	"github.com/bensallen/sqlios/fswatch"
+	"github.com/bensallen/sqlios/config"
 	"github.com/bensallen/sqlios/nagios"
-	"github.com/influxdata/influxdb/client/v2"
 	"github.com/pkg/profile"
 )
 
 //Cmd line flags
 var (
-	input       = kingpin.Flag("input", "Input file").Required().Short('i').String()
-	cpus        = kingpin.Flag("cpus", "Max number of CPUs to use").Short('c').Int()
-	noop        = kingpin.Flag("noop", "Don't actually push any data to InfluxDB, just print the JSON output").Short('n').Bool()
-	oneshot     = kingpin.Flag("oneshot", "Run once in the foreground and exit").Short('o').Bool()
-	verbose     = kingpin.Flag("verbose", "Output more verbose information").Short('v').Bool()
-	debug       = kingpin.Flag("debug", "Print debug output").Short('d').Bool()
-	host        = kingpin.Flag("host", "InfluxDB host to connect to").Default("http://localhost:8086").Short('h').String()
-	username    = kingpin.Flag("username", "InfluxDB user name to authenticate as").Default("root").Short('u').String()
-	password    = kingpin.Flag("password", "Password to authenticate with").Default("root").Short('p').String()
-	database    = kingpin.Flag("database", "InfluxDB database to connect to").Short('D').String()
-	loadOnStart = kingpin.Flag("onstart", "Force input file to be loaded on start, do not wait for the file to be updated").Short('O').Bool()
-	jsonOut     = kingpin.Flag("json", "Print out JSON output of data").Short('J').Bool()
-	profileOut  = kingpin.Flag("profile", "Enable profile output").Short('P').String()
-	startTime   = kingpin.Flag("last", "Specify epoch seconds as the start time, only entries after this time will be uploaded").Short('s').Int()
+	verbose    = kingpin.Flag("verbose", "Output more verbose information").Short('v').Bool()
+	debug      = kingpin.Flag("debug", "Print debug output").Short('d').Bool()
+	profileOut = kingpin.Flag("profile", "Enable profile output").Short('P').String()
+
+	//ingest, the default command, runs as a daemon reading inputs as they are updated
+	ingestCmd      = kingpin.Command("ingest", "Read inputs as they are updated and write them to the sinks").Default()
+	ingestFlags    = addPipelineFlags(ingestCmd)
+	input          = ingestCmd.Flag("input", "Input file").Short('i').String()
+	oneshot        = ingestCmd.Flag("oneshot", "Read the inputs once in the foreground and exit").Short('o').Bool()
+	loadOnStart    = ingestCmd.Flag("onstart", "Force input file to be loaded on start, do not wait for the file to be updated").Short('O').Bool()
+	startTime      = ingestCmd.Flag("last", "Specify epoch seconds as the start time, only entries after this time will be uploaded").Short('s').Int()
+	checkpointFile = ingestCmd.Flag("checkpoint", "File to save the created time of the last read input to, so a restart does not upload it again").String()
+	watchMode      = ingestCmd.Flag("watch", "How to notice the input being replaced: fsnotify, poll, or auto to poll if fsnotify can't watch it").Default(config.AutoWatch).Enum(config.AutoWatch, config.NotifyWatch, config.PollWatch)
+	pollInterval   = ingestCmd.Flag("poll-interval", "How often to check the input when polling").Default("5s").Duration()
+
+	//replay writes archived status.dat snapshots to the sinks
+	replayCmd      = kingpin.Command("replay", "Write archived status.dat snapshots, optionally gzip or bzip2 compressed, to the sinks in the order they were created, and exit")
+	replayFlags    = addPipelineFlags(replayCmd)
+	replayInstance = replayCmd.Flag("instance", "Instance tag to add to every point").String()
+	replayPaths    = replayCmd.Arg("paths", "status.dat snapshots to replay, as files, directories or globs").Required().Strings()
+
+	//parse, validate and diff inspect status.dat files without writing anything
+	parseCmd    = kingpin.Command("parse", "Convert a status.dat, optionally compressed, to JSON or line protocol on stdout")
+	parseConfig = parseCmd.Flag("config", "YAML configuration file to take tags, schema and filters from").Short('f').String()
+	parseFormat = parseCmd.Flag("format", "Output format, json or line").Short('F').Default("json").Enum("json", "line")
+	parseFile   = parseCmd.Arg("file", "status.dat to parse").Required().ExistingFile()
+
+	validateCmd   = kingpin.Command("validate", "Report malformed blocks and perfdata in status.dat files with their line numbers")
+	validateFiles = validateCmd.Arg("files", "status.dat files to validate").Required().ExistingFiles()
+
+	diffCmd  = kingpin.Command("diff", "Show what changed between two status.dat snapshots")
+	diffFrom = diffCmd.Arg("from", "Older status.dat").Required().ExistingFile()
+	diffTo   = diffCmd.Arg("to", "Newer status.dat").Required().ExistingFile()
+
+	//check is a Nagios plugin checking a running ingest
+	checkCmd           = kingpin.Command("check", "Nagios plugin checking the time since the last status.dat was ingested, the sink backlog and the write error rate of a running SQLios")
+	checkURL           = checkCmd.Flag("url", "Status endpoint of the SQLios to check, see --listen").Short('U').Default("http://127.0.0.1:9273/status").String()
+	checkCheckpoint    = checkCmd.Flag("checkpoint", "Check a checkpoint file instead of the status endpoint, only the age is known then").String()
+	checkWarningRange  = checkCmd.Flag("warning", "Warning ranges for age in seconds, backlog in bytes and error rate as age,backlog,error_rate").Short('w').Default("300,,0.05").String()
+	checkCriticalRange = checkCmd.Flag("critical", "Critical ranges for age in seconds, backlog in bytes and error rate as age,backlog,error_rate").Short('c').Default("900,,0.25").String()
+	checkTimeout       = checkCmd.Flag("timeout", "Timeout for querying the status endpoint").Short('t').Default("10s").Duration()
+
+	//migrate manages the normalized schema of SQL sinks
+	migrateCmd         = kingpin.Command("migrate", "Manage the normalized schema of SQL sinks")
+	migrateUpCmd       = migrateCmd.Command("up", "Apply the pending migrations")
+	migrateUpFlags     = addMigrateFlags(migrateUpCmd)
+	migrateUpTo        = migrateUpCmd.Flag("to", "Version to migrate up to, the latest if not given").Int()
+	migrateDownCmd     = migrateCmd.Command("down", "Revert the most recently applied migration")
+	migrateDownFlags   = addMigrateFlags(migrateDownCmd)
+	migrateDownTo      = migrateDownCmd.Flag("to", "Version to migrate down to, reverting every migration after it, 0 to revert them all").Int()
+	migrateStatusCmd   = migrateCmd.Command("status", "List the migrations and whether each is applied")
+	migrateStatusFlags = addMigrateFlags(migrateStatusCmd)
+	migrateSQLCmd      = migrateCmd.Command("sql", "Print the migrations creating the normalized schema, to apply by hand")
+	migrateSQLDown     = migrateSQLCmd.Flag("down", "Print the migrations dropping it instead, newest first").Bool()
+	migrateSQLDriver   = migrateSQLCmd.Flag("driver", "Database to print the migrations for, postgres or sqlite3").Default("postgres").Enum("postgres", "sqlite3")
 )
 
 func main() {
-	var NCPU = runtime.NumCPU()
-	runtime.GOMAXPROCS(NCPU)
-	var numUploaders = NCPU * 2
-	var numBlockParsers = NCPU * 2
-
-	kingpin.Parse()
-
-	if *cpus != 0 {
-		runtime.GOMAXPROCS(*cpus)
-		numUploaders = *cpus * 2
-		numBlockParsers = *cpus * 2
-	}
+	command := kingpin.Parse()
 
 	if *profileOut != "" {
 		switch *profileOut {
@@ -57,96 +85,148 @@ func main() {
 			// do nothing
 		}
 	}
-	file, err := os.Open(*input)
 
-	if err != nil {
-		log.Fatalf("os.Open: %s", err)
+	// The commands inspecting files only log what they are doing when asked
+	switch command {
+	case parseCmd.FullCommand(), validateCmd.FullCommand(), diffCmd.FullCommand(), checkCmd.FullCommand(), migrateSQLCmd.FullCommand():
+		if !*verbose {
+			log.SetOutput(ioutil.Discard)
+		}
 	}
 
-	c, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr:     *host,
-		Username: *username,
-		Password: *password,
-	})
-
-	if err != nil {
-		log.Fatalf("client.NewHTTPClient: %s", err)
+	var status int
+	switch command {
+	case ingestCmd.FullCommand():
+		status = runIngest()
+	case replayCmd.FullCommand():
+		status = runReplay()
+	case parseCmd.FullCommand():
+		status = runParse()
+	case validateCmd.FullCommand():
+		status = runValidate()
+	case diffCmd.FullCommand():
+		status = runDiff()
+	case checkCmd.FullCommand():
+		status = runCheck()
+	case migrateUpCmd.FullCommand():
+		status = runMigrateUp()
+	case migrateDownCmd.FullCommand():
+		status = runMigrateDown()
+	case migrateStatusCmd.FullCommand():
+		status = runMigrateStatus()
+	case migrateSQLCmd.FullCommand():
+		status = runMigrateSQL()
 	}
+	if status != 0 {
+		os.Exit(status)
+	}
+}
 
-	var filec = make(chan *os.File, 10)
-	var blockc = make(chan nagios.Block, 100)
-	var pointc = make(chan *client.Point, 100)
-
-	//Reader pushes a true to this channel at the end of each file. Uploader
-	//consumes it to know when to print off the count of uploaded points
-	var endOfFile = make(chan bool)
-
-	var errc = make(chan error, 10)
-
-	// Startup an err channel handler
-	go func() {
-		for err := range errc {
-			log.Printf("Error, %s", err)
+// blockFilters compiles the include or exclude filters from the
+// configuration.
+func blockFilters(entries []map[string]string) ([]nagios.BlockFilter, error) {
+	var filters = make([]nagios.BlockFilter, 0, len(entries))
+	for _, entry := range entries {
+		var filter = make(nagios.BlockFilter, len(entry))
+		for field, s := range entry {
+			p, err := nagios.CompilePattern(s)
+			if err != nil {
+				return nil, err
+			}
+			filter[field] = p
 		}
-	}()
-
-	var wgReader sync.WaitGroup
-	var wgUploaders sync.WaitGroup
-	var wgBlockParsers sync.WaitGroup
-
-	// Startup a single Reader
-	wgReader.Add(1)
-	go func() {
-		nagios.Reader(blockc, filec, endOfFile, errc)
-		wgReader.Done()
-	}()
-
-	// Startup the Uploaders
-	wgUploaders.Add(numUploaders)
-	for i := 0; i < numUploaders; i++ {
-		go func() {
-			nagios.Uploader(noop, jsonOut, c, pointc, endOfFile, errc)
-			wgUploaders.Done()
-		}()
+		filters = append(filters, filter)
 	}
+	return filters, nil
+}
 
-	// Startup the Block parsers
-	wgBlockParsers.Add(numBlockParsers)
-	for i := 0; i < numBlockParsers; i++ {
-		go func() {
-			nagios.ParseBlock(blockc, pointc, errc)
-			wgBlockParsers.Done()
-		}()
+// inputTags returns the tags added to every point from in.
+func inputTags(in config.Input) map[string]string {
+	var tags = make(map[string]string, len(in.Tags)+1)
+	for k, v := range in.Tags {
+		tags[k] = v
 	}
-
-	if *loadOnStart || *oneshot {
-		filec <- file
+	if in.Name != "" {
+		tags["instance"] = in.Name
 	}
+	return tags
+}
 
-	if !*oneshot {
-
-		done := make(chan bool)
-
-		fswatch.Watcher(input, filec, done, errc)
-
+// newRules builds the ParseBlock rules from the configuration, with schema
+// holding the types of fields seen so far.
+func newRules(cfg *config.Config, schema *nagios.Schema) (*nagios.Rules, error) {
+	var blocks = make(map[string]bool, len(cfg.Filters.Blocks))
+	for _, b := range cfg.Filters.Blocks {
+		blocks[b] = true
 	}
 
-	//The following needs to be in this specfic order of closes and waits to
-	//avoid panics from emitting or reading from a closed channel
-
-	//Close filec so Reader will exit
-	close(filec)
-	wgReader.Wait()
-
-	//Close blockc so influxios.ParseBlock will exit
-	close(blockc)
-	wgBlockParsers.Wait()
+	include, err := blockFilters(cfg.Filters.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := blockFilters(cfg.Filters.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	var hostgroups = make(map[string][]string)
+	for _, path := range cfg.Filters.ObjectsCache {
+		groups, err := nagios.ReadHostgroups(path)
+		if err != nil {
+			return nil, err
+		}
+		for host, names := range groups {
+			hostgroups[host] = append(hostgroups[host], names...)
+		}
+	}
 
-	//Close seriesc so influxios.Uploader will exit
-	close(pointc)
-	wgUploaders.Wait()
+	var fields = make(map[string]nagios.FieldFilter, len(cfg.Filters.Fields))
+	for block, conf := range cfg.Filters.Fields {
+		var filter nagios.FieldFilter
+		for _, s := range conf.Include {
+			p, err := nagios.CompilePattern(s)
+			if err != nil {
+				return nil, err
+			}
+			filter.Include = append(filter.Include, p)
+		}
+		for _, s := range conf.Exclude {
+			p, err := nagios.CompilePattern(s)
+			if err != nil {
+				return nil, err
+			}
+			filter.Exclude = append(filter.Exclude, p)
+		}
+		fields[block] = filter
+	}
 
-	//Finally close errc so the error handler exits
-	close(errc)
+	var relabel = make([]nagios.Relabel, 0, len(cfg.Relabel))
+	for _, conf := range cfg.Relabel {
+		re, err := nagios.CompileRegex(conf.Regex)
+		if err != nil {
+			return nil, err
+		}
+		relabel = append(relabel, nagios.Relabel{
+			Block:       conf.Block,
+			Action:      conf.Action,
+			Source:      conf.Source,
+			Target:      conf.Target,
+			Regex:       re,
+			Replacement: conf.Replacement,
+		})
+	}
 
+	return &nagios.Rules{
+		Tags:       cfg.Tags,
+		Blocks:     blocks,
+		Include:    include,
+		Exclude:    exclude,
+		Hostgroups: hostgroups,
+		Fields:     fields,
+		Relabel:    relabel,
+		Types:      cfg.Schema.Fields,
+		Floats:     !cfg.Schema.Integers,
+		Timestamps: cfg.Timestamps.Blocks,
+		ZeroTime:   cfg.Timestamps.Zero,
+		Schema:     schema,
+	}, nil
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/bensallen/sqlios/metrics"
+)
+
+var (
+	sinkLatency = metrics.NewHistogramVec("sqlios_sink_write_seconds", "Time taken to write a batch to a sink, including retries.", "sink", metrics.DefaultBuckets)
+	sinkPoints  = metrics.NewCounterVec("sqlios_sink_points_written_total", "Points written to each sink.", "sink")
+	sinkErrors  = metrics.NewCounterVec("sqlios_sink_write_errors_total", "Batches that failed to be written to each sink.", "sink")
+	ingestLag   = metrics.NewHistogram("sqlios_ingest_lag_seconds", "Time from the created time of the newest status.dat to a batch being written to a sink.", metrics.DefaultBuckets)
+	queueLength = metrics.NewGaugeVec("sqlios_queue_length", "Items waiting in each in-memory queue.", "queue")
+	spoolBytes  = metrics.NewGaugeVec("sqlios_spool_bytes", "Bytes waiting in each sink's spool.", "sink")
+)
+
+// serveHTTP serves metrics, status and health checks on addr in the
+// background.
+// /healthz answers as long as the process is running, /readyz only once
+// the pipeline is running and no sink is failing.
+func serveHTTP(addr string, sup *supervisor) {
+	rate := &errorRate{}
+	go rate.run()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/status", statusHandler(sup, rate))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		if err := sup.ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Error, HTTP server: %s", err)
+		}
+	}()
+}
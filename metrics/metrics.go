@@ -0,0 +1,379 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is anything that can write itself in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// Registry is a set of metrics exposed together.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// DefaultRegistry is the registry the New* functions add to.
+var DefaultRegistry = &Registry{}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// WritePrometheus writes every metric in the Prometheus text exposition format.
+func (r *Registry) WritePrometheus(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler serves the DefaultRegistry in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		DefaultRegistry.WritePrometheus(w)
+	})
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return fmt.Sprintf("%g", f)
+}
+
+// Counter is a monotonically increasing count.
+type Counter struct {
+	v int64
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.v, 1)
+}
+
+// Add adds n to the counter.
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.v, n)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+type namedCounter struct {
+	Counter
+	name, help string
+}
+
+func (c *namedCounter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// NewCounter registers a counter.
+func NewCounter(name, help string) *Counter {
+	c := &namedCounter{name: name, help: help}
+	DefaultRegistry.register(c)
+	return &c.Counter
+}
+
+// CounterVec is a set of counters distinguished by the value of one label.
+type CounterVec struct {
+	name, help, label string
+
+	mu       sync.Mutex
+	counters map[string]*Counter
+}
+
+// NewCounterVec registers a set of counters with the given label.
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{name: name, help: help, label: label, counters: make(map[string]*Counter)}
+	DefaultRegistry.register(c)
+	return c
+}
+
+// With returns the counter for the given label value, creating it if needed.
+func (c *CounterVec) With(value string) *Counter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counter, ok := c.counters[value]
+	if !ok {
+		counter = &Counter{}
+		c.counters[value] = counter
+	}
+	return counter
+}
+
+// Sum returns the total of every counter in the set.
+func (c *CounterVec) Sum() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var sum int64
+	for _, counter := range c.counters {
+		sum += counter.Value()
+	}
+	return sum
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, value := range sortedKeys(c.counters) {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, value, c.counters[value].Value())
+	}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits uint64
+}
+
+// Set sets the gauge to f.
+func (g *Gauge) Set(f float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(f))
+}
+
+// Value returns the current value.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+type namedGauge struct {
+	Gauge
+	name, help string
+}
+
+func (g *namedGauge) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.Value()))
+}
+
+// NewGauge registers a gauge.
+func NewGauge(name, help string) *Gauge {
+	g := &namedGauge{name: name, help: help}
+	DefaultRegistry.register(g)
+	return &g.Gauge
+}
+
+// GaugeVec is a set of gauges, distinguished by the value of one label,
+// whose values are read from functions when the metrics are written.
+type GaugeVec struct {
+	name, help, label string
+
+	mu    sync.Mutex
+	funcs map[string]func() float64
+}
+
+// NewGaugeVec registers a set of gauges with the given label.
+func NewGaugeVec(name, help, label string) *GaugeVec {
+	g := &GaugeVec{name: name, help: help, label: label, funcs: make(map[string]func() float64)}
+	DefaultRegistry.register(g)
+	return g
+}
+
+// Set reports the value of f for the given label value.
+func (g *GaugeVec) Set(value string, f func() float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.funcs[value] = f
+}
+
+// Delete stops reporting the given label value.
+func (g *GaugeVec) Delete(value string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.funcs, value)
+}
+
+// Values returns the current value for every label value.
+func (g *GaugeVec) Values() map[string]float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	values := make(map[string]float64, len(g.funcs))
+	for value, f := range g.funcs {
+		values[value] = f()
+	}
+	return values
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	values := g.Values()
+	for _, value := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s=%q} %s\n", g.name, g.label, value, formatFloat(values[value]))
+	}
+}
+
+// DefaultBuckets are histogram bucket upper bounds in seconds, from 5ms to
+// 10 minutes.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// Histogram counts observations into buckets.
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sumBits uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Observe adds a single observation.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+func (h *Histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{%s%sle=%q} %d\n", name, labels, sep, formatFloat(le), cumulative)
+	}
+	count := h.Count()
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(math.Float64frombits(atomic.LoadUint64(&h.sumBits))))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, count)
+}
+
+type namedHistogram struct {
+	*Histogram
+	name, help string
+}
+
+func (h *namedHistogram) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.Histogram.write(w, h.name, "")
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds,
+// which must be sorted.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &namedHistogram{Histogram: newHistogram(buckets), name: name, help: help}
+	DefaultRegistry.register(h)
+	return h.Histogram
+}
+
+// HistogramVec is a set of histograms distinguished by the value of one
+// label.
+type HistogramVec struct {
+	name, help, label string
+	buckets           []float64
+
+	mu         sync.Mutex
+	histograms map[string]*Histogram
+}
+
+// NewHistogramVec registers a set of histograms with the given label.
+func NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, label: label, buckets: buckets, histograms: make(map[string]*Histogram)}
+	DefaultRegistry.register(h)
+	return h
+}
+
+// With returns the histogram for the given label value, creating it if
+// needed.
+func (h *HistogramVec) With(value string) *Histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	histogram, ok := h.histograms[value]
+	if !ok {
+		histogram = newHistogram(h.buckets)
+		h.histograms[value] = histogram
+	}
+	return histogram
+}
+
+// Count returns the number of observations across every histogram in the set.
+func (h *HistogramVec) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var count uint64
+	for _, histogram := range h.histograms {
+		count += histogram.Count()
+	}
+	return count
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, value := range sortedKeys(h.histograms) {
+		h.histograms[value].write(w, h.name, fmt.Sprintf("%s=%q", h.label, value))
+	}
+}
+
+// sortedKeys returns the keys of a map with string keys in order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*Counter:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*Histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
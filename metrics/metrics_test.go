@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WritePrometheus(t *testing.T) {
+	r := &Registry{}
+
+	c := &namedCounter{name: "test_total", help: "A counter."}
+	c.Add(3)
+	r.register(c)
+
+	cv := &CounterVec{name: "test_errors_total", help: "Errors.", label: "type", counters: make(map[string]*Counter)}
+	cv.With("b").Inc()
+	cv.With("a").Add(2)
+	r.register(cv)
+
+	gv := &GaugeVec{name: "test_queue_length", help: "Queue length.", label: "queue", funcs: make(map[string]func() float64)}
+	gv.Set("points", func() float64 { return 5 })
+	gv.Set("gone", func() float64 { return 1 })
+	gv.Delete("gone")
+	r.register(gv)
+
+	h := &namedHistogram{Histogram: newHistogram([]float64{1, 10}), name: "test_seconds", help: "Latency."}
+	h.Observe(0.5)
+	h.Observe(5)
+	h.Observe(50)
+	r.register(h)
+
+	var buf bytes.Buffer
+	r.WritePrometheus(&buf)
+	got := buf.String()
+
+	tests := []string{
+		"# TYPE test_total counter\ntest_total 3\n",
+		"test_errors_total{type=\"a\"} 2\ntest_errors_total{type=\"b\"} 1\n",
+		"test_queue_length{queue=\"points\"} 5\n",
+		"test_seconds_bucket{le=\"1\"} 1\ntest_seconds_bucket{le=\"10\"} 2\ntest_seconds_bucket{le=\"+Inf\"} 3\n",
+		"test_seconds_sum 55.5\ntest_seconds_count 3\n",
+	}
+	for _, want := range tests {
+		if !strings.Contains(got, want) {
+			t.Errorf("WritePrometheus() missing %q in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "gone") {
+		t.Errorf("WritePrometheus() reported deleted gauge:\n%s", got)
+	}
+	if cv.Sum() != 3 {
+		t.Errorf("CounterVec.Sum() = %d, want 3", cv.Sum())
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/bensallen/sqlios/config"
+	"github.com/bensallen/sqlios/sink"
+)
+
+// migrateFlags choose the database the migrate commands work on.
+type migrateFlags struct {
+	configFile *string
+	sink       *string
+	dsn        *string
+	driver     *string
+}
+
+func addMigrateFlags(cmd *kingpin.CmdClause) *migrateFlags {
+	return &migrateFlags{
+		configFile: cmd.Flag("config", "YAML configuration file to take the DSN of a SQL sink with the normalized schema from").Short('f').String(),
+		sink:       cmd.Flag("sink", "Name of the SQL sink to migrate, when the configuration has several").String(),
+		dsn:        cmd.Flag("dsn", "DSN of a database to migrate instead of a sink from the configuration").String(),
+		driver:     cmd.Flag("driver", "Driver of --dsn, postgres or sqlite3").Default("postgres").Enum("postgres", "sqlite3"),
+	}
+}
+
+// open connects to the database given by --dsn, or of the SQL sink with the
+// normalized schema in the configuration file, returning its driver.
+func (f *migrateFlags) open() (*sql.DB, string, error) {
+	dsn, driver := *f.dsn, *f.driver
+	if dsn == "" {
+		if *f.configFile == "" {
+			return nil, "", fmt.Errorf("--config or --dsn is required")
+		}
+		cfg, err := config.Load(*f.configFile)
+		if err != nil {
+			return nil, "", err
+		}
+		var found []config.Sink
+		for _, s := range cfg.Sinks {
+			if s.Type == config.SQLSink && s.Schema == sink.NormalizedSchema && (*f.sink == "" || s.Name == *f.sink) {
+				found = append(found, s)
+			}
+		}
+		switch {
+		case len(found) == 0 && *f.sink != "":
+			return nil, "", fmt.Errorf("no SQL sink %q with the normalized schema in %s", *f.sink, *f.configFile)
+		case len(found) == 0:
+			return nil, "", fmt.Errorf("no SQL sink with the normalized schema in %s", *f.configFile)
+		case len(found) > 1:
+			return nil, "", fmt.Errorf("several SQL sinks with the normalized schema in %s, choose one with --sink", *f.configFile)
+		}
+		dsn, driver = found[0].DSN, found[0].Driver
+	}
+	db, err := sql.Open(driver, dsn)
+	return db, driver, err
+}
+
+// runMigrateUp applies the pending migrations.
+func runMigrateUp() int {
+	db, driver, err := migrateUpFlags.open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error, %s\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	applied, err := sink.MigrateUp(db, driver, *migrateUpTo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error, %s\n", err)
+		return 1
+	}
+	if len(applied) == 0 {
+		fmt.Println("No migrations to apply")
+	}
+	for _, m := range applied {
+		fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+	}
+	return 0
+}
+
+// runMigrateDown reverts the most recently applied migration, or every one
+// after --to.
+func runMigrateDown() int {
+	db, driver, err := migrateDownFlags.open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error, %s\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	to := *migrateDownTo
+	if !flagsSet()["to"] {
+		states, err := sink.MigrationStatus(db, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error, %s\n", err)
+			return 1
+		}
+		for _, state := range states {
+			if !state.Applied.IsZero() {
+				to = state.Version - 1
+			}
+		}
+	}
+
+	reverted, err := sink.MigrateDown(db, driver, to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error, %s\n", err)
+		return 1
+	}
+	if len(reverted) == 0 {
+		fmt.Println("No migrations to revert")
+	}
+	for _, m := range reverted {
+		fmt.Printf("Reverted %04d_%s\n", m.Version, m.Name)
+	}
+	return 0
+}
+
+// runMigrateStatus lists every migration and whether it is applied. It
+// exits 1 if any were applied by a newer SQLios.
+func runMigrateStatus() int {
+	db, driver, err := migrateStatusFlags.open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error, %s\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	states, err := sink.MigrationStatus(db, driver)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error, %s\n", err)
+		return 1
+	}
+
+	var status int
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATUS")
+	for _, state := range states {
+		var s string
+		switch {
+		case state.Unknown:
+			s = "applied " + state.Applied.Format(time.RFC3339) + " by a newer SQLios"
+			status = 1
+		case !state.Applied.IsZero():
+			s = "applied " + state.Applied.Format(time.RFC3339)
+		case state.Skipped:
+			s = "skipped, needs the " + state.Requires + " extension"
+		default:
+			s = "pending"
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\n", state.Version, state.Name, s)
+	}
+	w.Flush()
+	return status
+}
+
+// runMigrateSQL prints the migrations of the normalized schema in the order
+// they apply, or revert with --down.
+func runMigrateSQL() int {
+	migrations, err := sink.Migrations(*migrateSQLDriver)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error, %s\n", err)
+		return 1
+	}
+	if *migrateSQLDown {
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := migrations[i]
+			fmt.Printf("-- %04d_%s down\n%s\n", m.Version, m.Name, strings.TrimSpace(m.Down))
+		}
+		return 0
+	}
+	for _, m := range migrations {
+		fmt.Printf("-- %04d_%s up\n%s\n", m.Version, m.Name, strings.TrimSpace(m.Up))
+	}
+	return 0
+}
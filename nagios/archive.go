@@ -0,0 +1,164 @@
+package nagios
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// readCloser closes the file underneath a decompressing reader.
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
+// OpenFile opens a status.dat for Reader, transparently decompressing it if
+// it is gzip or bzip2 compressed.
+func OpenFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bufio.NewReader(file)
+	// A short file can't be compressed, Peek returns what there is
+	magic, _ := buf.Peek(3)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		return &readCloser{gz, func() error {
+			gz.Close()
+			return file.Close()
+		}}, nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return &readCloser{bzip2.NewReader(buf), file.Close}, nil
+	}
+	return &readCloser{buf, file.Close}, nil
+}
+
+// ReadCreated returns the created time from the info block at the start of
+// the status.dat at path.
+func ReadCreated(path string) (int64, error) {
+	file, err := OpenFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return ScanCreated(file, path)
+}
+
+// ScanCreated reads the created time from the info block at the start of a
+// status.dat read from r. path is used in errors.
+func ScanCreated(r io.Reader, path string) (int64, error) {
+	buf := bufio.NewReader(r)
+	var inInfo bool
+	for {
+		line, err := buf.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case line == "info {":
+			inInfo = true
+		case !inInfo || line == "\t}":
+			return 0, fmt.Errorf("%s: does not start with an info block with a created time", path)
+		case strings.HasPrefix(line, "\tcreated="):
+			created, err := strconv.ParseInt(strings.TrimPrefix(line, "\tcreated="), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("%s: %s", path, err)
+			}
+			return created, nil
+		}
+
+		if err == io.EOF {
+			return 0, fmt.Errorf("%s: does not start with an info block with a created time", path)
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Snapshot is an archived status.dat and the created time from its info
+// block.
+type Snapshot struct {
+	Path    string
+	Created int64
+}
+
+// FindSnapshots expands paths, each a file, a directory or a glob, into the
+// status.dat snapshots they hold, ordered by created time rather than name.
+// Files that are not a status.dat are skipped, as are copies of a snapshot
+// with the same created time as one already found.
+func FindSnapshots(paths []string) ([]Snapshot, error) {
+	var files []string
+	for _, p := range paths {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: no such file or directory", p)
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				files = append(files, match)
+				continue
+			}
+
+			entries, err := ioutil.ReadDir(match)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if entry.Mode().IsRegular() {
+					files = append(files, filepath.Join(match, entry.Name()))
+				}
+			}
+		}
+	}
+
+	var snapshots = make([]Snapshot, 0, len(files))
+	var seen = make(map[int64]string, len(files))
+	for _, file := range files {
+		created, err := ReadCreated(file)
+		if err != nil {
+			log.Printf("Warning, skipping %s", err)
+			continue
+		}
+		if other, ok := seen[created]; ok {
+			log.Printf("Warning, skipping %s, it has the same created time as %s", file, other)
+			continue
+		}
+		seen[created] = file
+		snapshots = append(snapshots, Snapshot{Path: file, Created: created})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created < snapshots[j].Created
+	})
+	return snapshots, nil
+}
@@ -0,0 +1,76 @@
+package nagios
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Checkpoint is the state Reader needs to pick up where it left off after a
+// restart, so blocks that were already uploaded are not uploaded again.
+type Checkpoint struct {
+	mu sync.Mutex
+	// Created is the created time from the info block of the last
+	// status.dat that was fully read.
+	Created int64 `json:"created"`
+}
+
+// LoadCheckpoint reads a checkpoint from path. A missing file is not an
+// error, an empty Checkpoint is returned instead.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	var cp Checkpoint
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &cp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// Save atomically writes the checkpoint to path.
+func (cp *Checkpoint) Save(path string) error {
+	cp.mu.Lock()
+	b, err := json.Marshal(cp)
+	cp.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFile(path, append(b, '\n'))
+}
+
+// writeFile atomically replaces path with b.
+func writeFile(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (cp *Checkpoint) created() int64 {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.Created
+}
+
+func (cp *Checkpoint) setCreated(created int64) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.Created = created
+}
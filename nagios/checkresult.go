@@ -0,0 +1,222 @@
+package nagios
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// checkResultFields maps check result file keys to status.dat field names,
+// other keys are kept as they are.
+var checkResultFields = map[string]string{
+	"return_code": "current_state",
+	"latency":     "check_latency",
+}
+
+// ParseCheckResults parses a check result file in the format Nagios queues
+// in its check_result_path, such as those written by NRDP, for example:
+//
+//	### Active Check Result File ###
+//	file_time=1416605950
+//
+//	### Nagios Service Check Result ###
+//	# Time: Fri Nov 21 21:39:10 2014
+//	host_name=web1
+//	service_description=Disk
+//	check_type=0
+//	latency=0.123
+//	start_time=1416605950.013
+//	finish_time=1416605950.212
+//	return_code=2
+//	output=DISK CRITICAL - /var 95%|/var=95%;80;90\nlong output
+//
+// Each result, separated from the next by a blank line, becomes a point
+// tagged as ParseBlock would the matching hoststatus or servicestatus block,
+// with the output split into plugin_output, long_plugin_output and
+// performance_data. Check results don't name the check command, so service
+// points are named after the host and service description. Results that
+// can't be parsed are passed to errFn and skipped.
+func ParseCheckResults(r io.Reader, rules *Rules, tags map[string]string, errFn func(error)) ([]*client.Point, error) {
+	var points []*client.Point
+	report := func(err error) {
+		parseErrors.With(errorType(err)).Inc()
+		errFn(err)
+	}
+
+	var fileTime string
+	parse := func(n int, raw map[string]string) {
+		if raw["host_name"] == "" {
+			// The header of the file, with only its file_time
+			if t, ok := raw["file_time"]; ok && len(raw) == 1 {
+				fileTime = t
+				return
+			}
+			report(&ParseError{Line: n, Block: "checkresult", Err: &errNotCheckResult{"no host_name"}})
+			return
+		}
+		blockName := "hoststatus"
+		if raw["service_description"] != "" {
+			blockName = "servicestatus"
+		}
+		if !rules.wants(blockName) || !rules.selects(mapLookup(raw)) {
+			return
+		}
+		blocksParsed.Inc()
+
+		// NRDP doesn't write a finish_time, and older versions no start_time
+		at := raw["finish_time"]
+		if at == "" {
+			at = raw["start_time"]
+		}
+		if at == "" {
+			at = fileTime
+		}
+		finish, err := strconv.ParseFloat(at, 64)
+		if err != nil {
+			report(&ParseError{Line: n, Block: blockName, Err: &errNotCheckResult{"no finish_time, start_time or file_time"}})
+			return
+		}
+		if start, err := strconv.ParseFloat(raw["start_time"], 64); err == nil && raw["finish_time"] != "" {
+			raw["check_execution_time"] = strconv.FormatFloat(finish-start, 'f', -1, 64)
+		}
+		delete(raw, "start_time")
+		delete(raw, "finish_time")
+		lastCheck := int64(finish)
+
+		output, long, perfdata := splitOutput(raw["output"])
+		delete(raw, "output")
+		raw["plugin_output"] = output
+		if long != "" {
+			raw["long_plugin_output"] = long
+		}
+
+		var fields = make(map[string]interface{})
+		if perfdata != "" {
+			if err := parsePerfData(perfdata, &fields); err != nil {
+				report(&ParseError{Line: n, Block: blockName, Err: err})
+			}
+		}
+		for key, v := range raw {
+			if v == "" {
+				continue
+			}
+			if key == "plugin_output" || key == "long_plugin_output" {
+				fields[key] = v
+				continue
+			}
+			value, err := parseDataValue(v)
+			if err != nil {
+				report(&ParseError{Line: n, Block: blockName, Err: err})
+			}
+			fields[key] = value
+		}
+
+		var pointTags = make(map[string]string, len(tags))
+		for k, v := range tags {
+			pointTags[k] = v
+		}
+		key := recordKey(blockName, tags, raw, lastCheck)
+		for _, err := range rules.process(blockName, raw, fields, pointTags) {
+			report(&ParseError{Line: n, Block: blockName, Err: err})
+		}
+		setKey(fields, key)
+
+		var name = []string{raw["host_name"], ""}
+		if blockName == "servicestatus" {
+			name[1] = raw["service_description"]
+		}
+		point, err := client.NewPoint(prettyName(name), pointTags, fields, time.Unix(lastCheck, 0))
+		if err != nil {
+			report(&ParseError{Line: n, Block: blockName, Err: err})
+			return
+		}
+		pointsEmitted.Inc()
+		points = append(points, point)
+	}
+
+	buf := bufio.NewReader(r)
+	var raw = make(map[string]string)
+	var n, start int
+	var bad bool
+	for {
+		line, err := buf.ReadString('\n')
+		if len(line) > 0 {
+			n++
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			// A blank line or the end of the file ends a result
+			if len(raw) > 0 && !bad {
+				parse(start, raw)
+			}
+			raw = make(map[string]string)
+			start, bad = 0, false
+		case strings.HasPrefix(line, "#"):
+		default:
+			if start == 0 {
+				start = n
+			}
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) < 2 {
+				if !bad {
+					report(&ParseError{Line: n, Block: "checkresult", Err: &errNotKeyValue{line}})
+				}
+				bad = true
+				continue
+			}
+			key, ok := checkResultFields[kv[0]]
+			if !ok {
+				key = kv[0]
+			}
+			raw[key] = kv[1]
+		}
+		if err == io.EOF {
+			if len(raw) > 0 && !bad {
+				parse(start, raw)
+			}
+			return points, nil
+		} else if err != nil {
+			return points, err
+		}
+	}
+}
+
+// splitOutput splits the output of a check result, with its newlines and
+// backslashes escaped by Nagios, into the first line, the long output of
+// the lines after it and the perfdata following a | in either.
+func splitOutput(s string) (output, long, perfdata string) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case 'n':
+				b.WriteByte('\n')
+				i++
+				continue
+			case '\\':
+				b.WriteByte('\\')
+				i++
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	s = b.String()
+
+	if i := strings.Index(s, "\n"); i >= 0 {
+		s, long = s[:i], s[i+1:]
+	}
+	if i := strings.Index(s, "|"); i >= 0 {
+		s, perfdata = s[:i], s[i+1:]
+	}
+	// Perfdata in the long output runs to its end
+	if i := strings.Index(long, "|"); i >= 0 {
+		long, perfdata = long[:i], perfdata+" "+strings.Replace(long[i+1:], "\n", " ", -1)
+	}
+	return strings.TrimSpace(s), strings.TrimSpace(long), strings.TrimSpace(perfdata)
+}
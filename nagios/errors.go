@@ -1,6 +1,9 @@
 package nagios
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+)
 
 //Custom Errors
 type errNonNumeric struct{ Msg string }
@@ -20,3 +23,102 @@ type errNotPerfData struct{ Msg string }
 func (e *errNotPerfData) Error() string {
 	return fmt.Sprintf("perfdata is in unexpected format, not a single value or 5 \";\" separated string: %s", e.Msg)
 }
+
+type errNotKeyValue struct{ Msg string }
+
+func (e *errNotKeyValue) Error() string {
+	return fmt.Sprintf("line is not in key=value format: %s", e.Msg)
+}
+
+type errUnterminatedBlock struct{ Msg string }
+
+func (e *errUnterminatedBlock) Error() string {
+	return fmt.Sprintf("block is not terminated before the end of the file: %s", e.Msg)
+}
+
+type errInfoBlock struct{ Msg string }
+
+func (e *errInfoBlock) Error() string {
+	return fmt.Sprintf("info block has no valid created time, skipping the file: %s", e.Msg)
+}
+
+type errNotPerfdataLine struct{ Msg string }
+
+func (e *errNotPerfdataLine) Error() string {
+	return fmt.Sprintf("line is not tab separated KEY::VALUE pairs with a HOSTPERFDATA or SERVICEPERFDATA DATATYPE: %s", e.Msg)
+}
+
+type errNotCheckResult struct{ Msg string }
+
+func (e *errNotCheckResult) Error() string {
+	return fmt.Sprintf("check result is incomplete: %s", e.Msg)
+}
+
+type errNotLogLine struct{ Msg string }
+
+func (e *errNotLogLine) Error() string {
+	return fmt.Sprintf("line does not start with a [timestamp]: %s", e.Msg)
+}
+
+type errTypeConflict struct {
+	Field string
+	Type  string
+	Value string
+}
+
+func (e *errTypeConflict) Error() string {
+	return fmt.Sprintf("field %s is a %s, dropping the value %q", e.Field, e.Type, e.Value)
+}
+
+// ParseError locates an error parsing a status.dat.
+type ParseError struct {
+	Line  int
+	Block string
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s: %s", e.Line, e.Block, e.Err)
+}
+
+// DecodeError lists the records DecodePoints couldn't parse, Err being the
+// error of the first.
+type DecodeError struct {
+	Records [][]byte
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%d undecodable records: %s", len(e.Records), e.Err)
+}
+
+// errorType names the kind of parse error for metrics.
+func errorType(err error) string {
+	switch e := err.(type) {
+	case *ParseError:
+		return errorType(e.Err)
+	case *errNonNumeric:
+		return "non_numeric"
+	case *errPerfDataNotKeyValue:
+		return "perfdata_not_key_value"
+	case *errNotPerfData:
+		return "not_perfdata"
+	case *errNotKeyValue:
+		return "not_key_value"
+	case *errUnterminatedBlock:
+		return "unterminated_block"
+	case *errInfoBlock:
+		return "info_block"
+	case *errNotPerfdataLine:
+		return "not_perfdata_line"
+	case *errNotCheckResult:
+		return "not_check_result"
+	case *errNotLogLine:
+		return "not_log_line"
+	case *errTypeConflict:
+		return "type_conflict"
+	case *strconv.NumError:
+		return "invalid_number"
+	}
+	return "other"
+}
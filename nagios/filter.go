@@ -0,0 +1,146 @@
+package nagios
+
+import (
+	"os"
+	"strings"
+)
+
+// BlockFilter matches a block when the value of each of its fields matches
+// the Pattern for it. The field hostgroup matches any hostgroup the host is
+// a member of, and custom variables such as _ENVIRONMENT match their value
+// without the modified flag status.dat writes before it. A field the block
+// doesn't have doesn't match.
+type BlockFilter map[string]*Pattern
+
+// match reports whether the block whose fields are found with lookup
+// matches the filter.
+func (f BlockFilter) match(lookup func(key string) (string, bool), hostgroups map[string][]string) bool {
+	for key, p := range f {
+		if key == "hostgroup" {
+			host, ok := lookup("host_name")
+			if !ok || !matchAny(p, hostgroups[host]) {
+				return false
+			}
+			continue
+		}
+
+		v, ok := lookup(key)
+		if !ok {
+			return false
+		}
+		if strings.HasPrefix(key, "_") {
+			if i := strings.Index(v, ";"); i >= 0 {
+				v = v[i+1:]
+			}
+		}
+		if !p.Match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(p *Pattern, values []string) bool {
+	for _, v := range values {
+		if p.Match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// selects reports whether a block should be parsed by Include and Exclude.
+// Blocks without a host_name, such as info and programstatus, are not
+// filtered.
+func (r *Rules) selects(lookup func(key string) (string, bool)) bool {
+	if r == nil || (len(r.Include) == 0 && len(r.Exclude) == 0) {
+		return true
+	}
+	if _, ok := lookup("host_name"); !ok {
+		return true
+	}
+
+	var included = len(r.Include) == 0
+	for _, f := range r.Include {
+		if f.match(lookup, r.Hostgroups) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		blocksFiltered.Inc()
+		return false
+	}
+	for _, f := range r.Exclude {
+		if f.match(lookup, r.Hostgroups) {
+			blocksFiltered.Inc()
+			return false
+		}
+	}
+	return true
+}
+
+// lineLookup finds fields in the unparsed lines of a status.dat block.
+func lineLookup(lines []string) func(key string) (string, bool) {
+	return func(key string) (string, bool) {
+		prefix := "\t" + key + "="
+		for _, line := range lines {
+			if strings.HasPrefix(line, prefix) {
+				return line[len(prefix):], true
+			}
+		}
+		return "", false
+	}
+}
+
+// mapLookup finds fields in a map of raw values.
+func mapLookup(raw map[string]string) func(key string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := raw[key]
+		return v, ok
+	}
+}
+
+// ReadHostgroups reads the members of each hostgroup from an objects.cache
+// written by Nagios, returning the hostgroups of each host.
+func ReadHostgroups(path string) (map[string][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var hostgroups = make(map[string][]string)
+	var inHostgroup bool
+	var name string
+	var members []string
+	err = readLines(file, func(n int, line string) {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "define hostgroup {":
+			inHostgroup, name, members = true, "", nil
+		case !inHostgroup:
+		case line == "}":
+			for _, host := range members {
+				hostgroups[host] = append(hostgroups[host], name)
+			}
+			inHostgroup = false
+		default:
+			i := strings.IndexAny(line, " \t")
+			if i < 0 {
+				return
+			}
+			switch key, value := line[:i], strings.TrimSpace(line[i:]); key {
+			case "hostgroup_name":
+				name = value
+			case "members":
+				for _, host := range strings.Split(value, ",") {
+					if host = strings.TrimSpace(host); host != "" {
+						members = append(members, host)
+					}
+				}
+			}
+		}
+	})
+	return hostgroups, err
+}
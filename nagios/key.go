@@ -0,0 +1,104 @@
+package nagios
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// KeyField is the field ParseBlock, ParseLog and ParsePerfdata store the
+// key of each point in. Sinks other than those keeping it in a column of
+// its own don't write it.
+const KeyField = "record_key"
+
+// eventIDs are the fields identifying an event, a check result or a comment
+// or downtime, by themselves.
+var eventIDs = []string{"current_event_id", "comment_id", "downtime_id"}
+
+// recordKey returns the natural key of a block, from its fields as read
+// before relabeling, typing or filtering change them: a hash of its block
+// type, instance, host_name, service_description, contact_name, time and
+// event ids. Blocks with no event id other than hosts and services, such as
+// log lines and notifications, add all their other fields, the message of a
+// log line among them. The same block parsed twice, after a crash or from a
+// replayed status.dat, gets the same key, so sinks can drop the second copy.
+func recordKey(block string, tags, raw map[string]string, at int64) string {
+	var parts = []string{block, tags["instance"], raw["host_name"], raw["service_description"], raw["contact_name"], strconv.FormatInt(at, 10)}
+
+	var hasID = block == "hoststatus" || block == "servicestatus"
+	for _, key := range eventIDs {
+		parts = append(parts, raw[key])
+		if raw[key] != "" {
+			hasID = true
+		}
+	}
+	if !hasID {
+		var keys = make([]string, 0, len(raw))
+		for k := range raw {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			parts = append(parts, k+"="+raw[k])
+		}
+	}
+	return hashKey(parts)
+}
+
+// setKey adds the key of a block to fields, unless nothing is left of them.
+func setKey(fields map[string]interface{}, key string) {
+	if len(fields) > 0 {
+		fields[KeyField] = key
+	}
+}
+
+// Key returns the natural key of a point, the one it was given when parsed.
+// Points spooled by earlier versions, without one, are keyed by a hash of
+// their measurement, instance, host_name, service_description, last_check
+// and current_event_id, with their time in place of a missing last_check.
+func Key(p *client.Point) string {
+	fields, _ := p.Fields()
+	if key, ok := fields[KeyField].(string); ok {
+		return key
+	}
+
+	tags := p.Tags()
+	lookup := func(key string) string {
+		if v, ok := tags[key]; ok {
+			return v
+		}
+		// A number is keyed the same whether typed as an int or a float
+		switch v := fields[key].(type) {
+		case string:
+			return v
+		case int64:
+			return strconv.FormatInt(v, 10)
+		case float64:
+			return strconv.FormatInt(int64(v), 10)
+		case nil:
+			return ""
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+
+	lastCheck := lookup("last_check")
+	if lastCheck == "" {
+		lastCheck = strconv.FormatInt(p.Time().Unix(), 10)
+	}
+	return hashKey([]string{p.Name(), tags["instance"], lookup("host_name"), lookup("service_description"), lastCheck, lookup("current_event_id")})
+}
+
+// hashKey hashes parts, each ended by a NUL.
+func hashKey(parts []string) string {
+	h := sha1.New()
+	for _, s := range parts {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
@@ -0,0 +1,110 @@
+package nagios
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// logEvents lists the fields of the nagios.log events that are split into
+// fields, other lines are kept whole as a message field.
+var logEvents = map[string][]string{
+	"HOST ALERT":            {"host_name", "state", "state_type", "attempt", "output"},
+	"CURRENT HOST STATE":    {"host_name", "state", "state_type", "attempt", "output"},
+	"SERVICE ALERT":         {"host_name", "service_description", "state", "state_type", "attempt", "output"},
+	"CURRENT SERVICE STATE": {"host_name", "service_description", "state", "state_type", "attempt", "output"},
+	"HOST NOTIFICATION":     {"contact_name", "host_name", "state", "notification_command", "output"},
+	"SERVICE NOTIFICATION":  {"contact_name", "host_name", "service_description", "state", "notification_command", "output"},
+}
+
+// logStateTypes maps the state types written to nagios.log to their value
+// in status.dat.
+var logStateTypes = map[string]string{
+	"SOFT": "0",
+	"HARD": "1",
+}
+
+// ParseLog parses lines from nagios.log, each of the form
+//
+//	[1416605950] SERVICE ALERT: host1;PING;CRITICAL;SOFT;1;PING CRITICAL - Packet loss = 100%
+//
+// Events listed in logEvents become a point named after the host and the
+// event, such as host1.service_alert, and are tagged using the rules for
+// that event name. Other lines become a log point with a message field.
+// Lines that can't be parsed are passed to errFn and skipped.
+func ParseLog(lines []string, rules *Rules, tags map[string]string, errFn func(error)) []*client.Point {
+	var points []*client.Point
+	report := func(err error) {
+		parseErrors.With(errorType(err)).Inc()
+		errFn(err)
+	}
+
+	for _, line := range lines {
+		end := strings.Index(line, "] ")
+		if !strings.HasPrefix(line, "[") || end < 0 {
+			report(&errNotLogLine{line})
+			continue
+		}
+		timestamp, err := strconv.ParseInt(line[1:end], 10, 64)
+		if err != nil {
+			report(&errNotLogLine{line})
+			continue
+		}
+		message := line[end+2:]
+
+		var name = []string{"log", ""}
+		var raw = make(map[string]string)
+		var blockName = "log"
+		event := strings.SplitN(message, ": ", 2)
+		if keys, ok := logEvents[event[0]]; ok && len(event) == 2 {
+			blockName = strings.Replace(strings.ToLower(event[0]), " ", "_", -1)
+			for i, v := range strings.SplitN(event[1], ";", len(keys)) {
+				raw[keys[i]] = v
+			}
+			// As in status.dat, where state_type is 0 for soft and 1 for hard
+			if stateType, ok := logStateTypes[raw["state_type"]]; ok {
+				raw["state_type"] = stateType
+			}
+			name = []string{raw["host_name"], blockName}
+		} else {
+			raw["message"] = message
+		}
+		if !rules.wants(blockName) || !rules.selects(mapLookup(raw)) {
+			continue
+		}
+		blocksParsed.Inc()
+
+		var fields = make(map[string]interface{}, len(raw))
+		for key, v := range raw {
+			if v == "" {
+				continue
+			}
+			value, err := parseDataValue(v)
+			if err != nil {
+				report(err)
+			}
+			fields[key] = value
+		}
+
+		var pointTags = make(map[string]string, len(tags))
+		for k, v := range tags {
+			pointTags[k] = v
+		}
+		key := recordKey(blockName, tags, raw, timestamp)
+		for _, err := range rules.process(blockName, raw, fields, pointTags) {
+			report(err)
+		}
+		setKey(fields, key)
+
+		point, err := client.NewPoint(prettyName(name), pointTags, fields, time.Unix(timestamp, 0))
+		if err != nil {
+			report(err)
+			continue
+		}
+		pointsEmitted.Inc()
+		points = append(points, point)
+	}
+	return points
+}
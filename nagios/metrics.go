@@ -0,0 +1,66 @@
+package nagios
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/bensallen/sqlios/metrics"
+)
+
+var (
+	filesRead      = metrics.NewCounter("sqlios_files_read_total", "Input files read.")
+	blocksParsed   = metrics.NewCounter("sqlios_blocks_parsed_total", "Blocks parsed from input files.")
+	blocksFiltered = metrics.NewCounter("sqlios_blocks_filtered_total", "Blocks dropped by host and service filters before being parsed.")
+	pointsEmitted  = metrics.NewCounter("sqlios_points_emitted_total", "Points emitted by the block parsers.")
+	pointsUploaded = metrics.NewCounter("sqlios_points_uploaded_total", "Points handed off by the Uploaders to be written.")
+	parseErrors    = metrics.NewCounterVec("sqlios_parse_errors_total", "Errors parsing blocks, by type of error.", "type")
+	lastCreated    = metrics.NewGauge("sqlios_last_created_timestamp_seconds", "Created time from the info block of the newest status.dat read.")
+	lastRead       = metrics.NewGauge("sqlios_last_read_timestamp_seconds", "Time the last input file was fully read.")
+
+	// pointsLogged is the value of pointsUploaded at the last end of file
+	// log message.
+	pointsLogged int64
+)
+
+// LastCreated returns the created time from the info block of the newest
+// status.dat read, or the zero time if none has been read.
+func LastCreated() time.Time {
+	if v := lastCreated.Value(); v != 0 {
+		return time.Unix(int64(v), 0)
+	}
+	return time.Time{}
+}
+
+// LastRead returns when an input file was last fully read, or the zero time
+// if none has been.
+func LastRead() time.Time {
+	if v := lastRead.Value(); v != 0 {
+		return time.Unix(0, int64(v*1e9))
+	}
+	return time.Time{}
+}
+
+// ParseErrors returns the total number of errors parsing blocks.
+func ParseErrors() int64 {
+	return parseErrors.Sum()
+}
+
+// setLastCreated records created if it is newer than what was seen before.
+func setLastCreated(created int64) {
+	if float64(created) > lastCreated.Value() {
+		lastCreated.Set(float64(created))
+	}
+}
+
+// uploadedSinceLastLog returns the number of points uploaded since it was
+// last called.
+func uploadedSinceLastLog() int64 {
+	n := pointsUploaded.Value()
+	return n - atomic.SwapInt64(&pointsLogged, n)
+}
+
+// parseError counts err by its type and passes it on to errc.
+func parseError(errc chan error, err error) {
+	parseErrors.With(errorType(err)).Inc()
+	errc <- err
+}
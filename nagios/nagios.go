@@ -1,19 +1,26 @@
 package nagios
 
 import (
-	"encoding/json"
-	"fmt"
+	"bufio"
+	"context"
+	"io"
 	"log"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
 
 	"github.com/influxdata/influxdb/client/v2"
-	"github.com/jprichardson/readline-go"
+	"github.com/influxdata/influxdb/models"
 )
 
+// Batch sizes the batches Uploader writes. A batch is flushed once it
+// reaches Size points or Interval has passed, whichever comes first.
+type Batch struct {
+	Size     int
+	Interval time.Duration
+}
+
 //Joins the name slice with a "." if both elements exist, otherwise return just the first element
 func prettyName(name []string) string {
 	if name[1] == "" {
@@ -74,9 +81,7 @@ func parsePerfData(s string, fields *map[string]interface{}) error {
 		if len(perfdataKv) == 2 {
 			valueAttrs := strings.Split(perfdataKv[1], ";")
 
-			if len(valueAttrs) == 1 {
-				(*fields)[strings.ToLower(prefix+string(perfdataKv[0]))] = perfdataKv[1]
-			} else if len(valueAttrs) == 5 || len(valueAttrs) == 4 {
+			if len(valueAttrs) <= 5 {
 				//fmt.Println(perfdataKv[0], valueAttrs)
 				for z, attr := range valueAttrs {
 					if attr == "" {
@@ -90,7 +95,6 @@ func parsePerfData(s string, fields *map[string]interface{}) error {
 					(*fields)[strings.ToLower(prefix+string(perfdataKv[0])+perfmap[z])] = value
 				}
 			} else {
-				fmt.Println(perfdataKv[0], valueAttrs)
 				return &errPerfDataNotKeyValue{s}
 			}
 		} else {
@@ -131,35 +135,48 @@ func parseInfoBlock(block *Block) (err error) {
 	return
 }
 
-// ParseBlock parses Blocks into InfluxDB *client.Point
-func ParseBlock(blockc chan Block, pointc chan *client.Point, errc chan error) {
+// ParseBlock parses Blocks into InfluxDB *client.Point according to the
+// current rules until blockc is closed or ctx is done
+func ParseBlock(ctx context.Context, ruleSet *RuleSet, blockc chan Block, pointc chan *client.Point, errc chan error) {
 
 	for block := range blockc {
+		if ctx.Err() != nil {
+			return
+		}
+		rules := ruleSet.Load()
+		if !rules.wants(block.Name) || !rules.selects(lineLookup(block.Lines)) {
+			continue
+		}
+		blocksParsed.Inc()
 
 		var name = make([]string, 2)
 		var fields = make(map[string]interface{})
+		var raw = make(map[string]string)
+		var timeField = rules.timestamp(block.Name)
 		var blockTime int64
 		var skip bool
 
-		for _, line := range block.Lines {
+		for i, line := range block.Lines {
 
 			kv := strings.Split(line, "=")
+			if len(kv) < 2 {
+				parseError(errc, block.errorAt(i, &errNotKeyValue{line}))
+				continue
+			}
 
-			// Parse the various time columns from status.dat into a int64
-			if kv[0] == "\tlast_check" || kv[0] == "\tcreated" || kv[0] == "\tentry_time" {
+			// The field chosen as the time of the block is not a field itself
+			if strings.TrimLeft(kv[0], "\t") == timeField {
 
 				var err error
 				blockTime, err = strconv.ParseInt(kv[1], 10, 64)
 				if err != nil {
-					errc <- err
+					parseError(errc, block.errorAt(i, err))
 				}
 
-				//fmt.Printf("Last Created: %d, Item's Time: %d, UnixTime: %s\n", block.LastCreated, blockTime, time.Unix(blockTime, 0).String())
-
 				// Compare this block's time to the last status.dat's created time.
 				// We care about blocks that are newer than the last created time to
 				// avoid uploading duplicate data points between status.dat updates.
-				if block.LastCreated > blockTime {
+				if blockTime != 0 && block.LastCreated > blockTime {
 					skip = true
 					break
 				}
@@ -168,7 +185,7 @@ func ParseBlock(blockc chan Block, pointc chan *client.Point, errc chan error) {
 				err := parsePerfData(strings.TrimPrefix(line, "\tperformance_data="), &fields)
 
 				if err != nil {
-					errc <- err
+					parseError(errc, block.errorAt(i, err))
 				}
 				continue
 			}
@@ -188,22 +205,14 @@ func ParseBlock(blockc chan Block, pointc chan *client.Point, errc chan error) {
 					name[1] = kv[1]
 				}
 
-			case block.Name == "info":
-				name[0] = "info"
+			case block.Name == "info" || block.Name == "programstatus":
+				name[0] = block.Name
 
-			//TODO: Figure out which field to use for time, for now skip programstatus
-			case block.Name == "programstatus":
-				skip = true
-				break
-			//name[0] = "programstatus"
-
-			//TODO: Figure out which field to use for time, for now skip contactstatus
 			case block.Name == "contactstatus":
-				skip = true
-				break
-			//if kv[0] == "\tcontact_name" {
-			//	name[0] = kv[1]
-			//}
+				if kv[0] == "\tcontact_name" {
+					name[0] = kv[1]
+					name[1] = block.Name
+				}
 			case block.Name == "hostcomment" || block.Name == "servicecomment" || block.Name == "hostdowntime":
 				if kv[0] == hostNameMatch {
 					name[0] = kv[1]
@@ -214,9 +223,27 @@ func ParseBlock(blockc chan Block, pointc chan *client.Point, errc chan error) {
 			if kv[1] != "" {
 				value, err := parseDataValue(kv[1])
 				if err != nil {
-					errc <- err
+					parseError(errc, block.errorAt(i, err))
 				}
 				fields[strings.TrimLeft(kv[0], "\t")] = value
+				raw[strings.TrimLeft(kv[0], "\t")] = kv[1]
+			}
+		}
+
+		switch {
+		case timeField == IngestTime:
+			blockTime = time.Now().Unix()
+		case timeField == "created" && blockTime == 0:
+			blockTime = block.Created
+		case blockTime == 0:
+			// Never checked, or the field is missing from the block
+			switch rules.zeroTime() {
+			case IngestTime:
+				blockTime = time.Now().Unix()
+			case "created":
+				blockTime = block.Created
+			default:
+				skip = true
 			}
 		}
 
@@ -225,73 +252,166 @@ func ParseBlock(blockc chan Block, pointc chan *client.Point, errc chan error) {
 		}
 		unixTime := time.Unix(blockTime, 0)
 
+		var tags = make(map[string]string, len(block.Tags))
+		for k, v := range block.Tags {
+			tags[k] = v
+		}
+		key := recordKey(block.Name, block.Tags, raw, blockTime)
+		for _, err := range rules.process(block.Name, raw, fields, tags) {
+			parseError(errc, &ParseError{Line: block.Line, Block: block.Name, Err: err})
+		}
+		setKey(fields, key)
+
 		//fmt.Printf("time: %#v, fields: %#v\n", unixTime, fields)
-		point, err := client.NewPoint(prettyName(name), map[string]string{}, fields, unixTime)
+		point, err := client.NewPoint(prettyName(name), tags, fields, unixTime)
 		if err != nil {
-			errc <- err
+			parseError(errc, &ParseError{Line: block.Line, Block: block.Name, Err: err})
+			continue
 		}
 		//fmt.Printf("unixTime: %s, blockTime: %d, name: %s, tags: %s\n", unixTime.String(), blockTime, point.Name(), point.Tags())
 
-		pointc <- point
+		select {
+		case pointc <- point:
+			pointsEmitted.Inc()
+		case <-ctx.Done():
+			return
+		}
 
 	}
 }
 
-// Uploader takes Series from ParseBlock and either outputs Marshal'ed JSON when no-op'ed
-// or pushes the series to InfluxDB
-func Uploader(noop *bool, jsonOut *bool, c client.Client, pointc chan *client.Point, endOfFile chan bool, errc chan error) {
-	var count int64
+// WriteFunc writes a batch of points to their destination.
+type WriteFunc func(points []*client.Point) error
+
+// DecodePoints parses line protocol records, as produced by Point.String(),
+// back into points. Records that can't be parsed are skipped and returned
+// in a *DecodeError along with the points of the others.
+func DecodePoints(recs [][]byte) ([]*client.Point, error) {
+	var points = make([]*client.Point, 0, len(recs))
+	var decodeErr *DecodeError
+
+	for _, rec := range recs {
+		pts, err := models.ParsePoints(rec)
+		if err != nil {
+			if decodeErr == nil {
+				decodeErr = &DecodeError{Err: err}
+			}
+			decodeErr.Records = append(decodeErr.Records, rec)
+			continue
+		}
+		for _, pt := range pts {
+			points = append(points, client.NewPointFrom(pt))
+		}
+	}
+	if decodeErr != nil {
+		return points, decodeErr
+	}
+	return points, nil
+}
+
+// Uploader takes Points from ParseBlock and hands them off in batches sized
+// by size to write. Once pointc is closed the last batch is flushed, if ctx
+// is done first any unflushed points are abandoned.
+func Uploader(ctx context.Context, size Batch, write WriteFunc, pointc chan *client.Point, endOfFile chan bool, errc chan error) {
+	var batch = make([]*client.Point, 0, size.Size)
 
 	//TODO Add this func to only run when verbose
 	go func() {
 		for range endOfFile {
 
-			log.Printf("Uploaded %d points (est.)", count)
-			count = 0
+			log.Printf("Uploaded %d points (est.)", uploadedSinceLastLog())
 		}
 	}()
 
-	for point := range pointc {
-		//fmt.Printf("time: %s, name: %s, tags: %s\n", point.Time().String(), point.Name(), point.Tags())
-		count++
-		if *jsonOut {
-			fields, err := point.Fields()
-			if err != nil {
-				errc <- err
-				continue
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := write(batch); err != nil {
+			errc <- err
+		}
+		batch = make([]*client.Point, 0, size.Size)
+	}
+
+	ticker := time.NewTicker(size.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case point, ok := <-pointc:
+			if !ok {
+				flush()
+				return
 			}
-			b, _ := json.MarshalIndent(fields, "", "  ")
-			b = append(b, "\n"...)
-			os.Stdout.Write(b)
+			//fmt.Printf("time: %s, name: %s, tags: %s\n", point.Time().String(), point.Name(), point.Tags())
+			pointsUploaded.Inc()
+			batch = append(batch, point)
+			if len(batch) >= size.Size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			return
 		}
+	}
+}
 
-		//if *noop == false {
-		//	if err := c.WriteSeriesWithTimePrecision([]*client.Series{series}, client.Second); err != nil {
-		//		errc <- err
-		//	}
-		//}
+// readLines calls f with each line of r, without its line ending, and its
+// line number. Empty lines are counted but skipped.
+func readLines(r io.Reader, f func(n int, line string)) error {
+	buf := bufio.NewReader(r)
+	var n int
+	for {
+		line, err := buf.ReadString('\n')
+		if len(line) > 0 {
+			n++
+			if line = strings.TrimRight(line, "\r\n"); line != "" {
+				f(n, line)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
 	}
 }
 
 // Reader reads files pushed to the filec channel, and outputs Block structs
-func Reader(blockc chan Block, filec chan *os.File, endOfFile chan bool, errc chan error) {
+// carrying tags. It resumes from and updates cp as each file is fully read.
+// Unless statusc is nil, the status of every host and service in each file
+// is sent to it once the file is read, replacing any status not taken yet so
+// a slow receiver never holds up reading. statusc must be buffered. Once ctx
+// is done Reader finishes the file it is on and returns.
+func Reader(ctx context.Context, cp *Checkpoint, tags map[string]string, blockc chan Block, filec chan io.ReadCloser, endOfFile chan bool, statusc chan *CurrentStatus, errc chan error) {
 
 	var lastCreated int64
-	var currentCreated int64
+	var currentCreated = cp.created()
 
 	for file := range filec {
+		if ctx.Err() != nil {
+			file.Close()
+			return
+		}
 		var inBlock bool
 		var firstBlock = true
 		var name string
+		var start int
 		var lines = make([]string, 0, 55)
 		var count int64
+		var skip bool
+		var status = &CurrentStatus{Instance: tags["instance"]}
 
 		//TODO Add to verbose log level
 		log.Print("Starting to read new file")
 
 		// Start reading the file
-		readline.ReadLine(file, func(line string) {
+		err := readLines(file, func(n int, line string) {
 
+			if skip {
+				return
+			}
 			if string(line[0]) == "#" {
 				/*if *debug {
 					log.Printf("Skipped comment: %s", line)
@@ -299,6 +419,9 @@ func Reader(blockc chan Block, filec chan *os.File, endOfFile chan bool, errc ch
 				return
 			}
 
+			if !inBlock {
+				start = n
+			}
 			lines = parseLine(&line, &inBlock, &name, lines)
 			//log.Printf("Lines: %s", lines)
 			//Finished with a block
@@ -308,13 +431,18 @@ func Reader(blockc chan Block, filec chan *os.File, endOfFile chan bool, errc ch
 				// update currentCreated and lastCreated before we move on.
 				if firstBlock {
 
-					infoBlock := &Block{name, lines, currentCreated, lastCreated}
+					infoBlock := &Block{Name: name, Lines: lines, Created: currentCreated, LastCreated: lastCreated, Tags: tags, Line: start}
 					err := parseInfoBlock(infoBlock)
 					if err != nil {
-						log.Fatalf("Parsing Info Block failed, exiting: %s", err)
+						// Without its created time none of the file can
+						// be placed, so the rest of it is skipped
+						parseError(errc, &ParseError{Line: start, Block: name, Err: &errInfoBlock{err.Error()}})
+						skip = true
+						return
 					}
 					lastCreated = infoBlock.LastCreated
 					currentCreated = infoBlock.Created
+					setLastCreated(currentCreated)
 
 					//TODO add to verbose level
 					log.Printf("Info block parsed: lastCreated time %d, currentCreated time %d", lastCreated, currentCreated)
@@ -322,21 +450,92 @@ func Reader(blockc chan Block, filec chan *os.File, endOfFile chan bool, errc ch
 					firstBlock = false
 				}
 				count++
-				blockc <- Block{name, lines, currentCreated, lastCreated}
+				if statusc != nil {
+					status.add(name, lines)
+				}
+				blockc <- Block{Name: name, Lines: lines, Created: currentCreated, LastCreated: lastCreated, Tags: tags, Line: start}
 
 				//Empty the lines slice and name string since we're headed into a new block.
 				lines = make([]string, 0, 55)
 				name = ""
 			}
 		})
+		if err != nil {
+			errc <- err
+		}
+		if inBlock && !skip {
+			parseError(errc, &ParseError{Line: start, Block: name, Err: &errUnterminatedBlock{name}})
+		}
+		if skip {
+			if err := file.Close(); err != nil {
+				errc <- err
+			}
+			continue
+		}
 
 		log.Printf("Read in %d items", count)
+		cp.setCreated(currentCreated)
+		filesRead.Inc()
+		lastRead.Set(float64(time.Now().UnixNano()) / 1e9)
 		endOfFile <- true
+		if statusc != nil && err == nil && !inBlock {
+			status.Created = time.Unix(currentCreated, 0)
+			// Reader is the only sender, so once the stale status is
+			// taken out there is room for this one
+			select {
+			case <-statusc:
+			default:
+			}
+			statusc <- status
+		}
 
-		err := file.Close()
+		err = file.Close()
 		if err != nil {
 			errc <- err
 		}
 	}
 
 }
+
+// ParseFile parses a single status.dat with Reader and ParseBlock, as the
+// ingest pipeline does, and returns the points from it. Errors are passed to
+// errFn as they are found.
+func ParseFile(file io.ReadCloser, rules *Rules, tags map[string]string, errFn func(error)) []*client.Point {
+	var ctx = context.Background()
+	var blockc = make(chan Block, 100)
+	var pointc = make(chan *client.Point, 100)
+	var filec = make(chan io.ReadCloser, 1)
+	var endOfFile = make(chan bool, 1)
+	var errc = make(chan error, 10)
+
+	filec <- file
+	close(filec)
+
+	go func() {
+		Reader(ctx, &Checkpoint{}, tags, blockc, filec, endOfFile, nil, errc)
+		close(blockc)
+	}()
+	go func() {
+		ParseBlock(ctx, NewRuleSet(rules), blockc, pointc, errc)
+		close(pointc)
+	}()
+
+	var points []*client.Point
+	for pointc != nil {
+		select {
+		case point, ok := <-pointc:
+			if !ok {
+				pointc = nil
+				continue
+			}
+			points = append(points, point)
+		case err := <-errc:
+			errFn(err)
+		}
+	}
+	// Reader and ParseBlock are done, only what is buffered is left
+	for len(errc) > 0 {
+		errFn(<-errc)
+	}
+	return points
+}
@@ -1,8 +1,21 @@
 package nagios
 
 import (
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
 )
 
 func Test_trimUnit(t *testing.T) {
@@ -224,3 +237,771 @@ func Test_parseInfoBlock(t *testing.T) {
 		})
 	}
 }
+
+func TestRules_apply(t *testing.T) {
+	rules := &Rules{
+		Tags:  map[string][]string{"servicestatus": {"host_name", "service_description"}},
+		Types: map[string]string{"current_state": "int", "last_version": "string"},
+	}
+	raw := map[string]string{
+		"host_name":           "host1",
+		"service_description": "PING",
+		"current_state":       "2",
+		"last_version":        "4.4",
+	}
+	fields := map[string]interface{}{
+		"host_name":           "host1",
+		"service_description": "PING",
+		"current_state":       2.0,
+		"last_version":        4.4,
+	}
+	tags := map[string]string{"instance": "prod"}
+
+	if err := rules.apply("servicestatus", raw, fields, tags); err != nil {
+		t.Fatalf("Rules.apply() error = %v", err)
+	}
+
+	wantTags := map[string]string{"instance": "prod", "host_name": "host1", "service_description": "PING"}
+	wantFields := map[string]interface{}{"current_state": int64(2), "last_version": "4.4"}
+	if !reflect.DeepEqual(tags, wantTags) {
+		t.Errorf("Rules.apply() tags = %#v, want %#v", tags, wantTags)
+	}
+	if !reflect.DeepEqual(fields, wantFields) {
+		t.Errorf("Rules.apply() fields = %#v, want %#v", fields, wantFields)
+	}
+}
+
+func TestRules_process(t *testing.T) {
+	pattern := func(s string) *Pattern {
+		p, err := CompilePattern(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	regex := func(s string) *regexp.Regexp {
+		re, err := CompileRegex(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return re
+	}
+
+	rules := &Rules{
+		Fields: map[string]FieldFilter{
+			"servicestatus": {
+				Include: []*Pattern{pattern("current_*"), pattern("output"), pattern("site"), pattern(`/^performance_data\..*$/`)},
+				Exclude: []*Pattern{pattern(`/\.(warn|crit)$/`)},
+			},
+		},
+		Relabel: []Relabel{
+			{Action: RenameAction, Source: "plugin_output", Target: "output"},
+			{Block: "hoststatus", Action: DropAction, Source: "current_state"},
+			{Action: DropAction, Source: "current_attempt", Regex: regex("1")},
+			{Action: TagAction, Source: "check_command", Target: "command"},
+			{Action: ReplaceAction, Source: "host_name", Target: "site", Regex: regex(`(\w+)-.*`), Replacement: "$1"},
+		},
+	}
+	raw := map[string]string{
+		"host_name":       "dc1-web1",
+		"check_command":   "check_ping",
+		"plugin_output":   "PING OK",
+		"current_state":   "0",
+		"current_attempt": "1",
+		"max_attempts":    "3",
+	}
+	fields := map[string]interface{}{
+		"host_name":                 "dc1-web1",
+		"check_command":             "check_ping",
+		"plugin_output":             "PING OK",
+		"current_state":             0.0,
+		"current_attempt":           1.0,
+		"max_attempts":              3.0,
+		"performance_data.rta":      0.5,
+		"performance_data.rta.warn": 100.0,
+	}
+	tags := map[string]string{}
+
+	if errs := rules.process("servicestatus", raw, fields, tags); len(errs) != 0 {
+		t.Fatalf("Rules.process() errors = %v", errs)
+	}
+
+	wantFields := map[string]interface{}{"current_state": int64(0), "output": "PING OK", "site": "dc1", "performance_data.rta": 0.5}
+	if !reflect.DeepEqual(fields, wantFields) {
+		t.Errorf("Rules.process() fields = %#v, want %#v", fields, wantFields)
+	}
+	if want := map[string]string{"command": "check_ping"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("Rules.process() tags = %#v, want %#v", tags, want)
+	}
+}
+
+func TestRules_selects(t *testing.T) {
+	f, err := ioutil.TempFile("", "objects.cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("define host {\n\thost_name\tweb1\n\t}\n\n" +
+		"define hostgroup {\n\thostgroup_name\tlinux\n\tmembers\tweb1,db1\n\t}\n\n" +
+		"define hostgroup {\n\thostgroup_name\tprod\n\tmembers\tdb1\n\t}\n")
+	f.Close()
+
+	hostgroups, err := ReadHostgroups(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][]string{"web1": {"linux"}, "db1": {"linux", "prod"}}; !reflect.DeepEqual(hostgroups, want) {
+		t.Errorf("ReadHostgroups() = %v, want %v", hostgroups, want)
+	}
+
+	filter := func(kv ...string) BlockFilter {
+		var f = make(BlockFilter)
+		for i := 0; i < len(kv); i += 2 {
+			p, err := CompilePattern(kv[i+1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			f[kv[i]] = p
+		}
+		return f
+	}
+	rules := &Rules{
+		Include: []BlockFilter{
+			filter("hostgroup", "prod"),
+			filter("host_name", "web*", "check_command", "/^check_mk-/"),
+		},
+		Exclude: []BlockFilter{
+			filter("_ENVIRONMENT", "dev"),
+		},
+		Hostgroups: hostgroups,
+	}
+
+	tests := []struct {
+		name  string
+		lines []string
+		want  bool
+	}{
+		{"In hostgroup", []string{"\thost_name=db1", "\tcheck_command=check_ping"}, true},
+		{"All conditions match", []string{"\thost_name=web1", "\tcheck_command=check_mk-uptime"}, true},
+		{"One condition fails", []string{"\thost_name=web1", "\tcheck_command=check_ping"}, false},
+		{"Field missing", []string{"\thost_name=web1"}, false},
+		{"Custom variable excluded", []string{"\thost_name=db1", "\t_ENVIRONMENT=0;dev"}, false},
+		{"No host_name", []string{"\tnagios_pid=1234"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules.selects(lineLookup(tt.lines)); got != tt.want {
+				t.Errorf("Rules.selects() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRules_typeFields(t *testing.T) {
+	rules := &Rules{Types: map[string]string{"current_state": "string"}, Schema: NewSchema()}
+
+	tests := []struct {
+		name     string
+		raw      map[string]string
+		fields   map[string]interface{}
+		want     map[string]interface{}
+		wantErrs int
+	}{
+		{
+			name:   "Known types",
+			raw:    map[string]string{"last_check": "1416605950", "last_version": "4.4", "check_latency": "0.1", "_FILENAME": "0;/etc/hosts.mk", "current_state": "2"},
+			fields: map[string]interface{}{"last_check": 1416605950.0, "last_version": 4.4, "check_latency": 0.1, "_FILENAME": 0.0, "current_state": "2", "performance_data.rta": 0.5},
+			want:   map[string]interface{}{"last_check": int64(1416605950), "last_version": "4.4", "check_latency": 0.1, "_FILENAME": "0;/etc/hosts.mk", "current_state": "2", "performance_data.rta": 0.5},
+		},
+		{
+			name:   "Unknown field first seen",
+			raw:    map[string]string{"custom_counter": "5"},
+			fields: map[string]interface{}{"custom_counter": 5.0},
+			want:   map[string]interface{}{"custom_counter": 5.0},
+		},
+		{
+			name:     "Unknown field conflicts",
+			raw:      map[string]string{"custom_counter": "n/a"},
+			fields:   map[string]interface{}{"custom_counter": "n/a"},
+			want:     map[string]interface{}{},
+			wantErrs: 1,
+		},
+		{
+			name:   "Conflicts reported once",
+			raw:    map[string]string{"custom_counter": "n/a"},
+			fields: map[string]interface{}{"custom_counter": "n/a"},
+			want:   map[string]interface{}{},
+		},
+		{
+			name:     "Perfdata range",
+			fields:   map[string]interface{}{"performance_data.rta.warn": "10:20"},
+			want:     map[string]interface{}{},
+			wantErrs: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := rules.typeFields(tt.raw, tt.fields)
+			if len(errs) != tt.wantErrs {
+				t.Errorf("Rules.typeFields() errors = %v, want %d", errs, tt.wantErrs)
+			}
+			if !reflect.DeepEqual(tt.fields, tt.want) {
+				t.Errorf("Rules.typeFields() fields = %#v, want %#v", tt.fields, tt.want)
+			}
+		})
+	}
+
+	if want := map[string]string{"custom_counter": "float"}; !reflect.DeepEqual(rules.Schema.Types(), want) {
+		t.Errorf("Schema.Types() = %v, want %v", rules.Schema.Types(), want)
+	}
+
+	floats := &Rules{Floats: true}
+	fields := map[string]interface{}{"last_check": 1416605950.0, "last_version": 4.4}
+	floats.typeFields(map[string]string{"last_check": "1416605950", "last_version": "4.4"}, fields)
+	if want := map[string]interface{}{"last_check": 1416605950.0, "last_version": "4.4"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("Rules.typeFields() with Floats fields = %#v, want %#v", fields, want)
+	}
+}
+
+func TestLoadSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schema.json")
+
+	schema, err := LoadSchema(path)
+	if err != nil {
+		t.Fatalf("LoadSchema() error = %v", err)
+	}
+	schema.typeOf("custom_counter", 5.0)
+	schema.typeOf("custom_name", "n/a")
+	if err := schema.Save(); err != nil {
+		t.Fatalf("Schema.Save() error = %v", err)
+	}
+
+	loaded, err := LoadSchema(path)
+	if err != nil {
+		t.Fatalf("LoadSchema() error = %v", err)
+	}
+	if !reflect.DeepEqual(loaded.Types(), schema.Types()) {
+		t.Errorf("LoadSchema() types = %v, want %v", loaded.Types(), schema.Types())
+	}
+	// A string now doesn't unlock the field saved as a float
+	if typ := loaded.typeOf("custom_counter", "n/a"); typ != "float" {
+		t.Errorf("Schema.typeOf() = %s, want float", typ)
+	}
+}
+
+func TestRange_Alert(t *testing.T) {
+	tests := []struct {
+		rng     string
+		alert   []float64
+		noAlert []float64
+	}{
+		{"10", []float64{-1, 11}, []float64{0, 5, 10}},
+		{"10:", []float64{9.9}, []float64{10, 1e9}},
+		{"~:10", []float64{10.1}, []float64{-1e9, 10}},
+		{"10:20", []float64{9, 21}, []float64{10, 15, 20}},
+		{"@10:20", []float64{10, 15, 20}, []float64{9, 21}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rng, func(t *testing.T) {
+			r, err := ParseRange(tt.rng)
+			if err != nil {
+				t.Fatalf("ParseRange() error = %v", err)
+			}
+			for _, v := range tt.alert {
+				if !r.Alert(v) {
+					t.Errorf("Range(%s).Alert(%v) = false, want true", tt.rng, v)
+				}
+			}
+			for _, v := range tt.noAlert {
+				if r.Alert(v) {
+					t.Errorf("Range(%s).Alert(%v) = true, want false", tt.rng, v)
+				}
+			}
+		})
+	}
+
+	for _, s := range []string{"abc", "20:10", "1:x"} {
+		if _, err := ParseRange(s); err == nil {
+			t.Errorf("ParseRange(%q) error = nil, want an error", s)
+		}
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "status.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\n\ninfo {\n\tcreated=1416605951\n\tversion=3.5.1\n\t}\n\n" +
+		"hoststatus {\n\thost_name=host1\n\tcurrent_state=0\n\tlast_check=1416605950\n\t}\n\n" +
+		"servicestatus {\n\thost_name=host1\n\tbad line\n\tlast_check=1416605950\n\t}\n\n" +
+		"hoststatus {\n\thost_name=host2\n")
+	f.Seek(0, 0)
+
+	var lines []int
+	points := ParseFile(f, nil, map[string]string{"instance": "test"}, func(err error) {
+		if e, ok := err.(*ParseError); ok {
+			lines = append(lines, e.Line)
+			return
+		}
+		t.Errorf("ParseFile() error = %v, want a *ParseError", err)
+	})
+	sort.Ints(lines)
+
+	if len(points) != 3 {
+		t.Errorf("ParseFile() got %d points, want 3", len(points))
+	}
+	for _, point := range points {
+		if point.Tags()["instance"] != "test" {
+			t.Errorf("ParseFile() point %s tags = %v", point.Name(), point.Tags())
+		}
+	}
+	if want := []int{16, 20}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("ParseFile() error lines = %v, want %v", lines, want)
+	}
+}
+
+func TestParseFile_infoBlock(t *testing.T) {
+	const status = "info {\n\tcreated=abc\n\tversion=3.5.1\n\t}\n" +
+		"hoststatus {\n\thost_name=host1\n\tlast_check=1416605950\n\t}\n"
+
+	var errs []error
+	points := ParseFile(ioutil.NopCloser(strings.NewReader(status)), nil, nil, func(err error) {
+		errs = append(errs, err)
+	})
+	if len(points) != 0 {
+		t.Errorf("ParseFile() got %d points, want none", len(points))
+	}
+	if len(errs) != 1 {
+		t.Fatalf("ParseFile() errors = %v, want 1", errs)
+	}
+	if e, ok := errs[0].(*ParseError); !ok || e.Line != 1 || e.Block != "info" {
+		t.Errorf("ParseFile() error = %#v, want a *ParseError for the info block on line 1", errs[0])
+	}
+}
+
+func TestParseFile_timestamps(t *testing.T) {
+	const status = "info {\n\tcreated=1416605951\n\tversion=3.5.1\n\t}\n" +
+		"programstatus {\n\tnagios_pid=1234\n\t}\n" +
+		"hoststatus {\n\thost_name=host1\n\tlast_check=1416605950\n\tlast_update=1416605940\n\t}\n" +
+		"servicestatus {\n\thost_name=host1\n\tcheck_command=check_ping\n\tlast_check=0\n\t}\n"
+
+	tests := []struct {
+		name  string
+		rules *Rules
+		want  map[string]int64
+	}{
+		{"Defaults", nil, map[string]int64{"info": 1416605951, "programstatus": 1416605951, "host1": 1416605950}},
+		{"Field per block", &Rules{Timestamps: map[string]string{"hoststatus": "last_update"}}, map[string]int64{"info": 1416605951, "programstatus": 1416605951, "host1": 1416605940}},
+		{"Zero as created", &Rules{ZeroTime: "created"}, map[string]int64{"info": 1416605951, "programstatus": 1416605951, "host1": 1416605950, "host1.check_ping": 1416605951}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points := ParseFile(ioutil.NopCloser(strings.NewReader(status)), tt.rules, nil, func(err error) {
+				t.Errorf("ParseFile() error = %v", err)
+			})
+			var got = make(map[string]int64, len(points))
+			for _, point := range points {
+				got[point.Name()] = point.Time().Unix()
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseFile() times = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	points := ParseFile(ioutil.NopCloser(strings.NewReader(status)), &Rules{Timestamps: map[string]string{"programstatus": IngestTime}}, nil, func(error) {})
+	for _, point := range points {
+		if point.Name() == "programstatus" && time.Since(point.Time()) > time.Minute {
+			t.Errorf("ParseFile() programstatus time = %s, want the ingest time", point.Time())
+		}
+	}
+}
+
+func TestParsePerfdata(t *testing.T) {
+	input := "DATATYPE::SERVICEPERFDATA\tTIMET::1416605950\tHOSTNAME::host1\tSERVICEDESC::Load\tSERVICEPERFDATA::load1=0.5;5;10;0\tSERVICECHECKCOMMAND::check_load\tSERVICESTATE::OK\n" +
+		"DATATYPE::HOSTPERFDATA\tTIMET::1416605950\tHOSTNAME::host2\tHOSTPERFDATA::rta=0.1ms;100;500;0\tHOSTSTATE::UP\n" +
+		"not perfdata\n" +
+		"DATATYPE::HOSTPERFDATA\tTIMET::\tHOSTNAME::host3\n"
+
+	var lines []int
+	points, err := ParsePerfdata(strings.NewReader(input), &Rules{Tags: map[string][]string{"servicestatus": {"service_description"}}}, map[string]string{"instance": "test"}, func(err error) {
+		if e, ok := err.(*ParseError); ok {
+			lines = append(lines, e.Line)
+			return
+		}
+		t.Errorf("ParsePerfdata() error = %v, want a *ParseError", err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 2 {
+		t.Fatalf("ParsePerfdata() got %d points, want 2", len(points))
+	}
+	if name := points[0].Name(); name != "host1.check_load" {
+		t.Errorf("ParsePerfdata() name = %s, want host1.check_load", name)
+	}
+	if tags := points[0].Tags(); tags["instance"] != "test" || tags["service_description"] != "Load" {
+		t.Errorf("ParsePerfdata() tags = %v", tags)
+	}
+	fields, _ := points[0].Fields()
+	if fields["performance_data.load1"] != 0.5 || fields["servicestate"] != "OK" {
+		t.Errorf("ParsePerfdata() fields = %v", fields)
+	}
+	if name := points[1].Name(); name != "host2" {
+		t.Errorf("ParsePerfdata() name = %s, want host2", name)
+	}
+	if want := []int{3, 4}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("ParsePerfdata() error lines = %v, want %v", lines, want)
+	}
+}
+
+func TestParseCheckResults(t *testing.T) {
+	input := "### Active Check Result File ###\nfile_time=1416605900\n\n" +
+		"### Nagios Service Check Result ###\n# Time: Fri Nov 21 21:39:10 2014\nhost_name=host1\nservice_description=Disk\ncheck_type=0\n" +
+		"latency=0.25\nstart_time=1416605950.5\nfinish_time=1416605951.0\nreturn_code=2\n" +
+		`output=DISK CRITICAL - /var 95%|/var=95%;80;90\nC:\\ 10%\n/tmp 5%|/tmp=5%;80;90` + "\n\n" +
+		"### NRDP Check ###\nhost_name=host2\ncheck_type=1\nreturn_code=0\noutput=PING OK\n\n" +
+		"host_name=host3\nnot a key value\n\n" +
+		"return_code=0\n"
+
+	var lines []int
+	points, err := ParseCheckResults(strings.NewReader(input), &Rules{Tags: map[string][]string{"servicestatus": {"service_description"}}}, map[string]string{"instance": "test"}, func(err error) {
+		if e, ok := err.(*ParseError); ok {
+			lines = append(lines, e.Line)
+			return
+		}
+		t.Errorf("ParseCheckResults() error = %v, want a *ParseError", err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 2 {
+		t.Fatalf("ParseCheckResults() got %d points, want 2", len(points))
+	}
+	if name := points[0].Name(); name != "host1.Disk" {
+		t.Errorf("ParseCheckResults() name = %s, want host1.Disk", name)
+	}
+	if tags := points[0].Tags(); tags["instance"] != "test" || tags["service_description"] != "Disk" {
+		t.Errorf("ParseCheckResults() tags = %v", tags)
+	}
+	fields, _ := points[0].Fields()
+	if fields["current_state"] != int64(2) || fields["check_latency"] != 0.25 || fields["check_execution_time"] != 0.5 ||
+		fields["plugin_output"] != "DISK CRITICAL - /var 95%" || fields["long_plugin_output"] != "C:\\ 10%\n/tmp 5%" ||
+		fields["performance_data./var"] != 0.95 || fields["performance_data./tmp"] != 0.05 {
+		t.Errorf("ParseCheckResults() fields = %v", fields)
+	}
+	if at := points[0].Time().Unix(); at != 1416605951 {
+		t.Errorf("ParseCheckResults() time = %d, want the finish_time", at)
+	}
+	// NRDP results are timed by the file_time without a start_time
+	if name, at := points[1].Name(), points[1].Time().Unix(); name != "host2" || at != 1416605900 {
+		t.Errorf("ParseCheckResults() name = %s, time = %d, want host2 at the file_time", name, at)
+	}
+	if want := []int{22, 24}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("ParseCheckResults() error lines = %v, want %v", lines, want)
+	}
+}
+
+func TestParseLog(t *testing.T) {
+	lines := []string{
+		"[1416605950] SERVICE ALERT: host1;PING;CRITICAL;SOFT;1;PING CRITICAL - Packet loss = 100%",
+		"[1416605951] HOST NOTIFICATION: admin;host2;DOWN;notify-host-by-email;PING CRITICAL; unreachable",
+		"[1416605952] Nagios 3.5.1 starting... (PID=1234)",
+		"no timestamp",
+	}
+
+	var errs int
+	points := ParseLog(lines, &Rules{Tags: map[string][]string{"service_alert": {"service_description"}}}, map[string]string{"instance": "test"}, func(err error) {
+		errs++
+	})
+	if errs != 1 {
+		t.Errorf("ParseLog() got %d errors, want 1", errs)
+	}
+	if len(points) != 3 {
+		t.Fatalf("ParseLog() got %d points, want 3", len(points))
+	}
+
+	want := []struct {
+		name   string
+		tags   map[string]string
+		fields map[string]interface{}
+	}{
+		{"host1.service_alert", map[string]string{"instance": "test", "service_description": "PING"}, map[string]interface{}{
+			"host_name": "host1", "state": "CRITICAL", "state_type": int64(0), "attempt": int64(1), "output": "PING CRITICAL - Packet loss = 100%"}},
+		{"host2.host_notification", map[string]string{"instance": "test"}, map[string]interface{}{
+			"contact_name": "admin", "host_name": "host2", "state": "DOWN", "notification_command": "notify-host-by-email", "output": "PING CRITICAL; unreachable"}},
+		{"log", map[string]string{"instance": "test"}, map[string]interface{}{"message": "Nagios 3.5.1 starting... (PID=1234)"}},
+	}
+	for i, w := range want {
+		fields, _ := points[i].Fields()
+		if _, ok := fields[KeyField].(string); !ok {
+			t.Errorf("ParseLog() point %d has no %s", i, KeyField)
+		}
+		delete(fields, KeyField)
+		if points[i].Name() != w.name || !reflect.DeepEqual(points[i].Tags(), w.tags) || !reflect.DeepEqual(fields, w.fields) {
+			t.Errorf("ParseLog() point %d = %s %v %v, want %s %v %v", i, points[i].Name(), points[i].Tags(), fields, w.name, w.tags, w.fields)
+		}
+	}
+}
+
+func TestCurrentStatus(t *testing.T) {
+	const status = "info {\n\tcreated=1416605951\n\tversion=3.5.1\n\t}\n" +
+		"hoststatus {\n\thost_name=web1\n\tcurrent_state=0\n\tstate_type=1\n\tplugin_output=PING OK\n\tlast_check=1416605950\n\t}\n" +
+		"servicestatus {\n\thost_name=web1\n\tservice_description=Disk\n\tcurrent_state=2\n\tplugin_output=DISK CRITICAL\n\tlast_check=0\n" +
+		"\tproblem_has_been_acknowledged=1\n\tscheduled_downtime_depth=2\n\t_ENVIRONMENT=0;dev\n\t}\n" +
+		"hostcomment {\n\thost_name=web1\n\tentry_time=1416605900\n\t}\n"
+
+	got := readStatus(status, map[string]string{"instance": "prod"})
+	want := &CurrentStatus{
+		Instance: "prod",
+		Created:  time.Unix(1416605951, 0),
+		Statuses: []Status{
+			{HostName: "web1", StateType: 1, Output: "PING OK", LastCheck: time.Unix(1416605950, 0)},
+			{HostName: "web1", ServiceDescription: "Disk", State: 2, Output: "DISK CRITICAL", Acknowledged: true, DowntimeDepth: 2},
+		},
+	}
+	for i := range got.Statuses {
+		got.Statuses[i].raw = nil
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Reader() status = %+v, want %+v", got, want)
+	}
+
+	p, err := CompilePattern("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = readStatus(status, nil).Filter(&Rules{Exclude: []BlockFilter{{"_ENVIRONMENT": p}}})
+	if len(got.Statuses) != 1 || got.Statuses[0].ServiceDescription != "" {
+		t.Errorf("CurrentStatus.Filter() = %+v, want only the host", got.Statuses)
+	}
+	got = readStatus(status, nil).Filter(&Rules{Blocks: map[string]bool{"servicestatus": true}})
+	if len(got.Statuses) != 1 || got.Statuses[0].ServiceDescription != "Disk" {
+		t.Errorf("CurrentStatus.Filter() = %+v, want only the service", got.Statuses)
+	}
+
+	// With nobody taking them, the status of a later file replaces the
+	// earlier one rather than blocking Reader
+	var filec = make(chan io.ReadCloser, 2)
+	var statusc = make(chan *CurrentStatus, 1)
+	filec <- ioutil.NopCloser(strings.NewReader(status))
+	filec <- ioutil.NopCloser(strings.NewReader(strings.Replace(status, "created=1416605951", "created=1416605961", 1)))
+	close(filec)
+	Reader(context.Background(), &Checkpoint{}, nil, make(chan Block, 10), filec, make(chan bool, 2), statusc, make(chan error, 10))
+	if got := <-statusc; got.Created.Unix() != 1416605961 {
+		t.Errorf("Reader() status created = %d, want the last file's 1416605961", got.Created.Unix())
+	}
+}
+
+// readStatus reads a status.dat with Reader, returning the current status
+// it sends.
+func readStatus(status string, tags map[string]string) *CurrentStatus {
+	var filec = make(chan io.ReadCloser, 1)
+	var statusc = make(chan *CurrentStatus, 1)
+	filec <- ioutil.NopCloser(strings.NewReader(status))
+	close(filec)
+	Reader(context.Background(), &Checkpoint{}, tags, make(chan Block, 10), filec, make(chan bool, 1), statusc, make(chan error, 10))
+	return <-statusc
+}
+
+func TestFindSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	status := func(created string) string {
+		return "# comment\ninfo {\n\tcreated=" + created + "\n\t}\n\nhoststatus {\n\thost_name=host1\n\t}\n"
+	}
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.dat", status("300"))
+	write("b.dat", status("100"))
+	write("copy-of-b.dat", status("100"))
+	write("notes.txt", "not a status.dat\n")
+
+	f, err := os.Create(filepath.Join(dir, "c.dat.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte(status("200")))
+	gz.Close()
+	f.Close()
+
+	got, err := FindSnapshots([]string{dir})
+	if err != nil {
+		t.Fatalf("FindSnapshots() error = %v", err)
+	}
+	want := []Snapshot{
+		{filepath.Join(dir, "b.dat"), 100},
+		{filepath.Join(dir, "c.dat.gz"), 200},
+		{filepath.Join(dir, "a.dat"), 300},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindSnapshots() = %v, want %v", got, want)
+	}
+
+	if _, err := FindSnapshots([]string{filepath.Join(dir, "*.missing")}); err == nil {
+		t.Errorf("FindSnapshots() of a glob matching nothing error = nil, want an error")
+	}
+}
+
+// syntheticStatus returns a status.dat of hosts hosts, each with services
+// services reporting perfdata.
+func syntheticStatus(hosts, services int) string {
+	var b strings.Builder
+	b.WriteString("info {\n\tcreated=1416605951\n\tversion=3.5.1\n\t}\n\n")
+	for h := 0; h < hosts; h++ {
+		host := "host" + strconv.Itoa(h)
+		b.WriteString("hoststatus {\n\thost_name=" + host + "\n\tcurrent_state=0\n\tstate_type=1\n\tcurrent_attempt=1\n" +
+			"\tplugin_output=PING OK - Packet loss = 0%, RTA = 0.50 ms\n\tperformance_data=rta=0.500ms;100.000;500.000;0; pl=0%;20;60;;\n" +
+			"\tlast_check=1416605950\n\tcheck_latency=0.101\n\tcheck_execution_time=4.012\n\t}\n\n")
+		for s := 0; s < services; s++ {
+			b.WriteString("servicestatus {\n\thost_name=" + host + "\n\tservice_description=Service " + strconv.Itoa(s) +
+				"\n\tcheck_command=check_disk\n\tcurrent_state=0\n\tstate_type=1\n\tcurrent_attempt=1\n" +
+				"\tplugin_output=DISK OK - free space: / 3326 MB (56%)\n\tperformance_data=/=2643MB;5948;5958;0;5968\n" +
+				"\tlast_check=1416605950\n\tcheck_latency=0.101\n\tcheck_execution_time=0.012\n\t}\n\n")
+		}
+	}
+	return b.String()
+}
+
+// BenchmarkParseFile parses synthetic status.dat files of 1000 and 10000
+// hosts with 10 services each, reporting the points parsed per second.
+func BenchmarkParseFile(b *testing.B) {
+	for _, hosts := range []int{1000, 10000} {
+		b.Run("services="+strconv.Itoa(hosts*10), func(b *testing.B) {
+			status := syntheticStatus(hosts, 10)
+			b.SetBytes(int64(len(status)))
+			b.ResetTimer()
+
+			var points int
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				points += len(ParseFile(ioutil.NopCloser(strings.NewReader(status)), nil, nil, func(err error) {
+					b.Error(err)
+				}))
+			}
+			b.ReportMetric(float64(points)/time.Since(start).Seconds(), "points/s")
+		})
+	}
+}
+
+// testPoint returns a point at the Unix time at.
+func testPoint(t testing.TB, name string, tags map[string]string, fields map[string]interface{}, at int64) *client.Point {
+	p, err := client.NewPoint(name, tags, fields, time.Unix(at, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestKey(t *testing.T) {
+	tags := map[string]string{"instance": "prod", "host_name": "web1"}
+	base := Key(testPoint(t, "web1.check_disk", tags, map[string]interface{}{"service_description": "Disk", "current_event_id": int64(7), "current_state": int64(0)}, 1416605950))
+
+	tests := []struct {
+		name  string
+		point *client.Point
+		same  bool
+	}{
+		{
+			name:  "Other fields differ",
+			point: testPoint(t, "web1.check_disk", tags, map[string]interface{}{"service_description": "Disk", "current_event_id": int64(7), "current_state": int64(2)}, 1416605950),
+			same:  true,
+		},
+		{
+			name:  "Event id as a float, last_check as a field",
+			point: testPoint(t, "web1.check_disk", tags, map[string]interface{}{"service_description": "Disk", "current_event_id": 7.0, "last_check": int64(1416605950)}, 1416605999),
+			same:  true,
+		},
+		{
+			name:  "Other event",
+			point: testPoint(t, "web1.check_disk", tags, map[string]interface{}{"service_description": "Disk", "current_event_id": int64(8)}, 1416605950),
+		},
+		{
+			name:  "Other check",
+			point: testPoint(t, "web1.check_disk", tags, map[string]interface{}{"service_description": "Disk", "current_event_id": int64(7)}, 1416605960),
+		},
+		{
+			name:  "Other instance",
+			point: testPoint(t, "web1.check_disk", map[string]string{"instance": "dev", "host_name": "web1"}, map[string]interface{}{"service_description": "Disk", "current_event_id": int64(7)}, 1416605950),
+		},
+		{
+			name:  "Other service",
+			point: testPoint(t, "web1.check_disk", tags, map[string]interface{}{"service_description": "Root", "current_event_id": int64(7)}, 1416605950),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Key(tt.point); (got == base) != tt.same {
+				t.Errorf("Key() = %s, base %s, want same %v", got, base, tt.same)
+			}
+		})
+	}
+
+	// The key given when parsed is kept
+	if got := Key(testPoint(t, "web1.check_disk", tags, map[string]interface{}{KeyField: "d9bb06c7"}, 1416605950)); got != "d9bb06c7" {
+		t.Errorf("Key() = %s, want the %s field", got, KeyField)
+	}
+}
+
+func TestParseLog_key(t *testing.T) {
+	// Only the output is kept, so the contacts are told apart by fields
+	// that are filtered out
+	output, err := CompilePattern("output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := &Rules{Fields: map[string]FieldFilter{"service_notification": {Include: []*Pattern{output}}}}
+	lines := []string{
+		"[1416605950] SERVICE NOTIFICATION: admin;host1;PING;CRITICAL;notify-service-by-email;PING CRITICAL",
+		"[1416605950] SERVICE NOTIFICATION: oncall;host1;PING;CRITICAL;notify-service-by-email;PING CRITICAL",
+		"[1416605950] SERVICE NOTIFICATION: admin;host1;PING;CRITICAL;notify-service-by-email;PING CRITICAL",
+	}
+	points := ParseLog(lines, rules, map[string]string{"instance": "test"}, func(err error) {
+		t.Errorf("ParseLog() error = %v", err)
+	})
+	if len(points) != 3 {
+		t.Fatalf("ParseLog() got %d points, want 3", len(points))
+	}
+	if fields, _ := points[0].Fields(); fields["contact_name"] != nil {
+		t.Errorf("ParseLog() fields = %v, want contact_name filtered out", fields)
+	}
+	if Key(points[0]) == Key(points[1]) {
+		t.Errorf("Key() of notifications to two contacts = %s for both", Key(points[0]))
+	}
+	if Key(points[0]) != Key(points[2]) {
+		t.Errorf("Key() of the same notification = %s and %s", Key(points[0]), Key(points[2]))
+	}
+}
+
+func TestDecodePoints(t *testing.T) {
+	recs := [][]byte{
+		[]byte("web1 current_state=0i 1416605951000000000"),
+		[]byte("web1 current_state="),
+		[]byte("web2 current_state=2i 1416605951000000000"),
+	}
+	points, err := DecodePoints(recs)
+	if len(points) != 2 || points[1].Name() != "web2" {
+		t.Errorf("DecodePoints() = %v, want the points of the good records", points)
+	}
+	e, ok := err.(*DecodeError)
+	if !ok || len(e.Records) != 1 || string(e.Records[0]) != "web1 current_state=" {
+		t.Errorf("DecodePoints() error = %v, want the bad record", err)
+	}
+}
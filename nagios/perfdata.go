@@ -0,0 +1,124 @@
+package nagios
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// perfdataBlocks maps the DATATYPE of a perfdata file line to the status.dat
+// block it corresponds to, so the same tags and schema apply to both.
+var perfdataBlocks = map[string]string{
+	"HOSTPERFDATA":    "hoststatus",
+	"SERVICEPERFDATA": "servicestatus",
+}
+
+// perfdataFields maps perfdata file keys to status.dat field names, other keys
+// are lower cased.
+var perfdataFields = map[string]string{
+	"TIMET":               "last_check",
+	"HOSTNAME":            "host_name",
+	"SERVICEDESC":         "service_description",
+	"HOSTCHECKCOMMAND":    "check_command",
+	"SERVICECHECKCOMMAND": "check_command",
+	"HOSTPERFDATA":        "performance_data",
+	"SERVICEPERFDATA":     "performance_data",
+}
+
+// ParsePerfdata parses a file written by the Nagios process-host-perfdata-file
+// and process-service-perfdata-file commands, using the tab separated
+// KEY::VALUE template from PNP4Nagios, for example:
+//
+//	DATATYPE::SERVICEPERFDATA	TIMET::$TIMET$	HOSTNAME::$HOSTNAME$	SERVICEDESC::$SERVICEDESC$	SERVICEPERFDATA::$SERVICEPERFDATA$	SERVICECHECKCOMMAND::$SERVICECHECKCOMMAND$	SERVICESTATE::$SERVICESTATE$
+//
+// Each line becomes a point named and tagged as ParseBlock would the matching
+// hoststatus or servicestatus block. Lines that can't be parsed are passed to
+// errFn and skipped.
+func ParsePerfdata(r io.Reader, rules *Rules, tags map[string]string, errFn func(error)) ([]*client.Point, error) {
+	var points []*client.Point
+	report := func(err error) {
+		parseErrors.With(errorType(err)).Inc()
+		errFn(err)
+	}
+
+	err := readLines(r, func(n int, line string) {
+		var raw = make(map[string]string)
+		var blockName string
+		for _, pair := range strings.Split(line, "\t") {
+			kv := strings.SplitN(pair, "::", 2)
+			if len(kv) < 2 {
+				report(&ParseError{Line: n, Block: "perfdata", Err: &errNotPerfdataLine{pair}})
+				return
+			}
+			if kv[0] == "DATATYPE" {
+				blockName = perfdataBlocks[kv[1]]
+				continue
+			}
+			key, ok := perfdataFields[kv[0]]
+			if !ok {
+				key = strings.ToLower(kv[0])
+			}
+			raw[key] = kv[1]
+		}
+		if blockName == "" {
+			report(&ParseError{Line: n, Block: "perfdata", Err: &errNotPerfdataLine{line}})
+			return
+		}
+		if !rules.wants(blockName) || !rules.selects(mapLookup(raw)) {
+			return
+		}
+		blocksParsed.Inc()
+
+		lastCheck, err := strconv.ParseInt(raw["last_check"], 10, 64)
+		if err != nil {
+			report(&ParseError{Line: n, Block: blockName, Err: err})
+			return
+		}
+		delete(raw, "last_check")
+
+		var fields = make(map[string]interface{})
+		if perfdata := raw["performance_data"]; perfdata != "" {
+			if err := parsePerfData(perfdata, &fields); err != nil {
+				report(&ParseError{Line: n, Block: blockName, Err: err})
+			}
+		}
+		delete(raw, "performance_data")
+
+		for key, v := range raw {
+			if v == "" {
+				continue
+			}
+			value, err := parseDataValue(v)
+			if err != nil {
+				report(&ParseError{Line: n, Block: blockName, Err: err})
+			}
+			fields[key] = value
+		}
+
+		var pointTags = make(map[string]string, len(tags))
+		for k, v := range tags {
+			pointTags[k] = v
+		}
+		key := recordKey(blockName, tags, raw, lastCheck)
+		for _, err := range rules.process(blockName, raw, fields, pointTags) {
+			report(&ParseError{Line: n, Block: blockName, Err: err})
+		}
+		setKey(fields, key)
+
+		var name = []string{raw["host_name"], ""}
+		if blockName == "servicestatus" {
+			name[1] = raw["check_command"]
+		}
+		point, err := client.NewPoint(prettyName(name), pointTags, fields, time.Unix(lastCheck, 0))
+		if err != nil {
+			report(&ParseError{Line: n, Block: blockName, Err: err})
+			return
+		}
+		pointsEmitted.Inc()
+		points = append(points, point)
+	})
+	return points, err
+}
@@ -0,0 +1,161 @@
+package nagios
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Pattern matches field names, either a glob such as last_* or a regexp
+// between slashes such as /^performance_data\..*\.(warn|crit)$/.
+type Pattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+// CompilePattern parses a glob or /regexp/.
+func CompilePattern(s string) (*Pattern, error) {
+	if len(s) > 1 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return nil, err
+		}
+		return &Pattern{re: re}, nil
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return nil, err
+	}
+	return &Pattern{glob: s}, nil
+}
+
+// Match reports whether name matches the pattern.
+func (p *Pattern) Match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	ok, _ := path.Match(p.glob, name)
+	return ok
+}
+
+// FieldFilter selects the fields kept from a block type. Without Include
+// every field is kept unless it matches Exclude.
+type FieldFilter struct {
+	Include []*Pattern
+	Exclude []*Pattern
+}
+
+// keep reports whether the field name passes the filter.
+func (f FieldFilter) keep(name string) bool {
+	var included = len(f.Include) == 0
+	for _, p := range f.Include {
+		if p.Match(name) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, p := range f.Exclude {
+		if p.Match(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Relabel actions
+const (
+	// RenameAction moves Source to Target.
+	RenameAction = "rename"
+	// DropAction removes Source if its value matches Regex.
+	DropAction = "drop"
+	// TagAction copies the value of Source to the tag Target.
+	TagAction = "tag"
+	// ReplaceAction sets Target to Replacement, with $1 and so on expanded
+	// from Regex, if the value of Source matches Regex.
+	ReplaceAction = "replace"
+)
+
+// Relabel is a rule rewriting the fields of a block, applied in order like
+// Prometheus relabel_configs. Regex must match the whole value.
+type Relabel struct {
+	// Block is the block type the rule applies to, empty for all.
+	Block       string
+	Action      string
+	Source      string
+	Target      string
+	Regex       *regexp.Regexp
+	Replacement string
+}
+
+// CompileRegex anchors a relabel regexp so it must match the whole value,
+// an empty one matches anything.
+func CompileRegex(s string) (*regexp.Regexp, error) {
+	if s == "" {
+		s = "(.*)"
+	}
+	return regexp.Compile("^(?:" + s + ")$")
+}
+
+// fieldString returns the value of a field as a string, its raw value if it
+// has one.
+func fieldString(raw map[string]string, fields map[string]interface{}, key string) (string, bool) {
+	if v, ok := raw[key]; ok {
+		return v, true
+	}
+	switch v := fields[key].(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// apply rewrites the fields, or adds a tag, as the rule says.
+func (r *Relabel) apply(raw map[string]string, fields map[string]interface{}, tags map[string]string) {
+	value, ok := fieldString(raw, fields, r.Source)
+	if !ok {
+		return
+	}
+	target := r.Target
+	if target == "" {
+		target = r.Source
+	}
+
+	// Without a Regex any value matches
+	matches := r.Regex == nil || r.Regex.MatchString(value)
+
+	switch r.Action {
+	case RenameAction:
+		if v, ok := raw[r.Source]; ok {
+			delete(raw, r.Source)
+			raw[target] = v
+		}
+		fields[target] = fields[r.Source]
+		delete(fields, r.Source)
+	case DropAction:
+		if matches {
+			delete(raw, r.Source)
+			delete(fields, r.Source)
+		}
+	case TagAction:
+		if value != "" {
+			tags[target] = value
+		}
+	case ReplaceAction:
+		if !matches {
+			return
+		}
+		replaced := r.Replacement
+		if r.Regex != nil {
+			replaced = r.Regex.ReplaceAllString(value, r.Replacement)
+		}
+		raw[target] = replaced
+		fields[target], _ = parseDataValue(replaced)
+	}
+}
@@ -0,0 +1,191 @@
+package nagios
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// Rules control how ParseBlock turns Blocks into points.
+type Rules struct {
+	// Tags lists, per block type, the fields that are moved into point tags.
+	Tags map[string][]string
+	// Blocks is the set of block types to parse, empty means all.
+	Blocks map[string]bool
+	// Include keeps only the blocks matching one of its filters, and
+	// Exclude drops those matching any of its, before they are parsed.
+	Include []BlockFilter
+	Exclude []BlockFilter
+	// Hostgroups lists the hostgroups of each host for the hostgroup field
+	// of filters.
+	Hostgroups map[string][]string
+	// Fields selects, per block type, the fields that are kept.
+	Fields map[string]FieldFilter
+	// Relabel rewrites fields before anything else is done with them.
+	Relabel []Relabel
+	// Types sets the type of a field by name, one of int, float, bool or
+	// string, in place of the type guessed by parseDataValue.
+	Types map[string]string
+	// Schema holds the type of the other fields, which outlives the Rules
+	// so it is kept across reloads. Without one fields whose type isn't
+	// known from status.dat keep the type guessed for each value.
+	Schema *Schema
+	// Floats writes the fields known from status.dat to be integers as
+	// floats, as every number was before fields had types, so databases
+	// written then keep accepting them.
+	Floats bool
+	// Timestamps sets, per block type, the field used as the time of its
+	// points, in place of defaultTimestamps. created is the created time of
+	// the status.dat and IngestTime the time the block is parsed.
+	Timestamps map[string]string
+	// ZeroTime is what to do with blocks whose time field is 0 or missing,
+	// such as a service that was never checked. SkipZeroTime, the default,
+	// drops them rather than writing them at the Unix epoch, IngestTime and
+	// created use those times instead.
+	ZeroTime string
+}
+
+// Timestamp sources besides the fields of a block
+const (
+	IngestTime   = "ingest"
+	SkipZeroTime = "skip"
+)
+
+// defaultTimestamps is the field used as the time of each block type when
+// Rules don't say otherwise.
+var defaultTimestamps = map[string]string{
+	"info":            "created",
+	"programstatus":   "created",
+	"hoststatus":      "last_check",
+	"servicestatus":   "last_check",
+	"contactstatus":   "created",
+	"hostcomment":     "entry_time",
+	"servicecomment":  "entry_time",
+	"hostdowntime":    "entry_time",
+	"servicedowntime": "entry_time",
+}
+
+// timestamp returns the field used as the time of blocks of the given type.
+func (r *Rules) timestamp(blockName string) string {
+	if r != nil && r.Timestamps[blockName] != "" {
+		return r.Timestamps[blockName]
+	}
+	if field, ok := defaultTimestamps[blockName]; ok {
+		return field
+	}
+	return "last_check"
+}
+
+// zeroTime returns what to do with blocks whose time is 0.
+func (r *Rules) zeroTime() string {
+	if r == nil || r.ZeroTime == "" {
+		return SkipZeroTime
+	}
+	return r.ZeroTime
+}
+
+// wants reports whether blocks of the given type should be parsed.
+func (r *Rules) wants(blockName string) bool {
+	return r == nil || len(r.Blocks) == 0 || r.Blocks[blockName]
+}
+
+// apply moves tag fields into tags and converts fields with a configured
+// type. raw holds the unparsed value of each field.
+func (r *Rules) apply(blockName string, raw map[string]string, fields map[string]interface{}, tags map[string]string) error {
+	if r == nil {
+		return nil
+	}
+
+	for _, key := range r.Tags[blockName] {
+		if v, ok := raw[key]; ok && v != "" {
+			tags[key] = v
+			delete(fields, key)
+		}
+	}
+
+	for key, typ := range r.Types {
+		v, ok := raw[key]
+		if _, isField := fields[key]; !ok || !isField {
+			continue
+		}
+		value, err := convertValue(v, typ)
+		if err != nil {
+			delete(fields, key)
+			return err
+		}
+		fields[key] = value
+	}
+	return nil
+}
+
+// process turns the fields of a block into the fields and tags of its point:
+// Relabel rules first, then tags and Types, then the Fields filter and
+// finally the Schema.
+func (r *Rules) process(blockName string, raw map[string]string, fields map[string]interface{}, tags map[string]string) []error {
+	if r != nil {
+		for i := range r.Relabel {
+			if r.Relabel[i].Block == "" || r.Relabel[i].Block == blockName {
+				r.Relabel[i].apply(raw, fields, tags)
+			}
+		}
+	}
+
+	var errs []error
+	if err := r.apply(blockName, raw, fields, tags); err != nil {
+		errs = append(errs, err)
+	}
+
+	if filter, ok := r.fields(blockName); ok {
+		for key := range fields {
+			if !filter.keep(key) {
+				delete(fields, key)
+			}
+		}
+	}
+
+	return append(errs, r.typeFields(raw, fields)...)
+}
+
+// fields returns the FieldFilter for a block type.
+func (r *Rules) fields(blockName string) (FieldFilter, bool) {
+	if r == nil {
+		return FieldFilter{}, false
+	}
+	filter, ok := r.Fields[blockName]
+	return filter, ok
+}
+
+// convertValue parses s as typ, one of int, float, bool or string.
+func convertValue(s string, typ string) (interface{}, error) {
+	switch typ {
+	case "int":
+		return strconv.ParseInt(s, 10, 64)
+	case "float":
+		return strconv.ParseFloat(s, 64)
+	case "bool":
+		return strconv.ParseBool(s)
+	}
+	return s, nil
+}
+
+// RuleSet holds the Rules in use, which may be replaced while ParseBlock is
+// running. Each block is parsed with the Rules current when it is started.
+type RuleSet struct {
+	v atomic.Value
+}
+
+// NewRuleSet returns a RuleSet holding r.
+func NewRuleSet(r *Rules) *RuleSet {
+	var s RuleSet
+	s.Store(r)
+	return &s
+}
+
+// Load returns the current Rules.
+func (s *RuleSet) Load() *Rules {
+	return s.v.Load().(*Rules)
+}
+
+// Store replaces the current Rules.
+func (s *RuleSet) Store(r *Rules) {
+	s.v.Store(r)
+}
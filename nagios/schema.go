@@ -0,0 +1,331 @@
+package nagios
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// knownTypes is the type of status.dat fields whose meaning is known, by
+// name. Fields not listed may still be known by their name through
+// knownType.
+var knownTypes = map[string]string{
+	// info
+	"created":          "int",
+	"version":          "string",
+	"last_version":     "string",
+	"new_version":      "string",
+	"update_available": "int",
+
+	// programstatus
+	"nagios_pid":                   "int",
+	"daemon_mode":                  "int",
+	"program_start":                "int",
+	"global_host_event_handler":    "string",
+	"global_service_event_handler": "string",
+	"modified_host_attributes":     "int",
+	"modified_service_attributes":  "int",
+	"check_host_freshness":         "int",
+	"check_service_freshness":      "int",
+	"obsess_over_hosts":            "int",
+	"obsess_over_services":         "int",
+
+	// hoststatus and servicestatus
+	"host_name":                     "string",
+	"service_description":           "string",
+	"check_command":                 "string",
+	"check_period":                  "string",
+	"notification_period":           "string",
+	"event_handler":                 "string",
+	"plugin_output":                 "string",
+	"long_plugin_output":            "string",
+	"modified_attributes":           "int",
+	"check_interval":                "float",
+	"retry_interval":                "float",
+	"has_been_checked":              "int",
+	"should_be_scheduled":           "int",
+	"check_execution_time":          "float",
+	"check_latency":                 "float",
+	"check_type":                    "int",
+	"check_options":                 "int",
+	"current_attempt":               "int",
+	"max_attempts":                  "int",
+	"state_type":                    "int",
+	"current_notification_number":   "int",
+	"is_flapping":                   "int",
+	"percent_state_change":          "float",
+	"problem_has_been_acknowledged": "int",
+	"acknowledgement_type":          "int",
+	"scheduled_downtime_depth":      "int",
+	"process_performance_data":      "int",
+	"obsess":                        "int",
+	"obsess_over_host":              "int",
+	"obsess_over_service":           "int",
+	"check_freshness":               "int",
+	"no_more_notifications":         "int",
+	"pending_flex_downtime":         "int",
+
+	// contactstatus
+	"contact_name":                "string",
+	"host_notification_period":    "string",
+	"service_notification_period": "string",
+
+	// comments and downtime
+	"entry_type":              "int",
+	"persistent":              "int",
+	"source":                  "int",
+	"expires":                 "int",
+	"author":                  "string",
+	"comment_data":            "string",
+	"comment":                 "string",
+	"fixed":                   "int",
+	"duration":                "int",
+	"triggered_by":            "int",
+	"flex_downtime":           "int",
+	"is_in_effect":            "int",
+	"flex_downtime_start":     "int",
+	"start_notification_sent": "int",
+
+	// nagios.log and perfdata files
+	"state":                "string",
+	"attempt":              "int",
+	"output":               "string",
+	"message":              "string",
+	"notification_command": "string",
+}
+
+// knownType returns the type of a field known from status.dat, or "".
+func knownType(key string) string {
+	if typ, ok := knownTypes[key]; ok {
+		return typ
+	}
+	switch {
+	case strings.HasPrefix(key, "performance_data."):
+		return "float"
+	case strings.HasPrefix(key, "_"):
+		// Custom variables
+		return "string"
+	case strings.HasSuffix(key, "_stats"):
+		return "string"
+	case strings.HasPrefix(key, "last_"), strings.HasPrefix(key, "next_"),
+		strings.HasSuffix(key, "_time"), strings.HasSuffix(key, "_enabled"),
+		strings.HasSuffix(key, "_id"), strings.HasSuffix(key, "_state"),
+		strings.HasPrefix(key, "notified_on_"), strings.HasPrefix(key, "enable_"),
+		strings.HasSuffix(key, "_slots"):
+		return "int"
+	}
+	return ""
+}
+
+// Schema locks each field that is neither configured nor known from
+// status.dat to the type it is first seen with, so a field can't flip
+// between a number and a string and be rejected by InfluxDB. A Schema loaded
+// with LoadSchema keeps the types across restarts.
+type Schema struct {
+	mu        sync.Mutex
+	types     map[string]string
+	conflicts map[string]bool
+	// path is where Save writes the types, changed whether any were locked
+	// since.
+	path    string
+	changed bool
+	saveMu  sync.Mutex
+}
+
+// NewSchema returns an empty Schema.
+func NewSchema() *Schema {
+	return &Schema{
+		types:     make(map[string]string),
+		conflicts: make(map[string]bool),
+	}
+}
+
+// LoadSchema returns a Schema with the types saved to path, which Save
+// writes to. A missing file is not an error, an empty Schema is returned
+// instead.
+func LoadSchema(path string) (*Schema, error) {
+	s := NewSchema()
+	s.path = path
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var saved struct {
+		Types map[string]string `json:"types"`
+	}
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for k, v := range saved.Types {
+		s.types[k] = v
+	}
+	return s, nil
+}
+
+// Save atomically writes the types locked so far to the file the Schema was
+// loaded from, if any were locked since the last save.
+func (s *Schema) Save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	if !s.changed {
+		s.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(struct {
+		Types map[string]string `json:"types"`
+	}{s.types})
+	s.changed = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(s.path, append(b, '\n')); err != nil {
+		s.mu.Lock()
+		s.changed = true
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// typeOf returns the type of the field key, locking it to the type of v if
+// it isn't known yet. A nil Schema only guesses.
+func (s *Schema) typeOf(key string, v interface{}) string {
+	if typ := knownType(key); typ != "" {
+		return typ
+	}
+
+	var guess = "string"
+	if _, ok := v.(float64); ok {
+		guess = "float"
+	}
+	if s == nil {
+		return guess
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if typ, ok := s.types[key]; ok {
+		return typ
+	}
+	s.types[key] = guess
+	s.changed = true
+	return guess
+}
+
+// firstConflict reports whether this is the first conflict for key, later
+// ones are only counted.
+func (s *Schema) firstConflict(key string) bool {
+	if s == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conflicts[key] {
+		return false
+	}
+	s.conflicts[key] = true
+	return true
+}
+
+// Types returns the type of every field locked so far.
+func (s *Schema) Types() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var types = make(map[string]string, len(s.types))
+	for k, v := range s.types {
+		types[k] = v
+	}
+	return types
+}
+
+// convertField converts a field to typ from its raw value, if it has one,
+// or the value guessed by parseDataValue.
+func convertField(raw string, hasRaw bool, v interface{}, typ string) (interface{}, bool) {
+	f, isFloat := v.(float64)
+	switch typ {
+	case "string":
+		if hasRaw {
+			return raw, true
+		}
+		if isFloat {
+			return strconv.FormatFloat(f, 'f', -1, 64), true
+		}
+		return v, true
+	case "int":
+		if hasRaw {
+			if i, err := strconv.ParseInt(raw, 10, 64); err == nil {
+				return i, true
+			}
+		}
+		if isFloat && f == math.Trunc(f) {
+			return int64(f), true
+		}
+	case "float":
+		if isFloat {
+			return f, true
+		}
+	case "bool":
+		if b, err := strconv.ParseBool(raw); hasRaw && err == nil {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// typeFields converts each field not given a type by Types to the type from
+// knownType or the Schema. Fields that don't fit their type are dropped,
+// and returned as errors the first time that happens to each field.
+func (r *Rules) typeFields(raw map[string]string, fields map[string]interface{}) []error {
+	var schema *Schema
+	var configured map[string]string
+	var floats bool
+	if r != nil {
+		schema, configured, floats = r.Schema, r.Types, r.Floats
+	}
+
+	var errs []error
+	for key, v := range fields {
+		if _, ok := configured[key]; ok {
+			continue
+		}
+		typ := schema.typeOf(key, v)
+		if typ == "int" && floats {
+			typ = "float"
+		}
+		rawValue, hasRaw := raw[key]
+		value, ok := convertField(rawValue, hasRaw, v, typ)
+		if ok {
+			fields[key] = value
+			continue
+		}
+
+		delete(fields, key)
+		if !hasRaw {
+			rawValue = fmt.Sprint(v)
+		}
+		err := &errTypeConflict{Field: key, Type: typ, Value: rawValue}
+		if schema.firstConflict(key) {
+			errs = append(errs, err)
+		} else {
+			parseErrors.With(errorType(err)).Inc()
+		}
+	}
+	return errs
+}
@@ -0,0 +1,103 @@
+package nagios
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusFields are the fields of a hoststatus or servicestatus block kept
+// in a Status.
+var statusFields = map[string]bool{
+	"host_name":                     true,
+	"service_description":           true,
+	"check_command":                 true,
+	"current_state":                 true,
+	"state_type":                    true,
+	"plugin_output":                 true,
+	"last_check":                    true,
+	"problem_has_been_acknowledged": true,
+	"scheduled_downtime_depth":      true,
+}
+
+// Status is the current status of a host, or of a service when
+// ServiceDescription is set.
+type Status struct {
+	HostName           string
+	ServiceDescription string
+	State              int
+	StateType          int
+	Output             string
+	// LastCheck is zero if it was never checked.
+	LastCheck     time.Time
+	Acknowledged  bool
+	DowntimeDepth int
+
+	// raw holds the fields Include and Exclude may match.
+	raw map[string]string
+}
+
+// CurrentStatus is the status of every host and service in a status.dat.
+type CurrentStatus struct {
+	// Instance is the instance tag of the input it was read from.
+	Instance string
+	// Created is the info created time of the status.dat.
+	Created  time.Time
+	Statuses []Status
+}
+
+// add adds the status from a hoststatus or servicestatus block, ignoring
+// other blocks.
+func (c *CurrentStatus) add(name string, lines []string) {
+	if name != "hoststatus" && name != "servicestatus" {
+		return
+	}
+
+	var raw = make(map[string]string, len(statusFields))
+	for _, line := range lines {
+		kv := strings.SplitN(strings.TrimLeft(line, "\t"), "=", 2)
+		if len(kv) == 2 && (statusFields[kv[0]] || strings.HasPrefix(kv[0], "_")) {
+			raw[kv[0]] = kv[1]
+		}
+	}
+	if raw["host_name"] == "" {
+		return
+	}
+
+	atoi := func(key string) int {
+		n, _ := strconv.Atoi(raw[key])
+		return n
+	}
+	s := Status{
+		HostName:      raw["host_name"],
+		State:         atoi("current_state"),
+		StateType:     atoi("state_type"),
+		Output:        raw["plugin_output"],
+		Acknowledged:  atoi("problem_has_been_acknowledged") != 0,
+		DowntimeDepth: atoi("scheduled_downtime_depth"),
+		raw:           raw,
+	}
+	if name == "servicestatus" {
+		s.ServiceDescription = raw["service_description"]
+	}
+	if t := atoi("last_check"); t != 0 {
+		s.LastCheck = time.Unix(int64(t), 0)
+	}
+	c.Statuses = append(c.Statuses, s)
+}
+
+// Filter returns the statuses of the hosts and services rules selects, of
+// the block types it wants.
+func (c *CurrentStatus) Filter(rules *Rules) *CurrentStatus {
+	filtered := &CurrentStatus{Instance: c.Instance, Created: c.Created, Statuses: make([]Status, 0, len(c.Statuses))}
+	for _, s := range c.Statuses {
+		block := "hoststatus"
+		if s.ServiceDescription != "" {
+			block = "servicestatus"
+		}
+		if rules.wants(block) && rules.selects(mapLookup(s.raw)) {
+			filtered.Statuses = append(filtered.Statuses, s)
+		}
+	}
+	return filtered
+}
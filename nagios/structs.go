@@ -2,10 +2,19 @@ package nagios
 
 // Block is made up of the section name from status.dat, lines of the block,
 // Created time of the current status.dat file based on the info section
-// and LastCreated time which is the created time from the last read status.dat
+// and LastCreated time which is the created time from the last read status.dat.
+// Tags are added to every point parsed from the block. Line is the line
+// number of the start of the block, its Lines follow on from it.
 type Block struct {
 	Name        string
 	Lines       []string
 	Created     int64
 	LastCreated int64
+	Tags        map[string]string
+	Line        int
+}
+
+// errorAt locates err at the i'th line of the block.
+func (b *Block) errorAt(i int, err error) *ParseError {
+	return &ParseError{Line: b.Line + 1 + i, Block: b.Name, Err: err}
 }
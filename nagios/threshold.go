@@ -0,0 +1,67 @@
+package nagios
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Range is a Nagios plugin threshold range, as used for the warn and crit
+// values of perfdata: "10" alerts outside 0 to 10, "10:" below 10, "~:10"
+// above 10, "10:20" outside 10 to 20 and "@10:20" inside 10 to 20.
+type Range struct {
+	Start, End float64
+	// Inside alerts when the value is inside the range instead of outside.
+	Inside bool
+
+	text string
+}
+
+// ParseRange parses a threshold range in the Nagios plugin format.
+func ParseRange(s string) (*Range, error) {
+	r := &Range{End: math.Inf(1), text: s}
+
+	if strings.HasPrefix(s, "@") {
+		r.Inside = true
+		s = s[1:]
+	}
+
+	start, end := "0", s
+	if i := strings.Index(s, ":"); i >= 0 {
+		start, end = s[:i], s[i+1:]
+	}
+
+	var err error
+	switch start {
+	case "~":
+		r.Start = math.Inf(-1)
+	case "":
+		r.Start = 0
+	default:
+		if r.Start, err = strconv.ParseFloat(start, 64); err != nil {
+			return nil, fmt.Errorf("invalid range %q: %s", r.text, err)
+		}
+	}
+	if end != "" {
+		if r.End, err = strconv.ParseFloat(end, 64); err != nil {
+			return nil, fmt.Errorf("invalid range %q: %s", r.text, err)
+		}
+	}
+	if r.Start > r.End {
+		return nil, fmt.Errorf("invalid range %q: start is greater than end", r.text)
+	}
+	return r, nil
+}
+
+// Alert reports whether v is outside the range, or inside it when Inside is
+// set.
+func (r *Range) Alert(v float64) bool {
+	outside := v < r.Start || v > r.End
+	return outside != r.Inside
+}
+
+// String returns the range as it was given.
+func (r *Range) String() string {
+	return r.text
+}
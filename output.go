@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bensallen/sqlios/config"
+	"github.com/bensallen/sqlios/nagios"
+	"github.com/bensallen/sqlios/sink"
+	"github.com/bensallen/sqlios/spool"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+const spoolRetryInterval = 5 * time.Second
+
+// output is a running sink, optionally with a spool in front of it.
+type output struct {
+	conf      config.Sink
+	spoolConf config.Spool
+	retryConf config.Retry
+	batchSize int
+	sink      sink.Sink
+	spool     *spool.Spool
+	// direct writes to the sink, write to the spool when there is one.
+	direct nagios.WriteFunc
+	write  nagios.WriteFunc
+	wg     sync.WaitGroup
+
+	// ctx is cancelled to stop the retries and the spool drainer.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	lastErr error
+}
+
+// newSink creates the Sink described by conf.
+func newSink(conf config.Sink) (sink.Sink, error) {
+	switch conf.Type {
+	case config.InfluxSink:
+		return sink.NewInflux(sink.InfluxConfig{
+			Addr:     conf.URL,
+			Username: conf.Username,
+			Password: conf.Password,
+			Database: conf.Database,
+			Timeout:  conf.Timeout,
+		})
+	case config.Influx2Sink:
+		return sink.NewInflux2(sink.Influx2Config{
+			Addr:         conf.URL,
+			Token:        conf.Token,
+			Org:          conf.Org,
+			Bucket:       conf.Bucket,
+			CreateBucket: conf.CreateBucket,
+			Timeout:      conf.Timeout,
+		})
+	case config.SQLSink:
+		return sink.NewSQL(sink.SQLConfig{
+			Driver: conf.Driver,
+			DSN:    conf.DSN,
+			Schema: conf.Schema,
+			Table:  conf.Table,
+		})
+	case config.ExportSink:
+		return sink.NewExport(sink.ExportConfig{
+			Dir:    conf.Dir,
+			Format: conf.Format,
+			Window: conf.Window,
+		})
+	}
+	return nil, fmt.Errorf("unknown sink type: %s", conf.Type)
+}
+
+// newOutput creates the sink described by conf with retries and, unless it
+// skips duplicates itself, deduplication in front of it. When cfg has a
+// spool directory the spool is opened by openSpool and drained once the
+// output is run.
+func newOutput(ctx context.Context, cfg *config.Config, conf config.Sink, deadLetter *sink.DeadLetter) (*output, error) {
+	s, err := newSink(conf)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := s.(sink.SchemaChecker); ok {
+		if err := c.CheckSchema(); sink.IsRetryable(err) {
+			log.Printf("Warning, sink %s: checking the schema version: %s", conf.Name, err)
+		} else if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	// SQL sinks skip points already written with their own unique keys
+	var dedupe sink.Sink = s
+	if conf.Type != config.SQLSink {
+		dedupe = sink.NewDedupe(s, 0)
+	}
+
+	o := &output{conf: conf, spoolConf: cfg.Spool, retryConf: cfg.Retry, batchSize: cfg.Batch.Size, sink: s}
+	o.ctx, o.cancel = context.WithCancel(ctx)
+	retry := sink.NewRetry(o.ctx, dedupe, sink.Backoff{
+		Initial: cfg.Retry.Backoff,
+		Max:     cfg.Retry.BackoffMax,
+		Retries: cfg.Retry.Retries,
+	}, deadLetter)
+	o.direct = o.instrument(retry.Write)
+	o.write = o.direct
+	return o, nil
+}
+
+// spoolPath returns the directory of the output's spool, or "" if it has
+// none.
+func (o *output) spoolPath() string {
+	if o.spoolConf.Dir == "" {
+		return ""
+	}
+	return filepath.Join(o.spoolConf.Dir, o.conf.Name)
+}
+
+// openSpool opens the spool of the output, if it has one. With a spool,
+// Uploaders append to disk and a single drainer replays the spool to the
+// sink in order, so an outage never stalls the Reader.
+func (o *output) openSpool() error {
+	if o.spoolConf.Dir == "" {
+		return nil
+	}
+	sp, err := spool.Open(o.spoolPath(), spool.Options{
+		MaxSize: o.spoolConf.MaxSize,
+		MaxAge:  o.spoolConf.MaxAge,
+	})
+	if err != nil {
+		return err
+	}
+	o.spool = sp
+	o.write = func(points []*client.Point) error {
+		for _, point := range points {
+			if err := o.spool.Append([]byte(point.String())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// run starts draining the spool, if the output has one.
+func (o *output) run(deadLetter *sink.DeadLetter, errc chan error) {
+	if o.spool == nil {
+		return
+	}
+	spoolBytes.Set(o.conf.Name, func() float64 { return float64(o.spool.Len()) })
+
+	o.wg.Add(1)
+	go func() {
+		drainSpool(o.ctx, o.spool, o.conf.Name, o.batchSize, o.direct, deadLetter, errc)
+		o.wg.Done()
+	}()
+}
+
+// stop closes the spool, waits for it to drain and closes the sink.
+func (o *output) stop() error {
+	if o.spool != nil {
+		o.spool.Close()
+		o.wg.Wait()
+	}
+	o.cancel()
+	return o.sink.Close()
+}
+
+// halt stops draining the spool, leaving whatever is in it to the output
+// replacing this one, and closes the sink. It also closes an output that
+// was never run.
+func (o *output) halt() error {
+	o.cancel()
+	o.wg.Wait()
+	if o.spool != nil {
+		o.spool.Close()
+	}
+	return o.sink.Close()
+}
+
+// instrument wraps write to record metrics and the outcome of the last
+// write to the sink.
+func (o *output) instrument(write nagios.WriteFunc) nagios.WriteFunc {
+	name := o.conf.Name
+	return func(points []*client.Point) error {
+		start := time.Now()
+		err := write(points)
+		sinkLatency.With(name).Observe(time.Since(start).Seconds())
+
+		o.mu.Lock()
+		o.lastErr = err
+		o.mu.Unlock()
+
+		if err != nil {
+			sinkErrors.With(name).Inc()
+			return err
+		}
+		sinkPoints.With(name).Add(int64(len(points)))
+		if created := nagios.LastCreated(); !created.IsZero() {
+			ingestLag.Observe(time.Since(created).Seconds())
+		}
+		return nil
+	}
+}
+
+// err returns the error from the last write to the sink, if it failed.
+func (o *output) err() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.lastErr
+}
+
+// drainSpool replays points from sp to write in order, batchSize at a time,
+// only advancing past a batch once it has been written or permanently
+// rejected. A batch that fails with a retryable error is retried until it
+// succeeds, or left in the spool for the next run once sp is closed or ctx
+// is done. Records that can't be decoded are sent to deadLetter, or logged
+// without one, before the rest of their batch is written, so failing to
+// record them never writes the batch twice.
+func drainSpool(ctx context.Context, sp *spool.Spool, name string, batchSize int, write nagios.WriteFunc, deadLetter *sink.DeadLetter, errc chan error) {
+	// wait waits before a retry, reporting false if the drainer should stop
+	wait := func() bool {
+		if sp.Closed() {
+			return false
+		}
+		select {
+		case <-time.After(spoolRetryInterval):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		recs, pos, err := sp.ReadContext(ctx, batchSize)
+		if err == io.EOF || ctx.Err() != nil {
+			return
+		} else if err != nil {
+			errc <- err
+			return
+		}
+
+		points, decodeErr := nagios.DecodePoints(recs)
+		if e, ok := decodeErr.(*nagios.DecodeError); ok {
+			if err := dropUndecodable(name, e, deadLetter); err != nil {
+				errc <- err
+				if !wait() {
+					return
+				}
+				continue
+			}
+		}
+
+		// Permanent failures are skipped over, only a retryable failure
+		// holds up the spool. The batch is retried as read, rather than
+		// read again, so its undecodable records aren't recorded twice.
+		for len(points) > 0 {
+			err := write(points)
+			if err == nil {
+				break
+			}
+			errc <- err
+			if !sink.IsRetryable(err) {
+				break
+			}
+			if !wait() {
+				return
+			}
+		}
+
+		if err := sp.Commit(pos); err != nil {
+			errc <- err
+		}
+	}
+}
+
+// dropUndecodable records the spooled records of e before they are
+// committed past, in deadLetter if there is one or else in the log.
+func dropUndecodable(name string, e *nagios.DecodeError, deadLetter *sink.DeadLetter) error {
+	if deadLetter != nil {
+		return deadLetter.WriteRecords(name, e, e.Records)
+	}
+	for _, rec := range e.Records {
+		log.Printf("Error, spool %s: dropping undecodable record %q: %s", name, rec, e.Err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/bensallen/sqlios/config"
+	"github.com/bensallen/sqlios/nagios"
+)
+
+// runReplay writes archived status.dat snapshots to the sinks in the order
+// they were created. As when ingesting, blocks older than the previous
+// snapshot's created time are skipped so overlapping snapshots are not
+// written twice.
+func runReplay() int {
+	cfg, err := replayFlags.loadConfig()
+	if err != nil {
+		log.Fatalf("loadConfig: %s", err)
+	}
+	// The files to replay replace any configured inputs
+	cfg.Inputs = nil
+
+	snapshots, err := nagios.FindSnapshots(*replayPaths)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	log.Printf("Replaying %d snapshots", len(snapshots))
+
+	p := startPipeline(replayFlags, cfg)
+
+	var filec = make(chan io.ReadCloser)
+	var done = make(chan struct{})
+	go func() {
+		nagios.Reader(p.ctx, &nagios.Checkpoint{}, inputTags(config.Input{Name: *replayInstance}), p.blockc, filec, p.endOfFile, nil, p.errc)
+		close(done)
+	}()
+
+	go func() {
+		//Close filec so Reader will exit
+		defer close(filec)
+		for _, snapshot := range snapshots {
+			file, err := nagios.OpenFile(snapshot.Path)
+			if err != nil {
+				p.errc <- err
+				continue
+			}
+			log.Printf("Replaying %s, created %s", snapshot.Path, time.Unix(snapshot.Created, 0).UTC())
+			select {
+			case filec <- file:
+			case <-p.ctx.Done():
+				file.Close()
+				return
+			}
+		}
+	}()
+
+run:
+	for {
+		select {
+		case <-done:
+			break run
+		case sig := <-p.sigc:
+			if sig == syscall.SIGHUP {
+				log.Printf("Received %s, ignoring while replaying", sig)
+				continue
+			}
+			p.shutdown(sig)
+			break run
+		}
+	}
+
+	p.stop(func() { <-done })
+	return 0
+}
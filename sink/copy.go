@@ -0,0 +1,45 @@
+package sink
+
+import (
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// copyRows loads rows into table with COPY, much faster than an INSERT per
+// row for the tens of thousands of rows in a large status.dat.
+func copyRows(tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare(pq.CopyIn(table, columns...))
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if _, err := stmt.Exec(row...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	// Flush what is buffered
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return err
+	}
+	return stmt.Close()
+}
+
+// inTx runs f in a transaction, committing it if f succeeds. Errors are
+// classified with classifySQL.
+func inTx(db *sql.DB, f func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classifySQL(err)
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return classifySQL(err)
+	}
+	return classifySQL(tx.Commit())
+}
@@ -0,0 +1,72 @@
+package sink
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// DeadLetter records points a sink permanently rejected, one JSON object per
+// line, so they can be inspected and replayed by hand.
+type DeadLetter struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// deadLetterRecord is the JSON written for each rejected point.
+type deadLetterRecord struct {
+	Time   time.Time `json:"time"`
+	Sink   string    `json:"sink"`
+	Reason string    `json:"reason"`
+	Point  string    `json:"point"`
+}
+
+// OpenDeadLetter opens path for appending, creating it if needed.
+func OpenDeadLetter(path string) (*DeadLetter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetter{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Write records points rejected by the named sink with reason.
+func (d *DeadLetter) Write(sink string, reason error, points []*client.Point) error {
+	var recs = make([][]byte, len(points))
+	for i, p := range points {
+		recs[i] = []byte(p.String())
+	}
+	return d.WriteRecords(sink, reason, recs)
+}
+
+// WriteRecords records line protocol records for the named sink with
+// reason, such as spooled records that can no longer be decoded.
+func (d *DeadLetter) WriteRecords(sink string, reason error, recs [][]byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for _, rec := range recs {
+		err := d.enc.Encode(deadLetterRecord{
+			Time:   now,
+			Sink:   sink,
+			Reason: reason.Error(),
+			Point:  string(rec),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying file.
+func (d *DeadLetter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Close()
+}
@@ -0,0 +1,85 @@
+package sink
+
+import (
+	"sync"
+
+	"github.com/bensallen/sqlios/nagios"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// DefaultDedupeWindow is the number of keys a Dedupe remembers when given
+// none, enough for several status.dat of a large Nagios.
+const DefaultDedupeWindow = 1 << 18
+
+// Dedupe wraps a Sink that has no natural key of its own, dropping points
+// whose nagios.Key was among the last keys written, or repeats within a
+// batch. The keys are only remembered in memory, so after a restart a
+// replayed point is written again; InfluxDB overwrites it in place.
+type Dedupe struct {
+	Sink
+
+	window int
+
+	mu sync.Mutex
+	// seen holds the keys in ring, the oldest at next once it is full.
+	seen map[string]bool
+	ring []string
+	next int
+}
+
+// NewDedupe wraps s, remembering the last window keys written.
+func NewDedupe(s Sink, window int) *Dedupe {
+	if window <= 0 {
+		window = DefaultDedupeWindow
+	}
+	return &Dedupe{Sink: s, window: window, seen: make(map[string]bool)}
+}
+
+// Write writes the points not written before to the wrapped Sink,
+// remembering their keys once it succeeds.
+func (d *Dedupe) Write(points []*client.Point) error {
+	d.mu.Lock()
+	var keys = make([]string, 0, len(points))
+	var batch = make(map[string]bool, len(points))
+	var fresh = make([]*client.Point, 0, len(points))
+	for _, p := range points {
+		key := nagios.Key(p)
+		if d.seen[key] || batch[key] {
+			continue
+		}
+		batch[key] = true
+		keys = append(keys, key)
+		fresh = append(fresh, p)
+	}
+	d.mu.Unlock()
+
+	if len(fresh) == 0 {
+		return nil
+	}
+	if err := d.Sink.Write(fresh); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, key := range keys {
+		d.remember(key)
+	}
+	return nil
+}
+
+// remember adds key to seen, forgetting the oldest key if the window is
+// full.
+func (d *Dedupe) remember(key string) {
+	if d.seen[key] {
+		return
+	}
+	if len(d.ring) < d.window {
+		d.ring = append(d.ring, key)
+	} else {
+		delete(d.seen, d.ring[d.next])
+		d.ring[d.next] = key
+		d.next = (d.next + 1) % len(d.ring)
+	}
+	d.seen[key] = true
+}
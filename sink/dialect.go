@@ -0,0 +1,101 @@
+package sink
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// dialect is the SQL that differs between the databases a SQL sink writes
+// to, keyed by database/sql driver name in dialects.
+type dialect struct {
+	// migrations create the normalized schema and current_status.
+	migrations []Migration
+	// The queries keeping schema_migrations. lockMigrations and extension
+	// are empty for a database without advisory locks or extensions.
+	lockMigrations, createMigrations, migrationsExist, applied string
+	extension, recordMigration, unrecordMigration              string
+
+	// createJSON returns the statements creating the table of JSONSchema,
+	// and mergeJSON formats the statement inserting the staged rows into
+	// it.
+	createJSON func(table string) []string
+	mergeJSON  string
+	// staging creates the staging tables, if the connection hasn't yet, and
+	// empties them if committing doesn't.
+	staging []string
+	// merge merges the staged points into the normalized schema, in order.
+	merge []string
+	// upsertStatus and deleteStatus merge the staged current status of an
+	// instance into current_status.
+	upsertStatus, deleteStatus string
+	// load inserts rows into a staging table.
+	load func(tx *sql.Tx, table string, columns []string, rows [][]interface{}) error
+	// maxOpenConns limits the connections to the database, if not 0.
+	maxOpenConns int
+}
+
+var dialects = map[string]*dialect{
+	"postgres": postgresDialect,
+}
+
+func dialectOf(driver string) (*dialect, error) {
+	if d, ok := dialects[driver]; ok {
+		return d, nil
+	}
+	return nil, fmt.Errorf("unsupported SQL driver: %s", driver)
+}
+
+// migration returns the migration called name.
+func (d *dialect) migration(name string) Migration {
+	for _, m := range d.migrations {
+		if m.Name == name {
+			return m
+		}
+	}
+	panic("no migration named " + name)
+}
+
+// stage prepares the staging tables for a transaction.
+func (d *dialect) stage(tx *sql.Tx) error {
+	for _, stmt := range d.staging {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var postgresDialect = &dialect{
+	migrations:        mustLoadMigrations("migrations"),
+	lockMigrations:    lockMigrationsSQL,
+	createMigrations:  createMigrationsSQL,
+	migrationsExist:   migrationsExistSQL,
+	applied:           appliedSQL,
+	extension:         extensionSQL,
+	recordMigration:   recordMigrationSQL,
+	unrecordMigration: unrecordMigrationSQL,
+
+	createJSON: func(table string) []string {
+		return []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			time        TIMESTAMPTZ NOT NULL,
+			measurement TEXT NOT NULL,
+			tags        JSONB NOT NULL,
+			fields      JSONB NOT NULL,
+			record_key  TEXT
+		)`, pq.QuoteIdentifier(table)),
+			// Tables created by earlier versions have no record_key
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS record_key TEXT", pq.QuoteIdentifier(table)),
+			fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (record_key)", pq.QuoteIdentifier(table+"_record_key_idx"), pq.QuoteIdentifier(table)),
+		}
+	},
+	mergeJSON: `INSERT INTO %s (time, measurement, tags, fields, record_key)
+	SELECT time, measurement, tags, fields, record_key FROM sqlios_stage_json
+	ON CONFLICT (record_key) DO NOTHING`,
+	staging:      []string{createStagingSQL, createStageStatusSQL, createStageJSONSQL},
+	merge:        mergeSQL,
+	upsertStatus: upsertStatusSQL,
+	deleteStatus: deleteStatusSQL,
+	load:         copyRows,
+}
@@ -0,0 +1,629 @@
+package sink
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bensallen/sqlios/nagios"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// Formats of the files of an export sink
+const (
+	CSVFormat     = "csv"
+	ParquetFormat = "parquet"
+)
+
+// ExportConfig configures an export sink.
+type ExportConfig struct {
+	// Dir is where the files are written, partitioned into
+	// date=YYYY-MM-DD/block=<type> directories.
+	Dir string
+	// Format is CSVFormat, the default, or ParquetFormat.
+	Format string
+	// Window is how long points are buffered before being written. With no
+	// window they are written once writes stop for exportIdle, so each
+	// status.dat snapshot is a file of its own per partition. Buffered
+	// points are kept in a journal in Dir too, so those taken before a crash
+	// are written out by the next run.
+	Window time.Duration
+}
+
+// Types of the columns of an export
+const (
+	exportString = iota
+	exportTime
+	exportInt
+	exportFloat
+)
+
+type exportColumn struct {
+	name string
+	typ  int
+	// required columns are never null.
+	required bool
+}
+
+// The columns of each block type. hoststatus and servicestatus follow the
+// check_results of the normalized schema, their perfdata is split into a
+// perfdata row per label. Other blocks keep their tags and fields as JSON.
+var (
+	hostStatusColumns = []exportColumn{
+		{name: "time", typ: exportTime, required: true},
+		{name: "instance"},
+		{name: "host_name", required: true},
+		{name: "state", typ: exportInt},
+		{name: "state_type", typ: exportInt},
+		{name: "attempt", typ: exportInt},
+		{name: "output"},
+		{name: "latency", typ: exportFloat},
+		{name: "execution_time", typ: exportFloat},
+		{name: "attributes"},
+		{name: "fields"},
+		{name: "record_key", required: true},
+	}
+	serviceStatusColumns = []exportColumn{
+		{name: "time", typ: exportTime, required: true},
+		{name: "instance"},
+		{name: "host_name", required: true},
+		{name: "service_description", required: true},
+		{name: "check_command"},
+		{name: "state", typ: exportInt},
+		{name: "state_type", typ: exportInt},
+		{name: "attempt", typ: exportInt},
+		{name: "output"},
+		{name: "latency", typ: exportFloat},
+		{name: "execution_time", typ: exportFloat},
+		{name: "attributes"},
+		{name: "fields"},
+		{name: "record_key", required: true},
+	}
+	perfdataColumns = []exportColumn{
+		{name: "time", typ: exportTime, required: true},
+		{name: "instance"},
+		{name: "host_name", required: true},
+		{name: "service_description"},
+		{name: "label", required: true},
+		{name: "value", typ: exportFloat, required: true},
+		{name: "warn", typ: exportFloat},
+		{name: "crit", typ: exportFloat},
+		{name: "min", typ: exportFloat},
+		{name: "max", typ: exportFloat},
+		{name: "record_key", required: true},
+	}
+	otherColumns = []exportColumn{
+		{name: "time", typ: exportTime, required: true},
+		{name: "measurement", required: true},
+		{name: "instance"},
+		{name: "host_name"},
+		{name: "service_description"},
+		{name: "tags", required: true},
+		{name: "fields", required: true},
+		{name: "record_key", required: true},
+	}
+)
+
+// exportColumnsOf returns the columns of block.
+func exportColumnsOf(block string) []exportColumn {
+	switch block {
+	case "hoststatus":
+		return hostStatusColumns
+	case "servicestatus":
+		return serviceStatusColumns
+	case "perfdata":
+		return perfdataColumns
+	}
+	return otherColumns
+}
+
+// exportPartition is a directory of an export.
+type exportPartition struct {
+	date  string
+	block string
+}
+
+// journalFile holds the rows buffered, a JSON journalEntry per line.
+const journalFile = ".window.jsonl"
+
+// exportIdle is how long an Export without a window waits for more writes
+// before writing out its buffer. The batches of a status.dat snapshot come
+// within a batch interval of each other. exportTick is how often the buffer
+// is checked.
+var (
+	exportIdle = 5 * time.Second
+	exportTick = time.Second
+)
+
+// journalEntry is a buffered row, its values formatted as in a CSV export
+// with null for nil.
+type journalEntry struct {
+	Date  string    `json:"date"`
+	Block string    `json:"block"`
+	Row   []*string `json:"row"`
+}
+
+// Export writes points to CSV or Parquet files for analysis with tools such
+// as pandas and DuckDB, partitioned by the date of the points and their
+// block type in directories such as
+//
+//	date=2014-11-21/block=servicestatus/part-1416605951000000000.parquet
+//
+// Each block type has a fixed set of typed columns, so the files of a block
+// can be read as one table.
+type Export struct {
+	conf ExportConfig
+
+	mu   sync.Mutex
+	rows map[exportPartition][][]interface{}
+	// started is when the first row of the buffer was written, last when
+	// the last one was.
+	started time.Time
+	last    time.Time
+	journal *os.File
+	// err is the error of the last attempt to write out the buffer.
+	err error
+
+	// idle and tick are exportIdle and exportTick when it was created.
+	idle    time.Duration
+	tick    time.Duration
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewExport returns an Export sink, creating its directory. Rows left in the
+// journal by a run that didn't write them out are written first.
+func NewExport(conf ExportConfig) (*Export, error) {
+	switch conf.Format {
+	case "":
+		conf.Format = CSVFormat
+	case CSVFormat, ParquetFormat:
+	default:
+		return nil, fmt.Errorf("unknown export format: %s", conf.Format)
+	}
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	e := &Export{
+		conf:    conf,
+		idle:    exportIdle,
+		tick:    exportTick,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	path := filepath.Join(conf.Dir, journalFile)
+	var err error
+	if e.rows, err = readJournal(path); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", path, err)
+	}
+	if len(e.rows) > 0 {
+		if err := e.flush(); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if e.journal, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+	go e.run()
+	return e, nil
+}
+
+// Name returns the sink's name
+func (e *Export) Name() string {
+	return "export:" + e.conf.Dir
+}
+
+// Write adds the rows of points to the buffer, journaling them before it
+// returns so they are as safe as if written out. The buffer is written out
+// once the window has passed since it was started, or without a window once
+// no write has come for exportIdle. While writing it out fails Write tries
+// again, and holds points back rather than buffer more.
+func (e *Export) Write(points []*client.Point) error {
+	rows, err := exportRows(points)
+	if err != nil {
+		return Rejected(err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.err != nil {
+		if e.err = e.flush(); e.err != nil {
+			return Retryable(e.err)
+		}
+	}
+
+	fi, err := e.journal.Stat()
+	if err != nil {
+		return Retryable(err)
+	}
+	if err := writeJournal(e.journal, rows); err != nil {
+		e.journal.Truncate(fi.Size())
+		return Retryable(err)
+	}
+	for partition, r := range rows {
+		e.rows[partition] = append(e.rows[partition], r...)
+	}
+	e.last = time.Now()
+	if e.started.IsZero() {
+		e.started = e.last
+	}
+	return nil
+}
+
+// run writes out the buffer whenever it is due, until Close.
+func (e *Export) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(e.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.done:
+			return
+		}
+
+		e.mu.Lock()
+		if e.due() {
+			if e.err = e.flush(); e.err != nil {
+				log.Printf("Error, %s: writing out the buffered rows, retrying: %s", e.Name(), e.err)
+			}
+		}
+		e.mu.Unlock()
+	}
+}
+
+// due reports whether the buffer should be written out. The caller must
+// hold e.mu.
+func (e *Export) due() bool {
+	if len(e.rows) == 0 {
+		return false
+	}
+	if e.conf.Window > 0 {
+		return time.Since(e.started) >= e.conf.Window
+	}
+	return time.Since(e.last) >= e.idle
+}
+
+// Close writes out any rows still buffered.
+func (e *Export) Close() error {
+	close(e.done)
+	<-e.stopped
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.flush(); err != nil {
+		return err
+	}
+	if err := e.journal.Close(); err != nil {
+		return err
+	}
+	return os.Remove(e.journal.Name())
+}
+
+// flush writes a file per partition of the buffer and empties it and the
+// journal. The files are written under hidden names and only renamed once
+// all of them are complete, so readers never see part of one and a failed
+// flush leaves nothing behind to be exported again when it is retried.
+func (e *Export) flush() error {
+	name := fmt.Sprintf("part-%d.%s", time.Now().UnixNano(), e.conf.Format)
+
+	var staged []string
+	removeStaged := func() {
+		for _, dir := range staged {
+			os.Remove(filepath.Join(dir, "."+name+".tmp"))
+		}
+	}
+	for partition, rows := range e.rows {
+		dir := filepath.Join(e.conf.Dir, "date="+partition.date, "block="+partition.block)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			removeStaged()
+			return err
+		}
+		staged = append(staged, dir)
+		if err := e.writeFile(filepath.Join(dir, "."+name+".tmp"), exportColumnsOf(partition.block), rows); err != nil {
+			removeStaged()
+			return err
+		}
+	}
+	for i, dir := range staged {
+		if err := os.Rename(filepath.Join(dir, "."+name+".tmp"), filepath.Join(dir, name)); err != nil {
+			for _, dir := range staged[:i] {
+				os.Remove(filepath.Join(dir, name))
+			}
+			removeStaged()
+			return err
+		}
+	}
+
+	e.rows = make(map[exportPartition][][]interface{})
+	e.started = time.Time{}
+	if e.journal != nil {
+		// Still nil while NewExport writes out the journal of the last run
+		if err := e.journal.Truncate(0); err != nil {
+			log.Printf("Warning, %s: emptying the journal, its rows will be exported again after a restart: %s", e.Name(), err)
+		}
+	}
+	return nil
+}
+
+// writeJournal appends rows to the journal f and syncs it.
+func writeJournal(f *os.File, rows map[exportPartition][][]interface{}) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for partition, rows := range rows {
+		for _, row := range rows {
+			entry := journalEntry{Date: partition.date, Block: partition.block, Row: make([]*string, len(row))}
+			for i, v := range row {
+				if s, ok := formatExportValue(v); ok {
+					entry.Row[i] = &s
+				}
+			}
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// readJournal returns the rows in the journal at path, if there is one. A
+// torn last line, from a crash while it was written, is ignored.
+func readJournal(path string) (map[exportPartition][][]interface{}, error) {
+	var rows = make(map[exportPartition][][]interface{})
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rows, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	lines := bytes.Split(b, []byte("\n"))
+	for n, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			if n == len(lines)-1 {
+				break
+			}
+			return nil, fmt.Errorf("line %d: %s", n+1, err)
+		}
+		columns := exportColumnsOf(entry.Block)
+		if len(entry.Row) != len(columns) {
+			return nil, fmt.Errorf("line %d: %d values for %d columns", n+1, len(entry.Row), len(columns))
+		}
+		var row = make([]interface{}, len(columns))
+		for i, c := range columns {
+			if entry.Row[i] == nil {
+				continue
+			}
+			if row[i], err = parseExportValue(c, *entry.Row[i]); err != nil {
+				return nil, fmt.Errorf("line %d: column %s: %s", n+1, c.name, err)
+			}
+		}
+		partition := exportPartition{date: entry.Date, block: entry.Block}
+		rows[partition] = append(rows[partition], row)
+	}
+	return rows, nil
+}
+
+func (e *Export) writeFile(path string, columns []exportColumn, rows [][]interface{}) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if e.conf.Format == ParquetFormat {
+		err = writeParquet(f, columns, rows)
+	} else {
+		err = writeCSV(f, columns, rows)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeCSV writes rows to w with a header of the column names. Times are
+// RFC 3339 in UTC and nulls are empty.
+func writeCSV(w io.Writer, columns []exportColumn, rows [][]interface{}) error {
+	cw := csv.NewWriter(w)
+	var record = make([]string, len(columns))
+	for i, c := range columns {
+		record[i] = c.name
+	}
+	if err := cw.Write(record); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		for i, v := range row {
+			record[i], _ = formatExportValue(v)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatExportValue formats a value of a row as text, or returns false if
+// it is null.
+func formatExportValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case string:
+		return v, true
+	}
+	return "", false
+}
+
+// parseExportValue parses a value of column c formatted by
+// formatExportValue.
+func parseExportValue(c exportColumn, s string) (interface{}, error) {
+	switch c.typ {
+	case exportTime:
+		return time.Parse(time.RFC3339Nano, s)
+	case exportInt:
+		return strconv.ParseInt(s, 10, 64)
+	case exportFloat:
+		return strconv.ParseFloat(s, 64)
+	}
+	return s, nil
+}
+
+// exportRows splits points into rows of the columns of their block type, by
+// partition.
+func exportRows(points []*client.Point) (map[exportPartition][][]interface{}, error) {
+	var rows = make(map[exportPartition][][]interface{})
+	for _, p := range points {
+		r, err := normalize(p)
+		if err != nil {
+			return nil, err
+		}
+		date := p.Time().UTC().Format("2006-01-02")
+		key := nagios.Key(p)
+		instance := nullString(p.Tags()["instance"])
+
+		block := exportBlock(p, r)
+		switch {
+		case r == nil:
+			fields, err := p.Fields()
+			if err != nil {
+				return nil, err
+			}
+			delete(fields, nagios.KeyField)
+			tags := p.Tags()
+			lookup := func(key string) interface{} {
+				if v, ok := tags[key]; ok {
+					return nullString(v)
+				}
+				v, _ := fields[key].(string)
+				return nullString(v)
+			}
+			tagsJSON, err := json.Marshal(tags)
+			if err != nil {
+				return nil, err
+			}
+			fieldsJSON, err := json.Marshal(fields)
+			if err != nil {
+				return nil, err
+			}
+			partition := exportPartition{date: date, block: block}
+			rows[partition] = append(rows[partition], []interface{}{
+				p.Time(), p.Name(), instance, lookup("host_name"), lookup("service_description"),
+				string(tagsJSON), string(fieldsJSON), key,
+			})
+			continue
+		case r.result == nil:
+			// Only perfdata, as from a perfdata file
+		case r.service == nil:
+			c := r.result
+			partition := exportPartition{date: date, block: block}
+			rows[partition] = append(rows[partition], []interface{}{
+				r.time, instance, r.host.name,
+				exportValue(c.state), exportValue(c.stateType), exportValue(c.attempt), exportValue(c.output),
+				exportValue(c.latency), exportValue(c.executionTime), nullString(r.host.attributes), c.fields, key,
+			})
+		default:
+			c := r.result
+			partition := exportPartition{date: date, block: block}
+			rows[partition] = append(rows[partition], []interface{}{
+				r.time, instance, r.host.name, r.service.description, nullString(r.service.checkCommand),
+				exportValue(c.state), exportValue(c.stateType), exportValue(c.attempt), exportValue(c.output),
+				exportValue(c.latency), exportValue(c.executionTime), nullString(r.service.attributes), c.fields, key,
+			})
+		}
+
+		var description interface{}
+		if r.service != nil {
+			description = r.service.description
+		}
+		partition := exportPartition{date: date, block: "perfdata"}
+		for _, v := range r.perf {
+			rows[partition] = append(rows[partition], []interface{}{
+				r.time, instance, r.host.name, description, v.label, v.value,
+				exportValue(v.limits[0]), exportValue(v.limits[1]), exportValue(v.limits[2]), exportValue(v.limits[3]), key,
+			})
+		}
+	}
+	return rows, nil
+}
+
+// exportBlock returns the block type of a point, r being it normalized.
+// Points are named after their host and service rather than their block,
+// so hoststatus and servicestatus are told apart by their check result or
+// perfdata, and other blocks by the suffix of their name, such as
+// host1.hostcomment.
+func exportBlock(p *client.Point, r *row) string {
+	if r != nil {
+		if r.service != nil {
+			return "servicestatus"
+		}
+		return "hoststatus"
+	}
+	block := p.Name()
+	if i := strings.LastIndex(block, "."); i >= 0 {
+		block = block[i+1:]
+	}
+	if block == "" || strings.ContainsAny(block, `/\`) {
+		return "other"
+	}
+	return block
+}
+
+// exportValue returns the value of a sql.Null type, or nil.
+func exportValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case sql.NullInt64:
+		if v.Valid {
+			return v.Int64
+		}
+	case sql.NullFloat64:
+		if v.Valid {
+			return v.Float64
+		}
+	case sql.NullString:
+		if v.Valid {
+			return v.String
+		}
+	}
+	return nil
+}
+
+// nullString returns s, or nil if it is empty.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
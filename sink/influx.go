@@ -0,0 +1,127 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/bensallen/sqlios/nagios"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// InfluxConfig configures an InfluxDB 1.x sink.
+type InfluxConfig struct {
+	Addr     string
+	Username string
+	Password string
+	Database string
+	Timeout  time.Duration
+}
+
+// Influx writes points to the InfluxDB 1.x /write endpoint. It talks HTTP
+// directly rather than through client.Client so that the response status
+// can be used to classify failures.
+type Influx struct {
+	conf   InfluxConfig
+	url    *url.URL
+	client *http.Client
+}
+
+// NewInflux returns a Sink that writes to InfluxDB 1.x.
+func NewInflux(conf InfluxConfig) (*Influx, error) {
+	u, err := url.Parse(conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported protocol scheme: %s, your address must start with http:// or https://", u.Scheme)
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = 30 * time.Second
+	}
+	return &Influx{
+		conf:   conf,
+		url:    u,
+		client: &http.Client{Timeout: conf.Timeout},
+	}, nil
+}
+
+// Name returns the sink's name
+func (s *Influx) Name() string {
+	return "influxdb:" + s.conf.Database
+}
+
+// Write sends points in a single request at second precision.
+func (s *Influx) Write(points []*client.Point) error {
+	var b bytes.Buffer
+	for _, p := range points {
+		b.WriteString(lineProtocol(p))
+		b.WriteByte('\n')
+	}
+
+	u := *s.url
+	u.Path = path.Join(u.Path, "write")
+	params := url.Values{}
+	params.Set("db", s.conf.Database)
+	params.Set("precision", "s")
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), &b)
+	if err != nil {
+		return Permanent(err)
+	}
+	if s.conf.Username != "" {
+		req.SetBasicAuth(s.conf.Username, s.conf.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return Retryable(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	return classifyStatus(resp.StatusCode, body)
+}
+
+// classifyStatus turns a non-2xx HTTP response into a retryable or permanent
+// Error. A 400 or 422, InfluxDB refusing some of the points as with a parse
+// error or a field type conflict, or a 413 for too many points, are caused
+// by the points written rather than the request.
+func classifyStatus(code int, body []byte) error {
+	if code >= 200 && code < 300 {
+		return nil
+	}
+	err := fmt.Errorf("%d %s: %s", code, http.StatusText(code), bytes.TrimSpace(body))
+	switch {
+	case code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout:
+		return Retryable(err)
+	case code == http.StatusBadRequest || code == http.StatusUnprocessableEntity || code == http.StatusRequestEntityTooLarge:
+		return Rejected(err)
+	}
+	return Permanent(err)
+}
+
+// Close is a no-op, Influx holds no resources between writes
+func (s *Influx) Close() error {
+	return nil
+}
+
+// lineProtocol returns p in line protocol at second precision, without its
+// nagios.KeyField, which InfluxDB has no use for.
+func lineProtocol(p *client.Point) string {
+	fields, err := p.Fields()
+	if _, ok := fields[nagios.KeyField]; err != nil || !ok {
+		return p.PrecisionString("s")
+	}
+	delete(fields, nagios.KeyField)
+	np, err := client.NewPoint(p.Name(), p.Tags(), fields, p.Time())
+	if err != nil {
+		return p.PrecisionString("s")
+	}
+	return np.PrecisionString("s")
+}
@@ -0,0 +1,208 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// Influx2Config configures an InfluxDB 2.x sink, or 3.x through its v2
+// compatible write API.
+type Influx2Config struct {
+	Addr   string
+	Token  string
+	Org    string
+	Bucket string
+	// CreateBucket creates Bucket in Org, with infinite retention, if it
+	// doesn't exist.
+	CreateBucket bool
+	Timeout      time.Duration
+}
+
+// Influx2 writes points to the InfluxDB 2.x /api/v2/write endpoint,
+// authenticating with a token and gzipping request bodies. Like Influx it
+// talks HTTP directly so the response status can be used to classify
+// failures.
+type Influx2 struct {
+	conf   Influx2Config
+	url    *url.URL
+	client *http.Client
+
+	mu      sync.Mutex
+	created bool
+}
+
+// NewInflux2 returns a Sink that writes to InfluxDB 2.x. InfluxDB isn't
+// contacted until the first write, which creates the bucket if
+// conf.CreateBucket is set.
+func NewInflux2(conf Influx2Config) (*Influx2, error) {
+	u, err := url.Parse(conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported protocol scheme: %s, your address must start with http:// or https://", u.Scheme)
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = 30 * time.Second
+	}
+	return &Influx2{
+		conf:    conf,
+		url:     u,
+		client:  &http.Client{Timeout: conf.Timeout},
+		created: !conf.CreateBucket,
+	}, nil
+}
+
+// Name returns the sink's name
+func (s *Influx2) Name() string {
+	return "influxdb2:" + s.conf.Bucket
+}
+
+// Write sends points in a single gzipped request at second precision.
+func (s *Influx2) Write(points []*client.Point) error {
+	if err := s.createBucket(); err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	for _, p := range points {
+		io.WriteString(gz, lineProtocol(p))
+		gz.Write([]byte{'\n'})
+	}
+	if err := gz.Close(); err != nil {
+		return Permanent(err)
+	}
+
+	params := url.Values{}
+	params.Set("org", s.conf.Org)
+	params.Set("bucket", s.conf.Bucket)
+	params.Set("precision", "s")
+	req, err := s.request("POST", "write", params, &b)
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	_, _, err = s.do(req)
+	return err
+}
+
+// createBucket creates the bucket on the first call that succeeds, unless
+// it already exists.
+func (s *Influx2) createBucket() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.created {
+		return nil
+	}
+
+	var buckets struct {
+		Buckets []struct{} `json:"buckets"`
+	}
+	if err := s.get("buckets", url.Values{"org": {s.conf.Org}, "name": {s.conf.Bucket}}, &buckets); err != nil {
+		return err
+	}
+	if len(buckets.Buckets) > 0 {
+		s.created = true
+		return nil
+	}
+
+	// Buckets are created in an org by its ID rather than its name
+	var orgs struct {
+		Orgs []struct {
+			ID string `json:"id"`
+		} `json:"orgs"`
+	}
+	if err := s.get("orgs", url.Values{"org": {s.conf.Org}}, &orgs); err != nil {
+		return err
+	}
+	if len(orgs.Orgs) == 0 {
+		return Permanent(fmt.Errorf("creating bucket %s: org %s not found", s.conf.Bucket, s.conf.Org))
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"orgID":          orgs.Orgs[0].ID,
+		"name":           s.conf.Bucket,
+		"retentionRules": []struct{}{},
+	})
+	if err != nil {
+		return Permanent(err)
+	}
+	req, err := s.request("POST", "buckets", nil, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if _, _, err := s.do(req); err != nil {
+		return err
+	}
+	s.created = true
+	return nil
+}
+
+// get decodes the JSON response to a GET of endpoint into v. A 404, how
+// InfluxDB answers a lookup by name that matches nothing, leaves v empty.
+func (s *Influx2) get(endpoint string, params url.Values, v interface{}) error {
+	req, err := s.request("GET", endpoint, params, nil)
+	if err != nil {
+		return Permanent(err)
+	}
+	body, status, err := s.do(req)
+	if status == http.StatusNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return Permanent(fmt.Errorf("%s: %s", endpoint, err))
+	}
+	return nil
+}
+
+// request returns a request to endpoint of the v2 API, authenticated with
+// the token.
+func (s *Influx2) request(method, endpoint string, params url.Values, body io.Reader) (*http.Request, error) {
+	u := *s.url
+	u.Path = path.Join(u.Path, "api/v2", endpoint)
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if s.conf.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.conf.Token)
+	}
+	return req, nil
+}
+
+// do sends req, returning the response body and status, and an error
+// classified by the status.
+func (s *Influx2) do(req *http.Request) ([]byte, int, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, Retryable(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	return body, resp.StatusCode, classifyStatus(resp.StatusCode, body)
+}
+
+// Close is a no-op, Influx2 holds no resources between writes
+func (s *Influx2) Close() error {
+	return nil
+}
@@ -0,0 +1,325 @@
+package sink
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the migrations creating the normalized schema, named
+// VERSION_NAME.up.sql and VERSION_NAME.down.sql, for PostgreSQL in
+// migrations and for SQLite in migrations/sqlite. An up migration starting
+// with a "-- requires extension: NAME" line is only applied to databases
+// with that extension installed.
+//
+//go:embed migrations/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+const requiresPrefix = "-- requires extension: "
+
+// Migration is one version of the normalized schema, with the SQL applying
+// it and the SQL reverting it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// Requires is the extension the migration needs, if any.
+	Requires string
+}
+
+// Migrations returns the migrations creating the normalized schema in the
+// databases of driver, oldest first.
+func Migrations(driver string) ([]Migration, error) {
+	d, err := dialectOf(driver)
+	if err != nil {
+		return nil, err
+	}
+	return append([]Migration(nil), d.migrations...), nil
+}
+
+func mustLoadMigrations(dir string) []Migration {
+	m, err := loadMigrations(dir)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func loadMigrations(dir string) ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var byVersion = make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		var base string
+		var up bool
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			base, up = strings.TrimSuffix(name, ".up.sql"), true
+		case strings.HasSuffix(name, ".down.sql"):
+			base = strings.TrimSuffix(name, ".down.sql")
+		default:
+			return nil, fmt.Errorf("migration %s: not .up.sql or .down.sql", name)
+		}
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("migration %s: not named VERSION_NAME", name)
+		}
+		b, err := migrationFiles.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		}
+		if up {
+			m.Up = string(b)
+			if strings.HasPrefix(m.Up, requiresPrefix) {
+				line := strings.SplitN(m.Up[len(requiresPrefix):], "\n", 2)[0]
+				m.Requires = strings.TrimSpace(line)
+			}
+		} else {
+			m.Down = string(b)
+		}
+	}
+
+	var list = make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d: missing up or down", m.Version)
+		}
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+const (
+	// The queries keeping schema_migrations in PostgreSQL, see
+	// sqliteDialect for SQLite's.
+	createMigrationsSQL = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	name       TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+	// lockMigrationsSQL serializes migrations between every SQLios sharing
+	// a database.
+	lockMigrationsSQL    = `SELECT pg_advisory_xact_lock(hashtext('sqlios schema_migrations'))`
+	migrationsExistSQL   = `SELECT to_regclass('schema_migrations') IS NOT NULL`
+	appliedSQL           = `SELECT version, name, applied_at FROM schema_migrations ORDER BY version`
+	extensionSQL         = `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = $1)`
+	recordMigrationSQL   = `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`
+	unrecordMigrationSQL = `DELETE FROM schema_migrations WHERE version = $1`
+)
+
+// MigrationState is a migration known to this SQLios or applied to a
+// database.
+type MigrationState struct {
+	Migration
+	// Applied is when the migration was applied, zero if it isn't.
+	Applied time.Time
+	// Unknown is set for a migration applied by a newer SQLios.
+	Unknown bool
+	// Skipped is set for a pending migration whose extension isn't
+	// installed.
+	Skipped bool
+}
+
+// UnknownSchemaError is returned for a database with migrations applied by
+// a newer SQLios.
+type UnknownSchemaError struct {
+	Versions []int
+}
+
+func (e *UnknownSchemaError) Error() string {
+	return fmt.Sprintf("schema has migrations %v applied that this SQLios doesn't know, it was migrated by a newer version", e.Versions)
+}
+
+// MigrationStatus returns the state of every migration known to this SQLios
+// or applied to db, a database of driver, in version order.
+func MigrationStatus(db *sql.DB, driver string) ([]MigrationState, error) {
+	d, err := dialectOf(driver)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return migrationStatus(tx, d)
+}
+
+func migrationStatus(tx *sql.Tx, d *dialect) ([]MigrationState, error) {
+	var byVersion = make(map[int]*MigrationState, len(d.migrations))
+	var states = make([]*MigrationState, 0, len(d.migrations))
+	for _, m := range d.migrations {
+		state := &MigrationState{Migration: m}
+		byVersion[m.Version] = state
+		states = append(states, state)
+	}
+
+	var exists bool
+	if err := tx.QueryRow(d.migrationsExist).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		rows, err := tx.Query(d.applied)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var version int
+			var name string
+			var applied time.Time
+			if err := rows.Scan(&version, &name, &applied); err != nil {
+				return nil, err
+			}
+			state, ok := byVersion[version]
+			if !ok {
+				state = &MigrationState{Migration: Migration{Version: version, Name: name}, Unknown: true}
+				states = append(states, state)
+			}
+			state.Applied = applied
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		rows.Close()
+	}
+
+	var extensions = make(map[string]bool)
+	var list = make([]MigrationState, 0, len(states))
+	for _, state := range states {
+		if ext := state.Requires; ext != "" && state.Applied.IsZero() {
+			installed, ok := extensions[ext]
+			if !ok && d.extension != "" {
+				if err := tx.QueryRow(d.extension, ext).Scan(&installed); err != nil {
+					return nil, err
+				}
+				extensions[ext] = installed
+			}
+			state.Skipped = !installed
+		}
+		list = append(list, *state)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+// checkKnown returns an UnknownSchemaError if any of states is unknown.
+func checkKnown(states []MigrationState) error {
+	var unknown []int
+	for _, state := range states {
+		if state.Unknown {
+			unknown = append(unknown, state.Version)
+		}
+	}
+	if unknown != nil {
+		return &UnknownSchemaError{unknown}
+	}
+	return nil
+}
+
+// MigrateUp applies the pending migrations to db, a database of driver, up
+// to and including version to, or all of them if to is 0, in a single
+// transaction. Migrations needing an extension that isn't installed are
+// skipped, to be applied by a later run once it is. It refuses to migrate a
+// database with unknown migrations applied. The migrations applied are
+// returned.
+func MigrateUp(db *sql.DB, driver string, to int) ([]Migration, error) {
+	return migrate(db, driver, func(tx *sql.Tx, d *dialect, states []MigrationState) ([]Migration, error) {
+		if err := checkKnown(states); err != nil {
+			return nil, err
+		}
+		var applied []Migration
+		for _, state := range states {
+			if !state.Applied.IsZero() || state.Skipped || (to != 0 && state.Version > to) {
+				continue
+			}
+			if _, err := tx.Exec(state.Up); err != nil {
+				return nil, fmt.Errorf("migration %d %s: %s", state.Version, state.Name, err)
+			}
+			if _, err := tx.Exec(d.recordMigration, state.Version, state.Name); err != nil {
+				return nil, err
+			}
+			applied = append(applied, state.Migration)
+		}
+		return applied, nil
+	})
+}
+
+// MigrateDown reverts the migrations applied to db, a database of driver,
+// newer than version to, newest first, in a single transaction. The
+// migrations reverted are returned.
+func MigrateDown(db *sql.DB, driver string, to int) ([]Migration, error) {
+	return migrate(db, driver, func(tx *sql.Tx, d *dialect, states []MigrationState) ([]Migration, error) {
+		var reverted []Migration
+		for i := len(states) - 1; i >= 0; i-- {
+			state := states[i]
+			if state.Applied.IsZero() || state.Version <= to {
+				continue
+			}
+			if state.Unknown {
+				return nil, fmt.Errorf("migration %d %s is unknown to this SQLios and can't be reverted", state.Version, state.Name)
+			}
+			if _, err := tx.Exec(state.Down); err != nil {
+				return nil, fmt.Errorf("migration %d %s: %s", state.Version, state.Name, err)
+			}
+			if _, err := tx.Exec(d.unrecordMigration, state.Version); err != nil {
+				return nil, err
+			}
+			reverted = append(reverted, state.Migration)
+		}
+		return reverted, nil
+	})
+}
+
+// migrate runs f with the state of the migrations in a transaction holding
+// the migrations lock, committing it if f succeeds.
+func migrate(db *sql.DB, driver string, f func(tx *sql.Tx, d *dialect, states []MigrationState) ([]Migration, error)) ([]Migration, error) {
+	d, err := dialectOf(driver)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range []string{d.lockMigrations, d.createMigrations} {
+		if stmt == "" {
+			continue
+		}
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	states, err := migrationStatus(tx, d)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	done, err := f(tx, d, states)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return done, tx.Commit()
+}
@@ -0,0 +1,59 @@
+-- Hosts, services and perfdata labels are dimensions with surrogate keys,
+-- inserted the first time they are seen and updated in place when their
+-- attributes change. check_results and perf_values are facts referencing
+-- them.
+
+CREATE TABLE IF NOT EXISTS hosts (
+	host_id    BIGSERIAL PRIMARY KEY,
+	instance   TEXT NOT NULL DEFAULT '',
+	host_name  TEXT NOT NULL,
+	attributes JSONB NOT NULL DEFAULT '{}',
+	first_seen TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	UNIQUE (instance, host_name)
+);
+
+CREATE TABLE IF NOT EXISTS services (
+	service_id          BIGSERIAL PRIMARY KEY,
+	host_id             BIGINT NOT NULL REFERENCES hosts (host_id),
+	service_description TEXT NOT NULL,
+	check_command       TEXT NOT NULL DEFAULT '',
+	attributes          JSONB NOT NULL DEFAULT '{}',
+	first_seen          TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at          TIMESTAMPTZ NOT NULL DEFAULT now(),
+	UNIQUE (host_id, service_description)
+);
+
+CREATE TABLE IF NOT EXISTS perf_labels (
+	label_id BIGSERIAL PRIMARY KEY,
+	label    TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS check_results (
+	time           TIMESTAMPTZ NOT NULL,
+	host_id        BIGINT NOT NULL REFERENCES hosts (host_id),
+	service_id     BIGINT REFERENCES services (service_id),
+	state          SMALLINT,
+	state_type     SMALLINT,
+	attempt        INTEGER,
+	output         TEXT,
+	latency        DOUBLE PRECISION,
+	execution_time DOUBLE PRECISION,
+	fields         JSONB NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS check_results_host_time ON check_results (host_id, time DESC);
+CREATE INDEX IF NOT EXISTS check_results_service_time ON check_results (service_id, time DESC);
+
+CREATE TABLE IF NOT EXISTS perf_values (
+	time       TIMESTAMPTZ NOT NULL,
+	host_id    BIGINT NOT NULL REFERENCES hosts (host_id),
+	service_id BIGINT REFERENCES services (service_id),
+	label_id   BIGINT NOT NULL REFERENCES perf_labels (label_id),
+	value      DOUBLE PRECISION NOT NULL,
+	warn       DOUBLE PRECISION,
+	crit       DOUBLE PRECISION,
+	min        DOUBLE PRECISION,
+	max        DOUBLE PRECISION
+);
+CREATE INDEX IF NOT EXISTS perf_values_label_time ON perf_values (label_id, time DESC);
+CREATE INDEX IF NOT EXISTS perf_values_service_time ON perf_values (service_id, time DESC);
@@ -0,0 +1,12 @@
+-- check_results and perf_values stay hypertables, which can't be turned
+-- back into plain tables, but are no longer compressed.
+
+DROP MATERIALIZED VIEW IF EXISTS perf_values_hourly;
+
+SELECT remove_compression_policy('perf_values', if_exists => TRUE);
+SELECT decompress_chunk(c, if_compressed => TRUE) FROM show_chunks('perf_values') c;
+ALTER TABLE perf_values SET (timescaledb.compress = false);
+
+SELECT remove_compression_policy('check_results', if_exists => TRUE);
+SELECT decompress_chunk(c, if_compressed => TRUE) FROM show_chunks('check_results') c;
+ALTER TABLE check_results SET (timescaledb.compress = false);
@@ -0,0 +1,34 @@
+-- requires extension: timescaledb
+-- Makes the fact tables hypertables, compresses chunks older than a week
+-- and keeps hourly aggregates of perfdata values. Only applied to databases
+-- with TimescaleDB installed.
+
+SELECT create_hypertable('check_results', 'time', if_not_exists => TRUE, migrate_data => TRUE);
+SELECT create_hypertable('perf_values', 'time', if_not_exists => TRUE, migrate_data => TRUE);
+
+ALTER TABLE check_results SET (
+	timescaledb.compress,
+	timescaledb.compress_segmentby = 'host_id, service_id',
+	timescaledb.compress_orderby = 'time DESC'
+);
+SELECT add_compression_policy('check_results', INTERVAL '7 days', if_not_exists => TRUE);
+
+ALTER TABLE perf_values SET (
+	timescaledb.compress,
+	timescaledb.compress_segmentby = 'host_id, service_id, label_id',
+	timescaledb.compress_orderby = 'time DESC'
+);
+SELECT add_compression_policy('perf_values', INTERVAL '7 days', if_not_exists => TRUE);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS perf_values_hourly
+WITH (timescaledb.continuous) AS
+SELECT time_bucket(INTERVAL '1 hour', time) AS bucket, host_id, service_id, label_id,
+	avg(value) AS avg, min(value) AS min, max(value) AS max, count(*) AS count
+FROM perf_values
+GROUP BY bucket, host_id, service_id, label_id
+WITH NO DATA;
+SELECT add_continuous_aggregate_policy('perf_values_hourly',
+	start_offset => INTERVAL '3 hours',
+	end_offset => INTERVAL '1 hour',
+	schedule_interval => INTERVAL '1 hour',
+	if_not_exists => TRUE);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS perf_values_record_key_idx;
+ALTER TABLE perf_values DROP COLUMN IF EXISTS record_key;
+
+DROP INDEX IF EXISTS check_results_record_key_idx;
+ALTER TABLE check_results DROP COLUMN IF EXISTS record_key;
@@ -0,0 +1,7 @@
+-- Natural keys of check results and perfdata values, so a point written
+-- twice is only stored once. Rows written before have none.
+ALTER TABLE check_results ADD COLUMN IF NOT EXISTS record_key TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS check_results_record_key_idx ON check_results (record_key, time);
+
+ALTER TABLE perf_values ADD COLUMN IF NOT EXISTS record_key TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS perf_values_record_key_idx ON perf_values (record_key, label_id, time);
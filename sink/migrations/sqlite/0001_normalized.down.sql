@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS perf_values;
+DROP TABLE IF EXISTS check_results;
+DROP TABLE IF EXISTS perf_labels;
+DROP TABLE IF EXISTS services;
+DROP TABLE IF EXISTS hosts;
@@ -0,0 +1,58 @@
+-- The normalized schema of the PostgreSQL migration of the same version in
+-- SQLite. JSON attributes and fields are TEXT, and times are TIMESTAMP,
+-- stored in UTC.
+
+CREATE TABLE IF NOT EXISTS hosts (
+	host_id    INTEGER PRIMARY KEY,
+	instance   TEXT NOT NULL DEFAULT '',
+	host_name  TEXT NOT NULL,
+	attributes TEXT NOT NULL DEFAULT '{}',
+	first_seen TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (instance, host_name)
+);
+
+CREATE TABLE IF NOT EXISTS services (
+	service_id          INTEGER PRIMARY KEY,
+	host_id             INTEGER NOT NULL REFERENCES hosts (host_id),
+	service_description TEXT NOT NULL,
+	check_command       TEXT NOT NULL DEFAULT '',
+	attributes          TEXT NOT NULL DEFAULT '{}',
+	first_seen          TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at          TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (host_id, service_description)
+);
+
+CREATE TABLE IF NOT EXISTS perf_labels (
+	label_id INTEGER PRIMARY KEY,
+	label    TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS check_results (
+	time           TIMESTAMP NOT NULL,
+	host_id        INTEGER NOT NULL REFERENCES hosts (host_id),
+	service_id     INTEGER REFERENCES services (service_id),
+	state          SMALLINT,
+	state_type     SMALLINT,
+	attempt        INTEGER,
+	output         TEXT,
+	latency        DOUBLE PRECISION,
+	execution_time DOUBLE PRECISION,
+	fields         TEXT NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS check_results_host_time ON check_results (host_id, time DESC);
+CREATE INDEX IF NOT EXISTS check_results_service_time ON check_results (service_id, time DESC);
+
+CREATE TABLE IF NOT EXISTS perf_values (
+	time       TIMESTAMP NOT NULL,
+	host_id    INTEGER NOT NULL REFERENCES hosts (host_id),
+	service_id INTEGER REFERENCES services (service_id),
+	label_id   INTEGER NOT NULL REFERENCES perf_labels (label_id),
+	value      DOUBLE PRECISION NOT NULL,
+	warn       DOUBLE PRECISION,
+	crit       DOUBLE PRECISION,
+	min        DOUBLE PRECISION,
+	max        DOUBLE PRECISION
+);
+CREATE INDEX IF NOT EXISTS perf_values_label_time ON perf_values (label_id, time DESC);
+CREATE INDEX IF NOT EXISTS perf_values_service_time ON perf_values (service_id, time DESC);
@@ -0,0 +1,18 @@
+-- The status of every host and service in the last status.dat read from
+-- each instance, hosts having an empty service_description. Hosts and
+-- services no longer in status.dat are deleted. updated_at is the created
+-- time of the status.dat the row last changed in.
+
+CREATE TABLE IF NOT EXISTS current_status (
+	instance            TEXT NOT NULL DEFAULT '',
+	host_name           TEXT NOT NULL,
+	service_description TEXT NOT NULL DEFAULT '',
+	state               SMALLINT NOT NULL,
+	state_type          SMALLINT NOT NULL,
+	output              TEXT NOT NULL DEFAULT '',
+	last_check          TIMESTAMP,
+	acknowledged        BOOLEAN NOT NULL DEFAULT false,
+	downtime_depth      INTEGER NOT NULL DEFAULT 0,
+	updated_at          TIMESTAMP NOT NULL,
+	PRIMARY KEY (instance, host_name, service_description)
+);
@@ -0,0 +1,424 @@
+package sink
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bensallen/sqlios/nagios"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// Schemas a SQL sink writes to
+const (
+	// JSONSchema is a single table with one row per point, its tags and
+	// fields stored as JSON.
+	JSONSchema = "json"
+	// NormalizedSchema is the tables created by Migrations, with hosts,
+	// services and perfdata labels referenced by check results and perfdata
+	// values.
+	NormalizedSchema = "normalized"
+)
+
+// perfdataPrefix starts the fields ParseBlock splits performance_data into,
+// each label's value followed by its limits such as performance_data.rta.warn.
+const perfdataPrefix = "performance_data."
+
+// perfdataLimits are the suffixes of the limits of a perfdata value, in the
+// order of the columns of perf_values.
+var perfdataLimits = []string{"warn", "crit", "min", "max"}
+
+// checkResultColumns maps the fields stored in their own check_results
+// column to it. Fields not listed, other than those identifying the host and
+// service, are stored in its fields column.
+var checkResultColumns = map[string]string{
+	"current_state":        "state",
+	"state_type":           "state_type",
+	"current_attempt":      "attempt",
+	"plugin_output":        "output",
+	"output":               "output",
+	"check_latency":        "latency",
+	"check_execution_time": "execution_time",
+}
+
+// dimensionFields identify the host and service of a point rather than
+// being part of its check result.
+var dimensionFields = map[string]bool{
+	"instance":            true,
+	"host_name":           true,
+	"service_description": true,
+	"check_command":       true,
+}
+
+// row is a point split into the rows of the normalized schema.
+type row struct {
+	time time.Time
+	host hostRow
+	// service is nil for a host.
+	service *serviceRow
+	// result is nil unless the point is a hoststatus or servicestatus.
+	result *checkResult
+	perf   []perfValue
+}
+
+type hostRow struct {
+	instance string
+	name     string
+	// attributes are the tags of a host as JSON, empty for a service's
+	// host, whose attributes aren't known from its points.
+	attributes string
+}
+
+type serviceRow struct {
+	description  string
+	checkCommand string
+	attributes   string
+}
+
+type checkResult struct {
+	state, stateType, attempt sql.NullInt64
+	output                    sql.NullString
+	latency, executionTime    sql.NullFloat64
+	fields                    string
+}
+
+type perfValue struct {
+	label  string
+	value  float64
+	limits [4]sql.NullFloat64
+}
+
+// normalize splits a point into rows, returning nil for points with neither
+// a check result nor perfdata, such as comments and programstatus.
+func normalize(p *client.Point) (*row, error) {
+	fields, err := p.Fields()
+	if err != nil {
+		return nil, err
+	}
+	delete(fields, nagios.KeyField)
+	tags := p.Tags()
+	lookup := func(key string) string {
+		if v, ok := tags[key]; ok {
+			return v
+		}
+		v, _ := fields[key].(string)
+		return v
+	}
+
+	hostName := lookup("host_name")
+	if hostName == "" {
+		return nil, nil
+	}
+
+	r := &row{time: p.Time(), perf: perfValues(fields)}
+	if _, ok := fields["current_state"]; ok {
+		if r.result, err = newCheckResult(fields); err != nil {
+			return nil, err
+		}
+	}
+	if r.result == nil && len(r.perf) == 0 {
+		return nil, nil
+	}
+
+	var attributes = make(map[string]string, len(tags))
+	for k, v := range tags {
+		if !dimensionFields[k] {
+			attributes[k] = v
+		}
+	}
+	b, err := json.Marshal(attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	r.host = hostRow{instance: tags["instance"], name: hostName}
+	if description := lookup("service_description"); description != "" {
+		r.service = &serviceRow{description: description, checkCommand: lookup("check_command"), attributes: string(b)}
+	} else {
+		r.host.attributes = string(b)
+	}
+	return r, nil
+}
+
+// newCheckResult takes the columns of check_results from fields.
+func newCheckResult(fields map[string]interface{}) (*checkResult, error) {
+	var c checkResult
+	var rest = make(map[string]interface{})
+	for key, v := range fields {
+		switch column := checkResultColumns[key]; {
+		case column == "state":
+			c.state = nullInt(v)
+		case column == "state_type":
+			c.stateType = nullInt(v)
+		case column == "attempt":
+			c.attempt = nullInt(v)
+		case column == "output":
+			if s, ok := v.(string); ok {
+				c.output = sql.NullString{String: s, Valid: true}
+			}
+		case column == "latency":
+			c.latency = nullFloat(v)
+		case column == "execution_time":
+			c.executionTime = nullFloat(v)
+		case dimensionFields[key] || strings.HasPrefix(key, perfdataPrefix):
+		default:
+			rest[key] = v
+		}
+	}
+	b, err := json.Marshal(rest)
+	if err != nil {
+		return nil, err
+	}
+	c.fields = string(b)
+	return &c, nil
+}
+
+// perfValues collects the perfdata fields into one value per label, sorted
+// by label. A field ending in .warn, .crit, .min or .max is a limit if the
+// field without it is a value, otherwise it is a label of its own.
+func perfValues(fields map[string]interface{}) []perfValue {
+	var numbers = make(map[string]float64)
+	for key, v := range fields {
+		if !strings.HasPrefix(key, perfdataPrefix) {
+			continue
+		}
+		if f := nullFloat(v); f.Valid {
+			numbers[key[len(perfdataPrefix):]] = f.Float64
+		}
+	}
+
+	var values = make(map[string]*perfValue)
+	var limits = make(map[string]float64)
+	for name, f := range numbers {
+		if limitOf(numbers, name) >= 0 {
+			limits[name] = f
+			continue
+		}
+		values[name] = &perfValue{label: name, value: f}
+	}
+	for name, f := range limits {
+		i := limitOf(numbers, name)
+		values[strings.TrimSuffix(name, "."+perfdataLimits[i])].limits[i] = sql.NullFloat64{Float64: f, Valid: true}
+	}
+
+	var list = make([]perfValue, 0, len(values))
+	for _, v := range values {
+		list = append(list, *v)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].label < list[j].label })
+	return list
+}
+
+// limitOf returns the index in perfdataLimits of the limit name is, or -1 if
+// it is a value.
+func limitOf(numbers map[string]float64, name string) int {
+	for i, suffix := range perfdataLimits {
+		base := strings.TrimSuffix(name, "."+suffix)
+		if _, ok := numbers[base]; ok && base != name && limitOf(numbers, base) < 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+func nullInt(v interface{}) sql.NullInt64 {
+	switch v := v.(type) {
+	case int64:
+		return sql.NullInt64{Int64: v, Valid: true}
+	case float64:
+		return sql.NullInt64{Int64: int64(v), Valid: true}
+	}
+	return sql.NullInt64{}
+}
+
+func nullFloat(v interface{}) sql.NullFloat64 {
+	switch v := v.(type) {
+	case float64:
+		return sql.NullFloat64{Float64: v, Valid: true}
+	case int64:
+		return sql.NullFloat64{Float64: float64(v), Valid: true}
+	}
+	return sql.NullFloat64{}
+}
+
+// stagePointsColumns and stagePerfColumns are the columns of the staging
+// tables each point is copied into, before being merged into the normalized
+// schema.
+var (
+	stagePointsColumns = []string{"time", "instance", "host_name", "host_attributes",
+		"service_description", "check_command", "service_attributes", "has_result",
+		"state", "state_type", "attempt", "output", "latency", "execution_time", "fields", "record_key"}
+	stagePerfColumns = []string{"time", "instance", "host_name", "service_description",
+		"label", "value", "warn", "crit", "min", "max", "record_key"}
+)
+
+const (
+	// createStagingSQL creates the staging tables in PostgreSQL, once per
+	// connection. They are emptied by every commit.
+	createStagingSQL = `CREATE TEMP TABLE IF NOT EXISTS sqlios_stage_points (
+	time                TIMESTAMPTZ NOT NULL,
+	instance            TEXT NOT NULL,
+	host_name           TEXT NOT NULL,
+	host_attributes     JSONB,
+	service_description TEXT,
+	check_command       TEXT,
+	service_attributes  JSONB,
+	has_result          BOOLEAN NOT NULL,
+	state               SMALLINT,
+	state_type          SMALLINT,
+	attempt             INTEGER,
+	output              TEXT,
+	latency             DOUBLE PRECISION,
+	execution_time      DOUBLE PRECISION,
+	fields              JSONB,
+	record_key          TEXT NOT NULL
+) ON COMMIT DELETE ROWS;
+CREATE TEMP TABLE IF NOT EXISTS sqlios_stage_perf (
+	time                TIMESTAMPTZ NOT NULL,
+	instance            TEXT NOT NULL,
+	host_name           TEXT NOT NULL,
+	service_description TEXT,
+	label               TEXT NOT NULL,
+	value               DOUBLE PRECISION NOT NULL,
+	warn                DOUBLE PRECISION,
+	crit                DOUBLE PRECISION,
+	min                 DOUBLE PRECISION,
+	max                 DOUBLE PRECISION,
+	record_key          TEXT NOT NULL
+) ON COMMIT DELETE ROWS`
+)
+
+// mergeSQL merges the staging tables into the normalized schema in
+// PostgreSQL, in order.
+// Hosts and services are inserted the first time they are seen and updated
+// when their attributes change, taking the latest point's when a batch has
+// several. A service's host is only inserted if it is new, its attributes
+// aren't known from the service's points. Points without a check_command
+// leave the service's as it is. Check results and perfdata values already
+// written, found by their record_key, are skipped.
+var mergeSQL = []string{
+	`INSERT INTO hosts (instance, host_name, attributes)
+	SELECT DISTINCT ON (instance, host_name) instance, host_name, host_attributes
+	FROM sqlios_stage_points WHERE host_attributes IS NOT NULL
+	ORDER BY instance, host_name, time DESC
+	ON CONFLICT (instance, host_name) DO UPDATE
+	SET attributes = EXCLUDED.attributes, updated_at = now()
+	WHERE hosts.attributes IS DISTINCT FROM EXCLUDED.attributes`,
+
+	`INSERT INTO hosts (instance, host_name)
+	SELECT DISTINCT instance, host_name FROM sqlios_stage_points
+	ON CONFLICT (instance, host_name) DO NOTHING`,
+
+	`INSERT INTO services (host_id, service_description, check_command, attributes)
+	SELECT DISTINCT ON (h.host_id, s.service_description)
+		h.host_id, s.service_description, COALESCE(s.check_command, ''), s.service_attributes
+	FROM sqlios_stage_points s
+	JOIN hosts h ON h.instance = s.instance AND h.host_name = s.host_name
+	WHERE s.service_description IS NOT NULL
+	ORDER BY h.host_id, s.service_description, s.time DESC
+	ON CONFLICT (host_id, service_description) DO UPDATE
+	SET check_command = COALESCE(NULLIF(EXCLUDED.check_command, ''), services.check_command),
+		attributes = EXCLUDED.attributes, updated_at = now()
+	WHERE (COALESCE(NULLIF(EXCLUDED.check_command, ''), services.check_command), EXCLUDED.attributes)
+		IS DISTINCT FROM (services.check_command, services.attributes)`,
+
+	`INSERT INTO perf_labels (label)
+	SELECT DISTINCT label FROM sqlios_stage_perf
+	ON CONFLICT (label) DO NOTHING`,
+
+	`INSERT INTO check_results
+		(time, host_id, service_id, state, state_type, attempt, output, latency, execution_time, fields, record_key)
+	SELECT s.time, h.host_id, sv.service_id, s.state, s.state_type, s.attempt, s.output,
+		s.latency, s.execution_time, s.fields, s.record_key
+	FROM sqlios_stage_points s
+	JOIN hosts h ON h.instance = s.instance AND h.host_name = s.host_name
+	LEFT JOIN services sv ON sv.host_id = h.host_id AND sv.service_description = s.service_description
+	WHERE s.has_result
+	ON CONFLICT (record_key, time) DO NOTHING`,
+
+	`INSERT INTO perf_values
+		(time, host_id, service_id, label_id, value, warn, crit, min, max, record_key)
+	SELECT p.time, h.host_id, sv.service_id, l.label_id, p.value, p.warn, p.crit, p.min, p.max, p.record_key
+	FROM sqlios_stage_perf p
+	JOIN hosts h ON h.instance = p.instance AND h.host_name = p.host_name
+	LEFT JOIN services sv ON sv.host_id = h.host_id AND sv.service_description = p.service_description
+	JOIN perf_labels l ON l.label = p.label
+	ON CONFLICT (record_key, label_id, time) DO NOTHING`,
+}
+
+// stageRows converts points into rows of the staging tables, skipping those
+// normalize returns nil for.
+func stageRows(points []*client.Point) (stagePoints, stagePerf [][]interface{}, err error) {
+	for _, p := range points {
+		r, err := normalize(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if r == nil {
+			continue
+		}
+
+		var hostAttributes, description, checkCommand, serviceAttributes interface{}
+		if r.host.attributes != "" {
+			hostAttributes = r.host.attributes
+		}
+		if r.service != nil {
+			description, serviceAttributes = r.service.description, r.service.attributes
+			if r.service.checkCommand != "" {
+				checkCommand = r.service.checkCommand
+			}
+		}
+
+		key := nagios.Key(p)
+		var c checkResult
+		var fields interface{}
+		if r.result != nil {
+			c, fields = *r.result, r.result.fields
+		}
+		stagePoints = append(stagePoints, []interface{}{
+			r.time, r.host.instance, r.host.name, hostAttributes,
+			description, checkCommand, serviceAttributes, r.result != nil,
+			c.state, c.stateType, c.attempt, c.output, c.latency, c.executionTime, fields, key,
+		})
+
+		for _, v := range r.perf {
+			stagePerf = append(stagePerf, []interface{}{
+				r.time, r.host.instance, r.host.name, description,
+				v.label, v.value, v.limits[0], v.limits[1], v.limits[2], v.limits[3], key,
+			})
+		}
+	}
+	return stagePoints, stagePerf, nil
+}
+
+// writeNormalized copies points into the staging tables and merges them
+// into the normalized schema in a single transaction.
+func writeNormalized(db *sql.DB, d *dialect, points []*client.Point) error {
+	stagePoints, stagePerf, err := stageRows(points)
+	if err != nil {
+		return Rejected(err)
+	}
+	if len(stagePoints) == 0 {
+		return nil
+	}
+
+	return inTx(db, func(tx *sql.Tx) error {
+		if err := d.stage(tx); err != nil {
+			return err
+		}
+		if err := d.load(tx, "sqlios_stage_points", stagePointsColumns, stagePoints); err != nil {
+			return err
+		}
+		if err := d.load(tx, "sqlios_stage_perf", stagePerfColumns, stagePerf); err != nil {
+			return err
+		}
+		for _, merge := range d.merge {
+			if _, err := tx.Exec(merge); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
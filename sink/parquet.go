@@ -0,0 +1,261 @@
+package sink
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// The Parquet format, as far as writeParquet needs it: a file of a single
+// row group with one uncompressed, PLAIN encoded data page per column, its
+// metadata encoded with the Thrift compact protocol.
+// See https://github.com/apache/parquet-format.
+const (
+	parquetMagic = "PAR1"
+
+	// Physical types
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	// Converted types
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetDataPage = 0
+)
+
+// Thrift compact protocol field types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs with the Thrift compact protocol.
+type thriftWriter struct {
+	buf []byte
+	// last is the id of the last field of the struct being written, stack
+	// those of the structs it is nested in.
+	last  int16
+	stack []int16
+}
+
+func (t *thriftWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf = append(t.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (t *thriftWriter) varint(v int64) {
+	t.uvarint(uint64(v<<1) ^ uint64(v>>63))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.varint(int64(id))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) string(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.uvarint(uint64(len(s)))
+	t.buf = append(t.buf, s...)
+}
+
+// list starts a list field of n elements of typ.
+func (t *thriftWriter) list(id int16, typ byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|typ)
+	} else {
+		t.buf = append(t.buf, 0xf0|typ)
+		t.uvarint(uint64(n))
+	}
+}
+
+// begin starts a struct, as field id or, if id is 0, as an element of a
+// list. end finishes it.
+func (t *thriftWriter) begin(id int16) {
+	if id != 0 {
+		t.field(id, thriftStruct)
+	}
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) end() {
+	t.buf = append(t.buf, 0)
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+// parquetColumn is the physical layout of an exportColumn.
+func parquetColumn(c exportColumn) (typ int32, converted int32) {
+	switch c.typ {
+	case exportTime:
+		return parquetInt64, parquetTimestampMillis
+	case exportInt:
+		return parquetInt64, -1
+	case exportFloat:
+		return parquetDouble, -1
+	}
+	return parquetByteArray, parquetUTF8
+}
+
+// writeParquet writes rows to w as a Parquet file. Values are nil for
+// null, time.Time, int64, float64 or string as the column's type.
+func writeParquet(w io.Writer, columns []exportColumn, rows [][]interface{}) error {
+	var file = []byte(parquetMagic)
+	var meta thriftWriter
+
+	// FileMetaData
+	meta.i32(1, 1)
+	meta.list(2, thriftStruct, len(columns)+1)
+	meta.begin(0)
+	meta.string(4, "schema")
+	meta.i32(5, int32(len(columns)))
+	meta.end()
+	for _, c := range columns {
+		typ, converted := parquetColumn(c)
+		meta.begin(0)
+		meta.i32(1, typ)
+		if c.required {
+			meta.i32(3, parquetRequired)
+		} else {
+			meta.i32(3, parquetOptional)
+		}
+		meta.string(4, c.name)
+		if converted >= 0 {
+			meta.i32(6, converted)
+		}
+		meta.end()
+	}
+	meta.i64(3, int64(len(rows)))
+
+	meta.list(4, thriftStruct, 1)
+	meta.begin(0)
+	meta.list(1, thriftStruct, len(columns))
+	var total int64
+	for i, c := range columns {
+		page := parquetPage(c, i, rows)
+		var header thriftWriter
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(page)))
+		header.begin(5)
+		header.i32(1, int32(len(rows)))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.end()
+		header.buf = append(header.buf, 0)
+
+		offset := int64(len(file))
+		size := int64(len(header.buf) + len(page))
+		file = append(append(file, header.buf...), page...)
+		total += size
+
+		typ, _ := parquetColumn(c)
+		// ColumnChunk
+		meta.begin(0)
+		meta.i64(2, offset)
+		meta.begin(3)
+		meta.i32(1, typ)
+		meta.list(2, thriftI32, 2)
+		meta.varint(parquetPlain)
+		meta.varint(parquetRLE)
+		meta.list(3, thriftBinary, 1)
+		meta.uvarint(uint64(len(c.name)))
+		meta.buf = append(meta.buf, c.name...)
+		meta.i32(4, 0)
+		meta.i64(5, int64(len(rows)))
+		meta.i64(6, size)
+		meta.i64(7, size)
+		meta.i64(9, offset)
+		meta.end()
+		meta.end()
+	}
+	meta.i64(2, total)
+	meta.i64(3, int64(len(rows)))
+	meta.end()
+	meta.string(6, "sqlios")
+	meta.buf = append(meta.buf, 0)
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(meta.buf)))
+	file = append(append(append(file, meta.buf...), length[:]...), parquetMagic...)
+	_, err := w.Write(file)
+	return err
+}
+
+// parquetPage encodes column i of rows as the data of a page: the
+// definition levels of an optional column, 1 for a value and 0 for null,
+// then the values.
+func parquetPage(c exportColumn, i int, rows [][]interface{}) []byte {
+	var page []byte
+	if !c.required {
+		var levels []byte
+		var b [binary.MaxVarintLen64]byte
+		// Runs of the same level, as in the RLE/bit-packing hybrid
+		// encoding with a bit width of 1
+		for start := 0; start < len(rows); {
+			defined := rows[start][i] != nil
+			end := start
+			for end < len(rows) && (rows[end][i] != nil) == defined {
+				end++
+			}
+			levels = append(levels, b[:binary.PutUvarint(b[:], uint64(end-start)<<1)]...)
+			if defined {
+				levels = append(levels, 1)
+			} else {
+				levels = append(levels, 0)
+			}
+			start = end
+		}
+		var length [4]byte
+		binary.LittleEndian.PutUint32(length[:], uint32(len(levels)))
+		page = append(append(page, length[:]...), levels...)
+	}
+
+	var b [8]byte
+	for _, row := range rows {
+		switch v := row[i].(type) {
+		case time.Time:
+			binary.LittleEndian.PutUint64(b[:], uint64(v.UnixNano()/int64(time.Millisecond)))
+			page = append(page, b[:]...)
+		case int64:
+			binary.LittleEndian.PutUint64(b[:], uint64(v))
+			page = append(page, b[:]...)
+		case float64:
+			binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+			page = append(page, b[:]...)
+		case string:
+			binary.LittleEndian.PutUint32(b[:4], uint32(len(v)))
+			page = append(append(page, b[:4]...), v...)
+		}
+	}
+	return page
+}
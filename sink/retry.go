@@ -0,0 +1,116 @@
+package sink
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// Backoff describes a jittered exponential backoff.
+type Backoff struct {
+	// Initial is the delay before the first retry.
+	Initial time.Duration
+	// Max caps the delay between retries.
+	Max time.Duration
+	// Retries is the number of retries before giving up.
+	Retries int
+}
+
+// DefaultBackoff supplies Initial and Max when they are left zero in the
+// Backoff passed to NewRetry.
+var DefaultBackoff = Backoff{
+	Initial: 500 * time.Millisecond,
+	Max:     30 * time.Second,
+	Retries: 5,
+}
+
+// Delay returns how long to wait before the given retry, counting from 0.
+// The delay doubles each attempt up to Max, and a random half of it is
+// jitter so that many writers retrying at once spread out.
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := b.Initial
+	for i := 0; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+// Retry wraps a Sink, retrying retryable errors with backoff and sending
+// permanently rejected points to a DeadLetter.
+type Retry struct {
+	Sink
+	ctx        context.Context
+	backoff    Backoff
+	deadLetter *DeadLetter
+}
+
+// NewRetry wraps s. deadLetter may be nil, in which case permanent errors are
+// returned to the caller. Once ctx is done writes stop waiting to retry and
+// return their last error.
+func NewRetry(ctx context.Context, s Sink, backoff Backoff, deadLetter *DeadLetter) *Retry {
+	if backoff.Initial == 0 {
+		backoff.Initial = DefaultBackoff.Initial
+	}
+	if backoff.Max == 0 {
+		backoff.Max = DefaultBackoff.Max
+	}
+	return &Retry{Sink: s, ctx: ctx, backoff: backoff, deadLetter: deadLetter}
+}
+
+// Write writes points to the wrapped Sink. Once retries are exhausted the
+// last retryable error is returned so the caller can keep the points.
+//
+// When some of the points of a batch are rejected, as with a field type
+// conflict, it is split in half and each half is written again, until the
+// individual points at fault are found and dead-lettered. Sinks must
+// tolerate a point being written twice, which InfluxDB does since a point
+// with the same series and time overwrites. Other permanent errors, such as
+// a rejected token, dead-letter the whole batch at once.
+func (r *Retry) Write(points []*client.Point) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = r.Sink.Write(points)
+		if err == nil {
+			return nil
+		}
+		if !IsRetryable(err) || attempt >= r.backoff.Retries {
+			break
+		}
+		delay := r.backoff.Delay(attempt)
+		log.Printf("Warning, %s: write of %d points failed, retrying in %s: %s", r.Name(), len(points), delay, err)
+		select {
+		case <-time.After(delay):
+		case <-r.ctx.Done():
+			return err
+		}
+	}
+
+	if IsRetryable(err) {
+		return err
+	}
+
+	if len(points) > 1 && IsRejected(err) {
+		mid := len(points) / 2
+		errHead := r.Write(points[:mid])
+		errTail := r.Write(points[mid:])
+		if errHead != nil {
+			return errHead
+		}
+		return errTail
+	}
+
+	if r.deadLetter == nil {
+		return err
+	}
+	return r.deadLetter.Write(r.Name(), err, points)
+}
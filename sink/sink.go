@@ -0,0 +1,106 @@
+package sink
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+
+	"github.com/bensallen/sqlios/nagios"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// Sink is a destination that parsed points are written to.
+type Sink interface {
+	// Name identifies the sink in logs and dead-letter records.
+	Name() string
+	Write(points []*client.Point) error
+	Close() error
+}
+
+// SchemaChecker is a Sink that can check, before writing, that it
+// understands the schema of its database. A Permanent error means it never
+// will.
+type SchemaChecker interface {
+	CheckSchema() error
+}
+
+// StatusWriter is a Sink that also mirrors the current status of every host
+// and service, replacing what it holds for the instance with each status.dat
+// read.
+type StatusWriter interface {
+	WriteStatus(status *nagios.CurrentStatus) error
+}
+
+// Error is returned by a Sink to say whether a failed write is worth
+// retrying. Retryable errors are transient, like timeouts, 5xx responses and
+// refused connections. Anything else means the points will never be
+// accepted as they are, such as a field type conflict or a 4xx response.
+type Error struct {
+	Err       error
+	Retryable bool
+	// Points is set on a permanent error that may be caused by only some of
+	// the points written, such as a field type conflict, so that writing
+	// part of them may succeed. Other permanent errors, such as a rejected
+	// token or a missing database, fail every point alike.
+	Points bool
+}
+
+func (e *Error) Error() string {
+	if e.Retryable {
+		return fmt.Sprintf("retryable: %s", e.Err)
+	}
+	return fmt.Sprintf("permanent: %s", e.Err)
+}
+
+// Retryable marks err as transient.
+func Retryable(err error) error {
+	return &Error{Err: err, Retryable: true}
+}
+
+// Permanent marks err as one that retrying will not fix.
+func Permanent(err error) error {
+	return &Error{Err: err, Retryable: false}
+}
+
+// Rejected marks err as permanent and caused by some of the points written.
+func Rejected(err error) error {
+	return &Error{Err: err, Retryable: false, Points: true}
+}
+
+// IsRejected reports whether err was caused by some of the points written.
+func IsRejected(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Points
+}
+
+// IsRetryable reports whether a write that failed with err may succeed if
+// tried again. Errors not classified by a Sink are judged on whether they
+// look like a network failure.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Retryable
+	}
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return true
+	}
+	if e, ok := err.(*net.OpError); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*os.SyscallError); ok {
+		err = e.Err
+	}
+	switch err {
+	case syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EPIPE, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,1119 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bensallen/sqlios/nagios"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// testPoint returns a point at the created time of example_data/status_small.dat.
+func testPoint(t testing.TB, name string, tags map[string]string, fields map[string]interface{}) *client.Point {
+	p, err := client.NewPoint(name, tags, fields, time.Unix(1416605951, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func testPoints(t *testing.T, names ...string) []*client.Point {
+	var points []*client.Point
+	for _, name := range names {
+		points = append(points, testPoint(t, name, nil, map[string]interface{}{"value": 1.0}))
+	}
+	return points
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "Retryable", err: Retryable(errors.New("x")), want: true},
+		{name: "Permanent", err: Permanent(errors.New("x")), want: false},
+		{name: "Connection refused", err: &net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}, want: true},
+		{name: "Unclassified", err: errors.New("x"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_classifyStatus(t *testing.T) {
+	tests := []struct {
+		code          int
+		wantErr       bool
+		wantRetryable bool
+		wantRejected  bool
+	}{
+		{code: 204},
+		{code: 400, wantErr: true, wantRejected: true},
+		{code: 401, wantErr: true},
+		{code: 404, wantErr: true},
+		{code: 413, wantErr: true, wantRejected: true},
+		{code: 429, wantErr: true, wantRetryable: true},
+		{code: 500, wantErr: true, wantRetryable: true},
+		{code: 503, wantErr: true, wantRetryable: true},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.code), func(t *testing.T) {
+			err := classifyStatus(tt.code, nil)
+			if (err != nil) != tt.wantErr || IsRetryable(err) != tt.wantRetryable || IsRejected(err) != tt.wantRejected {
+				t.Errorf("classifyStatus(%d) = %v, wantErr %v, wantRetryable %v, wantRejected %v", tt.code, err, tt.wantErr, tt.wantRetryable, tt.wantRejected)
+			}
+		})
+	}
+}
+
+func TestRetry_Write(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case n == 1:
+			http.Error(w, "timeout", http.StatusServiceUnavailable)
+		case strings.Contains(string(body), "bad"):
+			http.Error(w, `{"error":"partial write: field type conflict"}`, http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	influx, err := NewInflux(InfluxConfig{Addr: ts.URL, Database: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	dl, err := OpenDeadLetter(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRetry(context.Background(), influx, Backoff{Initial: time.Millisecond, Max: time.Millisecond, Retries: 1}, dl)
+	if err := r.Write(testPoints(t, "good1", "bad", "good2", "good3")); err != nil {
+		t.Errorf("Retry.Write() error = %v", err)
+	}
+	dl.Close()
+
+	f, _ = os.Open(f.Name())
+	defer f.Close()
+	var lines []string
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 1 || !strings.Contains(lines[0], `"point":"bad value=1 `) || !strings.Contains(lines[0], "field type conflict") {
+		t.Errorf("dead letter = %v, want a single record for the bad point", lines)
+	}
+
+	// A rejected token fails every point alike, the batch isn't split
+	requests = 0
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "authorization failed", http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+	influx, err = NewInflux(InfluxConfig{Addr: unauthorized.URL, Database: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = NewRetry(context.Background(), influx, Backoff{Initial: time.Millisecond, Max: time.Millisecond, Retries: 1}, nil)
+	if err := r.Write(testPoints(t, "good1", "good2", "good3", "good4")); err == nil || requests != 1 {
+		t.Errorf("Retry.Write() error = %v after %d requests, want an error after 1", err, requests)
+	}
+}
+
+func TestInflux2_Write(t *testing.T) {
+	var created, writes int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Token secret" {
+			http.Error(w, "unauthorized: "+got, http.StatusUnauthorized)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v2/buckets":
+			if r.URL.Query().Get("name") != "nagios" || r.URL.Query().Get("org") != "ops" {
+				t.Errorf("bucket lookup query = %s", r.URL.RawQuery)
+			}
+			// InfluxDB answers a lookup of a missing bucket with a 404
+			if atomic.LoadInt32(&created) == 0 {
+				http.Error(w, `{"code":"not found","message":"bucket \"nagios\" not found"}`, http.StatusNotFound)
+			} else {
+				w.Write([]byte(`{"buckets":[{"name":"nagios"}]}`))
+			}
+		case "GET /api/v2/orgs":
+			w.Write([]byte(`{"orgs":[{"id":"0a1b2c3d4e5f6a7b","name":"ops"}]}`))
+		case "POST /api/v2/buckets":
+			body, _ := ioutil.ReadAll(r.Body)
+			if want := `{"name":"nagios","orgID":"0a1b2c3d4e5f6a7b","retentionRules":[]}`; string(body) != want {
+				t.Errorf("bucket created with %s, want %s", body, want)
+			}
+			atomic.AddInt32(&created, 1)
+			w.WriteHeader(http.StatusCreated)
+		case "POST /api/v2/write":
+			if want := "bucket=nagios&org=ops&precision=s"; r.URL.RawQuery != want {
+				t.Errorf("write query = %s, want %s", r.URL.RawQuery, want)
+			}
+			if r.Header.Get("Content-Encoding") != "gzip" {
+				http.Error(w, "not gzipped", http.StatusBadRequest)
+				return
+			}
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body, _ := ioutil.ReadAll(gz)
+			if want := "good1 value=1 1416605951\ngood2 value=1 1416605951\n"; string(body) != want {
+				t.Errorf("line protocol = %q, want %q", body, want)
+			}
+			atomic.AddInt32(&writes, 1)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "Bad token", token: "wrong", wantErr: true},
+		{name: "Create bucket", token: "secret"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewInflux2(Influx2Config{Addr: ts.URL, Token: tt.token, Org: "ops", Bucket: "nagios", CreateBucket: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The second write finds the bucket already checked
+			for i := 0; i < 2; i++ {
+				err = s.Write(testPoints(t, "good1", "good2"))
+				// A rejected token is permanent
+				if (err != nil) != tt.wantErr || IsRetryable(err) {
+					t.Fatalf("Influx2.Write() error = %v, wantErr %v", err, tt.wantErr)
+				}
+			}
+		})
+	}
+	if created != 1 || writes != 2 {
+		t.Errorf("created %d buckets and wrote %d times, want 1 and 2", created, writes)
+	}
+}
+
+func Test_lineProtocol(t *testing.T) {
+	p := testPoint(t, "web1", nil, map[string]interface{}{"value": 1.0, nagios.KeyField: "d9bb06c7"})
+	if got, want := lineProtocol(p), "web1 value=1 1416605951"; got != want {
+		t.Errorf("lineProtocol() = %q, want %q", got, want)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 || migrations[0].Version != 1 {
+		t.Fatalf("Migrations() = %v, want version 1 first", migrations)
+	}
+	for i, m := range migrations {
+		if i > 0 && m.Version <= migrations[i-1].Version {
+			t.Errorf("Migrations() version %d after %d", m.Version, migrations[i-1].Version)
+		}
+	}
+	for _, table := range []string{"hosts", "services", "perf_labels", "check_results", "perf_values"} {
+		if !strings.Contains(migrations[0].Up, "CREATE TABLE IF NOT EXISTS "+table+" (") || !strings.Contains(migrations[0].Down, "DROP TABLE IF EXISTS "+table+";") {
+			t.Errorf("Migrations() doesn't create and drop %s", table)
+		}
+	}
+	if m := postgresDialect.migration("timescaledb"); m.Requires != "timescaledb" {
+		t.Errorf("timescaledb migration requires %q", m.Requires)
+	}
+	if m := postgresDialect.migration("current_status"); !strings.Contains(m.Up, "PRIMARY KEY (instance, host_name, service_description)") {
+		t.Errorf("current_status migration = %s", m.Up)
+	}
+	for _, merge := range mergeSQL {
+		for _, index := range []string{"(record_key, time)", "(record_key, label_id, time)"} {
+			if strings.Contains(merge, "ON CONFLICT "+index) && !strings.Contains(postgresDialect.migration("record_keys").Up, index) {
+				t.Errorf("no unique index on %s for %s", index, merge)
+			}
+		}
+	}
+
+	// The SQLite migrations have the versions of their PostgreSQL
+	// counterparts
+	for _, m := range sqliteDialect.migrations {
+		if pg := postgresDialect.migration(m.Name); pg.Version != m.Version {
+			t.Errorf("SQLite migration %d %s is PostgreSQL's %d", m.Version, m.Name, pg.Version)
+		}
+	}
+}
+
+func Test_checkKnown(t *testing.T) {
+	states := []MigrationState{
+		{Migration: Migration{Version: 1}, Applied: time.Now()},
+		{Migration: Migration{Version: 2}},
+	}
+	if err := checkKnown(states); err != nil {
+		t.Errorf("checkKnown() error = %v", err)
+	}
+	states = append(states, MigrationState{Migration: Migration{Version: 9, Name: "future"}, Applied: time.Now(), Unknown: true})
+	if err, ok := checkKnown(states).(*UnknownSchemaError); !ok || !reflect.DeepEqual(err.Versions, []int{9}) {
+		t.Errorf("checkKnown() error = %v, want an UnknownSchemaError for 9", err)
+	}
+}
+
+func Test_normalize(t *testing.T) {
+	valid := func(f float64) sql.NullFloat64 { return sql.NullFloat64{Float64: f, Valid: true} }
+	tests := []struct {
+		name   string
+		tags   map[string]string
+		fields map[string]interface{}
+		want   *row
+	}{
+		{
+			name: "Host check",
+			tags: map[string]string{"instance": "prod", "host_name": "host1", "site": "dc1"},
+			fields: map[string]interface{}{
+				"current_state": int64(0), "state_type": int64(1), "current_attempt": int64(1),
+				"plugin_output": "PING OK", "check_latency": 0.1, "check_execution_time": 4.0,
+				"has_been_checked": int64(1), "performance_data.rta": 0.5, "performance_data.rta.warn": 100.0,
+				"performance_data.rta.crit": 500.0, "performance_data.pl": int64(0),
+			},
+			want: &row{
+				host: hostRow{instance: "prod", name: "host1", attributes: `{"site":"dc1"}`},
+				result: &checkResult{
+					state:         sql.NullInt64{Int64: 0, Valid: true},
+					stateType:     sql.NullInt64{Int64: 1, Valid: true},
+					attempt:       sql.NullInt64{Int64: 1, Valid: true},
+					output:        sql.NullString{String: "PING OK", Valid: true},
+					latency:       valid(0.1),
+					executionTime: valid(4),
+					fields:        `{"has_been_checked":1}`,
+				},
+				perf: []perfValue{
+					{label: "pl", value: 0},
+					{label: "rta", value: 0.5, limits: [4]sql.NullFloat64{valid(100), valid(500)}},
+				},
+			},
+		},
+		{
+			name: "Service check with fields as tags",
+			tags: map[string]string{"host_name": "host1", "service_description": "Disk"},
+			fields: map[string]interface{}{
+				"current_state": int64(2), "check_command": "check_disk", "output": "DISK CRITICAL",
+				// A label ending in .max whose value has no label of its own
+				"performance_data./var.max": 80.0,
+			},
+			want: &row{
+				host:    hostRow{name: "host1"},
+				service: &serviceRow{description: "Disk", checkCommand: "check_disk", attributes: `{}`},
+				result: &checkResult{
+					state:  sql.NullInt64{Int64: 2, Valid: true},
+					output: sql.NullString{String: "DISK CRITICAL", Valid: true},
+					fields: `{}`,
+				},
+				perf: []perfValue{{label: "/var.max", value: 80}},
+			},
+		},
+		{
+			name:   "Perfdata file",
+			fields: map[string]interface{}{"host_name": "host1", "service_description": "Load", "servicestate": "OK", "performance_data.load1": 0.2},
+			want: &row{
+				host:    hostRow{name: "host1"},
+				service: &serviceRow{description: "Load", attributes: `{}`},
+				perf:    []perfValue{{label: "load1", value: 0.2}},
+			},
+		},
+		{
+			name:   "Comment",
+			fields: map[string]interface{}{"host_name": "host1", "comment_data": "rebooting"},
+		},
+		{
+			name:   "Program status",
+			fields: map[string]interface{}{"pid": int64(1234)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalize(testPoint(t, "host1", tt.tags, tt.fields))
+			if err != nil {
+				t.Fatalf("normalize() error = %v", err)
+			}
+			if got != nil {
+				got.time = time.Time{}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("normalize() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_stageRows(t *testing.T) {
+	host := testPoint(t, "hoststatus", map[string]string{"host_name": "host1"},
+		map[string]interface{}{"current_state": int64(0), "performance_data.rta": 0.5})
+	service := testPoint(t, "servicestatus", map[string]string{"host_name": "host1", "service_description": "Disk"},
+		map[string]interface{}{"current_state": int64(2)})
+	comment := testPoint(t, "hostcomment", map[string]string{"host_name": "host1"},
+		map[string]interface{}{"comment_data": "rebooting"})
+
+	points, perf, err := stageRows([]*client.Point{host, service, comment})
+	if err != nil {
+		t.Fatalf("stageRows() error = %v", err)
+	}
+	if len(points) != 2 || len(perf) != 1 {
+		t.Fatalf("stageRows() = %d points and %d perf rows, want 2 and 1", len(points), len(perf))
+	}
+	for _, r := range points {
+		if len(r) != len(stagePointsColumns) {
+			t.Errorf("stageRows() point row has %d values, want %d", len(r), len(stagePointsColumns))
+		}
+	}
+	if points[0][3] != "{}" || points[0][4] != nil {
+		t.Errorf("stageRows() host attributes = %v, service = %v, want {} and nil", points[0][3], points[0][4])
+	}
+	if points[1][3] != nil || points[1][4] != "Disk" || points[1][5] != nil {
+		t.Errorf("stageRows() service row = %v", points[1])
+	}
+	if len(perf[0]) != len(stagePerfColumns) || perf[0][4] != "rta" || perf[0][5] != 0.5 {
+		t.Errorf("stageRows() perf row = %v", perf[0])
+	}
+	if key := points[0][len(points[0])-1]; key != nagios.Key(host) || key != perf[0][len(perf[0])-1] {
+		t.Errorf("stageRows() record_key = %v, want %s for the host and its perfdata", key, nagios.Key(host))
+	}
+}
+
+// countingSink records the points written to it.
+type countingSink struct {
+	written []string
+	err     error
+}
+
+func (s *countingSink) Name() string { return "counting" }
+func (s *countingSink) Close() error { return nil }
+func (s *countingSink) Write(points []*client.Point) error {
+	if s.err != nil {
+		return s.err
+	}
+	for _, p := range points {
+		s.written = append(s.written, p.Name())
+	}
+	return nil
+}
+
+func TestDedupe_Write(t *testing.T) {
+	s := &countingSink{}
+	d := NewDedupe(s, 2)
+
+	if err := d.Write(testPoints(t, "a", "b", "a")); err != nil {
+		t.Fatal(err)
+	}
+	// b was written, c failed, so it isn't remembered
+	s.err = errors.New("down")
+	if err := d.Write(testPoints(t, "b", "c")); err == nil {
+		t.Error("Dedupe.Write() error = nil, want the sink's")
+	}
+	s.err = nil
+	if err := d.Write(testPoints(t, "b", "c")); err != nil {
+		t.Fatal(err)
+	}
+	// The window of 2 has forgotten a
+	if err := d.Write(testPoints(t, "a", "c")); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c", "a"}; !reflect.DeepEqual(s.written, want) {
+		t.Errorf("Dedupe.Write() wrote %v, want %v", s.written, want)
+	}
+}
+
+// syntheticPoints returns the points of a status.dat of hosts hosts, each
+// with services services reporting perfdata.
+func syntheticPoints(b *testing.B, hosts, services int) []*client.Point {
+	var points []*client.Point
+	add := func(name string, tags map[string]string) {
+		points = append(points, testPoint(b, name, tags, map[string]interface{}{
+			"current_state": int64(0), "state_type": int64(1), "current_attempt": int64(1),
+			"plugin_output": "OK", "check_latency": 0.101, "check_execution_time": 4.012,
+			"performance_data.rta": 0.5, "performance_data.rta.warn": 100.0, "performance_data.rta.crit": 500.0,
+		}))
+	}
+	for h := 0; h < hosts; h++ {
+		host := "host" + strconv.Itoa(h)
+		add("hoststatus", map[string]string{"instance": "bench", "host_name": host})
+		for s := 0; s < services; s++ {
+			add("servicestatus", map[string]string{"instance": "bench", "host_name": host, "service_description": "Service " + strconv.Itoa(s)})
+		}
+	}
+	return points
+}
+
+// benchmarkHosts are the numbers of hosts, with 10 services each, of the
+// synthetic status.dat files benchmarked.
+var benchmarkHosts = []int{1000, 10000}
+
+// Benchmark_stageRows measures converting points into the rows copied into
+// the staging tables.
+func Benchmark_stageRows(b *testing.B) {
+	for _, hosts := range benchmarkHosts {
+		b.Run("services="+strconv.Itoa(hosts*10), func(b *testing.B) {
+			points := syntheticPoints(b, hosts, 10)
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := stageRows(points); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N*len(points))/time.Since(start).Seconds(), "points/s")
+		})
+	}
+}
+
+// BenchmarkSQL_Write measures writing to the normalized schema in batches
+// of 5000 points. It needs the DSN of a scratch PostgreSQL database in
+// SQLIOS_TEST_POSTGRES.
+func BenchmarkSQL_Write(b *testing.B) {
+	dsn := os.Getenv("SQLIOS_TEST_POSTGRES")
+	if dsn == "" {
+		b.Skip("SQLIOS_TEST_POSTGRES isn't set")
+	}
+	s, err := NewSQL(SQLConfig{Driver: "postgres", DSN: dsn, Schema: NormalizedSchema})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, hosts := range benchmarkHosts {
+		b.Run("services="+strconv.Itoa(hosts*10), func(b *testing.B) {
+			points := syntheticPoints(b, hosts, 10)
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < len(points); j += 5000 {
+					end := j + 5000
+					if end > len(points) {
+						end = len(points)
+					}
+					if err := s.Write(points[j:end]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(b.N*len(points))/time.Since(start).Seconds(), "points/s")
+		})
+	}
+}
+
+func TestSQL_sqlite(t *testing.T) {
+	if _, err := dialectOf("sqlite3"); err != nil {
+		t.Skip("built without cgo, which the SQLite driver needs")
+	}
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	points := []*client.Point{
+		testPoint(t, "web1", map[string]string{"instance": "prod", "host_name": "web1", "site": "dc1"},
+			map[string]interface{}{"current_state": int64(0), "current_event_id": int64(1), "performance_data.rta": 0.5, "performance_data.rta.warn": 100.0}),
+		testPoint(t, "web1.check_disk", map[string]string{"instance": "prod", "host_name": "web1", "service_description": "Disk"},
+			map[string]interface{}{"current_state": int64(2), "current_event_id": int64(2), "check_command": "check_disk", "plugin_output": "DISK CRITICAL"}),
+		testPoint(t, "web1.hostcomment", map[string]string{"instance": "prod", "host_name": "web1"},
+			map[string]interface{}{"comment_data": "rebooting"}),
+	}
+	count := func(db *sql.DB, query string) int {
+		var n int
+		if err := db.QueryRow(query).Scan(&n); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return n
+	}
+
+	for _, schema := range []string{NormalizedSchema, JSONSchema} {
+		t.Run(schema, func(t *testing.T) {
+			s, err := NewSQL(SQLConfig{Driver: "sqlite3", DSN: filepath.Join(dir, schema+".db"), Schema: schema, Table: "nagios"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			// Written twice, as after a retry, the points are stored once
+			for i := 0; i < 2; i++ {
+				if err := s.Write(points); err != nil {
+					t.Fatalf("SQL.Write() error = %v", err)
+				}
+			}
+			if err := s.CheckSchema(); err != nil {
+				t.Errorf("SQL.CheckSchema() error = %v", err)
+			}
+
+			if schema == JSONSchema {
+				if n := count(s.db, "SELECT count(*) FROM nagios"); n != 3 {
+					t.Errorf("nagios has %d rows, want 3", n)
+				}
+				return
+			}
+			for query, want := range map[string]int{
+				"SELECT count(*) FROM hosts WHERE attributes = '{\"site\":\"dc1\"}'":                  1,
+				"SELECT count(*) FROM services WHERE check_command = 'check_disk'":                    1,
+				"SELECT count(*) FROM check_results":                                                  2,
+				"SELECT count(*) FROM check_results WHERE output = 'DISK CRITICAL' AND state = 2":     1,
+				"SELECT count(*) FROM perf_values JOIN perf_labels USING (label_id) WHERE warn = 100": 1,
+			} {
+				if n := count(s.db, query); n != want {
+					t.Errorf("%s = %d, want %d", query, n, want)
+				}
+			}
+		})
+	}
+
+	s, err := NewSQL(SQLConfig{Driver: "sqlite3", DSN: filepath.Join(dir, "status.db"), Schema: NormalizedSchema})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	status := &nagios.CurrentStatus{Instance: "prod", Created: time.Unix(1416605951, 0), Statuses: []nagios.Status{
+		{HostName: "web1"},
+		{HostName: "web1", ServiceDescription: "Disk", State: 2, Output: "DISK CRITICAL"},
+	}}
+	if err := s.WriteStatus(status); err != nil {
+		t.Fatalf("SQL.WriteStatus() error = %v", err)
+	}
+	status.Statuses = status.Statuses[1:]
+	status.Statuses[0].State = 0
+	if err := s.WriteStatus(status); err != nil {
+		t.Fatalf("SQL.WriteStatus() error = %v", err)
+	}
+	if n := count(s.db, "SELECT count(*) FROM current_status WHERE service_description = 'Disk' AND state = 0"); n != 1 || count(s.db, "SELECT count(*) FROM current_status") != 1 {
+		t.Errorf("current_status isn't the last status written")
+	}
+
+	reverted, err := MigrateDown(s.db, "sqlite3", 0)
+	if err != nil || len(reverted) != len(sqliteDialect.migrations) {
+		t.Errorf("MigrateDown() = %v, %v", reverted, err)
+	}
+	if n := count(s.db, "SELECT count(*) FROM sqlite_master WHERE name IN ('hosts', 'current_status')"); n != 0 {
+		t.Errorf("MigrateDown() left %d tables", n)
+	}
+
+	// Points aren't dead-lettered while the database has been migrated by
+	// a newer SQLios, but held back as if it was down
+	newer, err := NewSQL(SQLConfig{Driver: "sqlite3", DSN: filepath.Join(dir, "newer.db"), Schema: NormalizedSchema})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newer.Close()
+	if _, err := MigrateUp(newer.db, "sqlite3", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newer.db.Exec("INSERT INTO schema_migrations (version, name) VALUES (99, 'future')"); err != nil {
+		t.Fatal(err)
+	}
+	dlPath := filepath.Join(dir, "dead_letter.json")
+	dl, err := OpenDeadLetter(dlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Close()
+	err = NewRetry(context.Background(), newer, Backoff{Initial: time.Millisecond}, dl).Write(points)
+	if e, ok := err.(*Error); !ok || !e.Retryable || reflect.TypeOf(e.Err) != reflect.TypeOf(&UnknownSchemaError{}) {
+		t.Errorf("Retry.Write() error = %v, want a retryable UnknownSchemaError", err)
+	}
+	if b, _ := ioutil.ReadFile(dlPath); len(b) != 0 {
+		t.Errorf("Retry.Write() dead-lettered %s", b)
+	}
+}
+
+func TestExport(t *testing.T) {
+	points := []*client.Point{
+		testPoint(t, "web1", map[string]string{"instance": "prod", "host_name": "web1", "site": "dc1"},
+			map[string]interface{}{"current_state": int64(0), "check_latency": 0.25, "performance_data.rta": 0.5, "performance_data.rta.warn": 100.0}),
+		testPoint(t, "web1.check_disk", map[string]string{"instance": "prod", "host_name": "web1", "service_description": "Disk"},
+			map[string]interface{}{"current_state": int64(2), "check_command": "check_disk", "plugin_output": "DISK CRITICAL, /var"}),
+		testPoint(t, "web1.hostcomment", map[string]string{"host_name": "web1"},
+			map[string]interface{}{"comment_data": "rebooting"}),
+	}
+	export := func(t *testing.T, conf ExportConfig) (*Export, func()) {
+		dir, err := ioutil.TempDir("", "export")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf.Dir = dir
+		e, err := NewExport(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e, func() { os.RemoveAll(dir) }
+	}
+	read := func(t *testing.T, e *Export, block string) []byte {
+		files, err := filepath.Glob(filepath.Join(e.conf.Dir, "date=2014-11-21", "block="+block, "part-*."+e.conf.Format))
+		if err != nil || len(files) != 1 {
+			t.Fatalf("block %s has files %v, want 1", block, files)
+		}
+		b, err := ioutil.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	t.Run("CSV", func(t *testing.T) {
+		e, cleanup := export(t, ExportConfig{})
+		defer cleanup()
+		if err := e.Write(points); err != nil {
+			t.Fatalf("Export.Write() error = %v", err)
+		}
+		if err := e.Close(); err != nil {
+			t.Fatalf("Export.Close() error = %v", err)
+		}
+
+		host, service, comment := nagios.Key(points[0]), nagios.Key(points[1]), nagios.Key(points[2])
+		for block, want := range map[string]string{
+			"hoststatus": "time,instance,host_name,state,state_type,attempt,output,latency,execution_time,attributes,fields,record_key\n" +
+				"2014-11-21T21:39:11Z,prod,web1,0,,,,0.25,,\"{\"\"site\"\":\"\"dc1\"\"}\",{}," + host + "\n",
+			"servicestatus": "time,instance,host_name,service_description,check_command,state,state_type,attempt,output,latency,execution_time,attributes,fields,record_key\n" +
+				"2014-11-21T21:39:11Z,prod,web1,Disk,check_disk,2,,,\"DISK CRITICAL, /var\",,,{},{}," + service + "\n",
+			"perfdata": "time,instance,host_name,service_description,label,value,warn,crit,min,max,record_key\n" +
+				"2014-11-21T21:39:11Z,prod,web1,,rta,0.5,100,,,," + host + "\n",
+			"hostcomment": "time,measurement,instance,host_name,service_description,tags,fields,record_key\n" +
+				"2014-11-21T21:39:11Z,web1.hostcomment,,web1,,\"{\"\"host_name\"\":\"\"web1\"\"}\",\"{\"\"comment_data\"\":\"\"rebooting\"\"}\"," + comment + "\n",
+		} {
+			if got := string(read(t, e, block)); got != want {
+				t.Errorf("block %s = %q, want %q", block, got, want)
+			}
+		}
+	})
+
+	t.Run("Parquet", func(t *testing.T) {
+		e, cleanup := export(t, ExportConfig{Format: ParquetFormat})
+		defer cleanup()
+		if err := e.Write(points); err != nil {
+			t.Fatalf("Export.Write() error = %v", err)
+		}
+		if err := e.Close(); err != nil {
+			t.Fatalf("Export.Close() error = %v", err)
+		}
+
+		columns, rows, err := readParquet(read(t, e, "servicestatus"))
+		if err != nil {
+			t.Fatalf("readParquet() error = %v", err)
+		}
+		if !reflect.DeepEqual(columns, serviceStatusColumns) {
+			t.Errorf("columns = %v, want %v", columns, serviceStatusColumns)
+		}
+		want := [][]interface{}{{
+			time.Unix(1416605951, 0).UTC(), "prod", "web1", "Disk", "check_disk", int64(2), nil, nil, "DISK CRITICAL, /var",
+			nil, nil, "{}", "{}", nagios.Key(points[1]),
+		}}
+		if !reflect.DeepEqual(rows, want) {
+			t.Errorf("rows = %v, want %v", rows, want)
+		}
+	})
+
+	t.Run("Window", func(t *testing.T) {
+		e, cleanup := export(t, ExportConfig{Window: time.Hour})
+		defer cleanup()
+		for _, p := range points {
+			if err := e.Write([]*client.Point{p}); err != nil {
+				t.Fatalf("Export.Write() error = %v", err)
+			}
+		}
+		if files, _ := filepath.Glob(filepath.Join(e.conf.Dir, "*", "*", "*")); len(files) != 0 {
+			t.Errorf("Export.Write() wrote %v before the window passed", files)
+		}
+		if err := e.Close(); err != nil {
+			t.Fatalf("Export.Close() error = %v", err)
+		}
+		for _, block := range []string{"hoststatus", "servicestatus", "perfdata", "hostcomment"} {
+			read(t, e, block)
+		}
+		if _, err := os.Stat(filepath.Join(e.conf.Dir, journalFile)); !os.IsNotExist(err) {
+			t.Errorf("Export.Close() left the journal, Stat() error = %v", err)
+		}
+	})
+
+	t.Run("Window passed", func(t *testing.T) {
+		defer func(tick time.Duration) { exportTick = tick }(exportTick)
+		exportTick = 5 * time.Millisecond
+
+		e, cleanup := export(t, ExportConfig{Window: 50 * time.Millisecond})
+		defer cleanup()
+		defer e.Close()
+		// The window is written out even if no write comes after it
+		if err := e.Write(points); err != nil {
+			t.Fatalf("Export.Write() error = %v", err)
+		}
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(exportTick) {
+			if files, _ := filepath.Glob(filepath.Join(e.conf.Dir, "*", "*", "part-*")); len(files) == 4 {
+				break
+			}
+		}
+		for _, block := range []string{"hoststatus", "servicestatus", "perfdata", "hostcomment"} {
+			read(t, e, block)
+		}
+	})
+
+	t.Run("Journal", func(t *testing.T) {
+		e, cleanup := export(t, ExportConfig{Window: time.Hour})
+		defer cleanup()
+		if err := e.Write(points); err != nil {
+			t.Fatalf("Export.Write() error = %v", err)
+		}
+
+		// A crash loses the buffer, the next run writes out the journal
+		recovered, err := NewExport(e.conf)
+		if err != nil {
+			t.Fatalf("NewExport() error = %v", err)
+		}
+		defer recovered.Close()
+		host, service, comment := nagios.Key(points[0]), nagios.Key(points[1]), nagios.Key(points[2])
+		for block, want := range map[string]string{
+			"hoststatus":    "2014-11-21T21:39:11Z,prod,web1,0,,,,0.25,,\"{\"\"site\"\":\"\"dc1\"\"}\",{}," + host + "\n",
+			"servicestatus": "2014-11-21T21:39:11Z,prod,web1,Disk,check_disk,2,,,\"DISK CRITICAL, /var\",,,{},{}," + service + "\n",
+			"perfdata":      "2014-11-21T21:39:11Z,prod,web1,,rta,0.5,100,,,," + host + "\n",
+			"hostcomment":   "2014-11-21T21:39:11Z,web1.hostcomment,,web1,,\"{\"\"host_name\"\":\"\"web1\"\"}\",\"{\"\"comment_data\"\":\"\"rebooting\"\"}\"," + comment + "\n",
+		} {
+			b := string(read(t, recovered, block))
+			if got := b[strings.Index(b, "\n")+1:]; got != want {
+				t.Errorf("block %s = %q, want %q", block, got, want)
+			}
+		}
+	})
+
+	t.Run("Idle", func(t *testing.T) {
+		defer func(idle, tick time.Duration) { exportIdle, exportTick = idle, tick }(exportIdle, exportTick)
+		exportIdle, exportTick = 50*time.Millisecond, 5*time.Millisecond
+
+		e, cleanup := export(t, ExportConfig{})
+		defer cleanup()
+		defer e.Close()
+		// The batches of a snapshot go to one file once writes stop
+		for _, p := range points {
+			if err := e.Write([]*client.Point{p}); err != nil {
+				t.Fatalf("Export.Write() error = %v", err)
+			}
+		}
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(exportTick) {
+			if files, _ := filepath.Glob(filepath.Join(e.conf.Dir, "*", "*", "part-*")); len(files) == 4 {
+				break
+			}
+		}
+		for _, block := range []string{"hoststatus", "servicestatus", "perfdata", "hostcomment"} {
+			read(t, e, block)
+		}
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		e, cleanup := export(t, ExportConfig{Window: time.Hour})
+		defer cleanup()
+		// A file in place of the directory of one partition fails the flush
+		blocker := filepath.Join(e.conf.Dir, "date=2014-11-21", "block=perfdata")
+		if err := os.MkdirAll(filepath.Dir(blocker), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(blocker, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Write(points); err != nil {
+			t.Fatalf("Export.Write() error = %v", err)
+		}
+		e.mu.Lock()
+		e.err = e.flush()
+		e.mu.Unlock()
+		if e.err == nil {
+			t.Fatalf("Export.flush() succeeded with a partition blocked")
+		}
+		if files, _ := filepath.Glob(filepath.Join(e.conf.Dir, "*", "*", "part-*")); len(files) != 0 {
+			t.Errorf("Export.flush() left %v after failing", files)
+		}
+		// Writes are held back until the buffer is written out
+		if err := e.Write(points); !IsRetryable(err) {
+			t.Fatalf("Export.Write() error = %v, want a retryable error", err)
+		}
+
+		os.Remove(blocker)
+		if err := e.Write(points[:1]); err != nil {
+			t.Fatalf("Export.Write() error = %v", err)
+		}
+		for _, block := range []string{"hoststatus", "servicestatus", "perfdata", "hostcomment"} {
+			read(t, e, block)
+		}
+		if err := e.Close(); err != nil {
+			t.Fatalf("Export.Close() error = %v", err)
+		}
+	})
+}
+
+func Test_writeParquet(t *testing.T) {
+	columns := []exportColumn{
+		{name: "time", typ: exportTime, required: true},
+		{name: "value", typ: exportInt},
+		{name: "ratio", typ: exportFloat},
+		{name: "label"},
+	}
+	var rows [][]interface{}
+	for i := 0; i < 20; i++ {
+		var row = []interface{}{time.Unix(1416605951, int64(i)*int64(time.Millisecond)).UTC(), nil, nil, nil}
+		if i%3 != 0 {
+			row[1] = int64(i - 10)
+		}
+		if i < 5 || i > 15 {
+			row[2] = float64(i) / 4
+		}
+		if i%2 == 0 {
+			row[3] = strings.Repeat("x", i)
+		}
+		rows = append(rows, row)
+	}
+
+	var buf bytes.Buffer
+	if err := writeParquet(&buf, columns, rows); err != nil {
+		t.Fatal(err)
+	}
+	gotColumns, gotRows, err := readParquet(buf.Bytes())
+	if err != nil {
+		t.Fatalf("readParquet() error = %v", err)
+	}
+	if !reflect.DeepEqual(gotColumns, columns) {
+		t.Errorf("columns = %v, want %v", gotColumns, columns)
+	}
+	if !reflect.DeepEqual(gotRows, rows) {
+		t.Errorf("rows = %v, want %v", gotRows, rows)
+	}
+}
+
+// thriftReader decodes the Thrift compact protocol into a map of field ids
+// to values for each struct, independently of thriftWriter.
+type thriftReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *thriftReader) byte() byte {
+	if r.pos >= len(r.b) {
+		panic("thrift: short buffer")
+	}
+	r.pos++
+	return r.b[r.pos-1]
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	var v uint64
+	for shift := uint(0); ; shift += 7 {
+		c := r.byte()
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return v
+		}
+	}
+}
+
+func (r *thriftReader) varint() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case 1, 2:
+		return typ == 1
+	case 3:
+		return int64(r.byte())
+	case 4, 5, 6:
+		return r.varint()
+	case 7:
+		v := r.b[r.pos : r.pos+8]
+		r.pos += 8
+		return math.Float64frombits(binary.LittleEndian.Uint64(v))
+	case 8:
+		n := int(r.uvarint())
+		v := string(r.b[r.pos : r.pos+n])
+		r.pos += n
+		return v
+	case 9:
+		h := r.byte()
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		var list []interface{}
+		for i := 0; i < n; i++ {
+			list = append(list, r.value(h&0x0f))
+		}
+		return list
+	case 12:
+		return r.structure()
+	}
+	panic(fmt.Sprintf("thrift: unknown type %d", typ))
+}
+
+func (r *thriftReader) structure() map[int64]interface{} {
+	var fields = make(map[int64]interface{})
+	var last int64
+	for {
+		h := r.byte()
+		if h == 0 {
+			return fields
+		}
+		id := last + int64(h>>4)
+		if h>>4 == 0 {
+			id = r.varint()
+		}
+		fields[id] = r.value(h & 0x0f)
+		last = id
+	}
+}
+
+// readParquet decodes a Parquet file of a single row group of uncompressed,
+// PLAIN encoded pages, as writeParquet writes, back into its columns and
+// rows.
+func readParquet(b []byte) (columns []exportColumn, rows [][]interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	if len(b) < 12 || string(b[:4]) != "PAR1" || string(b[len(b)-4:]) != "PAR1" {
+		return nil, nil, fmt.Errorf("no PAR1 magic")
+	}
+	n := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	footer := &thriftReader{b: b[:len(b)-8], pos: len(b) - 8 - n}
+	meta := footer.structure()
+	if footer.pos != len(b)-8 {
+		return nil, nil, fmt.Errorf("footer ends at %d, not %d", footer.pos, len(b)-8)
+	}
+
+	numRows := int(meta[3].(int64))
+	schema := meta[2].([]interface{})
+	groups := meta[4].([]interface{})
+	if len(groups) != 1 {
+		return nil, nil, fmt.Errorf("%d row groups", len(groups))
+	}
+	chunks := groups[0].(map[int64]interface{})[1].([]interface{})
+	if len(chunks) != len(schema)-1 || schema[0].(map[int64]interface{})[5].(int64) != int64(len(chunks)) {
+		return nil, nil, fmt.Errorf("%d column chunks for a schema of %d", len(chunks), len(schema))
+	}
+
+	rows = make([][]interface{}, numRows)
+	for i := range rows {
+		rows[i] = make([]interface{}, len(chunks))
+	}
+	for i, chunk := range chunks {
+		element := schema[i+1].(map[int64]interface{})
+		c := exportColumn{name: element[4].(string), required: element[3].(int64) == 0}
+		typ, converted := element[1].(int64), element[6]
+		switch {
+		case typ == 2 && converted == int64(9):
+			c.typ = exportTime
+		case typ == 2:
+			c.typ = exportInt
+		case typ == 5:
+			c.typ = exportFloat
+		case typ != 6 || converted != int64(0):
+			return nil, nil, fmt.Errorf("column %s has type %d converted %v", c.name, typ, converted)
+		}
+		columns = append(columns, c)
+
+		column := chunk.(map[int64]interface{})[3].(map[int64]interface{})
+		if column[5].(int64) != int64(numRows) {
+			return nil, nil, fmt.Errorf("column %s has %d values", c.name, column[5])
+		}
+		pages := &thriftReader{b: b, pos: int(column[9].(int64))}
+		header := pages.structure()
+		size := int(header[3].(int64))
+		if int64(pages.pos+size)-column[9].(int64) != column[6].(int64) {
+			return nil, nil, fmt.Errorf("column %s has a size of %d", c.name, column[6])
+		}
+		if data := header[5].(map[int64]interface{}); data[1].(int64) != int64(numRows) || data[2].(int64) != 0 {
+			return nil, nil, fmt.Errorf("column %s has a page of %d values encoded %d", c.name, data[1], data[2])
+		}
+		page := b[pages.pos : pages.pos+size]
+
+		var defined = make([]bool, numRows)
+		for j := range defined {
+			defined[j] = true
+		}
+		if !c.required {
+			levels := &thriftReader{b: page[4 : 4+binary.LittleEndian.Uint32(page)]}
+			defined = defined[:0]
+			for levels.pos < len(levels.b) {
+				h := levels.uvarint()
+				if h&1 != 0 {
+					return nil, nil, fmt.Errorf("column %s has bit-packed levels", c.name)
+				}
+				level := levels.byte()
+				for k := uint64(0); k < h>>1; k++ {
+					defined = append(defined, level == 1)
+				}
+			}
+			if len(defined) != numRows {
+				return nil, nil, fmt.Errorf("column %s has %d levels", c.name, len(defined))
+			}
+			page = page[4+len(levels.b):]
+		}
+
+		for j := range rows {
+			if !defined[j] {
+				continue
+			}
+			switch c.typ {
+			case exportTime:
+				rows[j][i] = time.Unix(0, int64(binary.LittleEndian.Uint64(page))*int64(time.Millisecond)).UTC()
+				page = page[8:]
+			case exportInt:
+				rows[j][i] = int64(binary.LittleEndian.Uint64(page))
+				page = page[8:]
+			case exportFloat:
+				rows[j][i] = math.Float64frombits(binary.LittleEndian.Uint64(page))
+				page = page[8:]
+			default:
+				l := binary.LittleEndian.Uint32(page)
+				rows[j][i] = string(page[4 : 4+l])
+				page = page[4+l:]
+			}
+		}
+		if len(page) != 0 {
+			return nil, nil, fmt.Errorf("column %s has %d bytes left over", c.name, len(page))
+		}
+	}
+	return columns, rows, nil
+}
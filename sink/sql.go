@@ -0,0 +1,222 @@
+package sink
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/bensallen/sqlios/nagios"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/lib/pq"
+)
+
+// SQLConfig configures a SQL sink.
+type SQLConfig struct {
+	// Driver is the database/sql driver name, postgres or sqlite3.
+	Driver string
+	// DSN is a connection string for postgres, or a file name for
+	// sqlite3.
+	DSN string
+	// Schema is JSONSchema, the default, or NormalizedSchema.
+	Schema string
+	// Table is the table of JSONSchema.
+	Table string
+}
+
+// jsonColumns are the columns of the table of JSONSchema, and of the
+// staging table it is merged from.
+var jsonColumns = []string{"time", "measurement", "tags", "fields", "record_key"}
+
+// createStageJSONSQL creates the staging table of JSONSchema in PostgreSQL,
+// once per connection. It is emptied by every commit.
+const createStageJSONSQL = `CREATE TEMP TABLE IF NOT EXISTS sqlios_stage_json (
+	time        TIMESTAMPTZ NOT NULL,
+	measurement TEXT NOT NULL,
+	tags        JSONB NOT NULL,
+	fields      JSONB NOT NULL,
+	record_key  TEXT NOT NULL
+) ON COMMIT DELETE ROWS`
+
+// SQL writes points to a SQL database, either to a single table with one
+// row per point and its tags and fields stored as JSON, or split into the
+// normalized schema. Either way it keeps the current_status table.
+type SQL struct {
+	conf    SQLConfig
+	db      *sql.DB
+	dialect *dialect
+	create  []string
+	// merge inserts the staged rows of JSONSchema into its table.
+	merge string
+	// normalized is set when writing the normalized schema.
+	normalized bool
+
+	mu      sync.Mutex
+	created bool
+	// upsertMu serializes the writes upserting rows, those of the
+	// normalized schema and of current_status.
+	upsertMu sync.Mutex
+}
+
+// NewSQL returns a SQL sink. The database isn't contacted until the first
+// write, which creates the tables if they don't exist, so SQLios can start
+// while the database is down.
+func NewSQL(conf SQLConfig) (*SQL, error) {
+	d, err := dialectOf(conf.Driver)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SQL{conf: conf, dialect: d}
+	switch conf.Schema {
+	case "", JSONSchema:
+		s.create = append(d.createJSON(conf.Table), d.migration("current_status").Up)
+		s.merge = fmt.Sprintf(d.mergeJSON, pq.QuoteIdentifier(conf.Table))
+	case NormalizedSchema:
+		s.normalized = true
+	default:
+		return nil, fmt.Errorf("unknown SQL schema: %s", conf.Schema)
+	}
+
+	db, err := sql.Open(conf.Driver, conf.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if d.maxOpenConns != 0 {
+		db.SetMaxOpenConns(d.maxOpenConns)
+	}
+	s.db = db
+	return s, nil
+}
+
+// createTable creates the tables on the first call that succeeds. The
+// normalized schema is migrated to the latest version known.
+func (s *SQL) createTable() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.created {
+		return nil
+	}
+	if s.normalized {
+		applied, err := MigrateUp(s.db, s.conf.Driver, 0)
+		if _, ok := err.(*UnknownSchemaError); ok {
+			// Not the fault of the points, which are held back to be
+			// written once the database is migrated back or SQLios
+			// upgraded, rather than dead-lettered
+			return Retryable(err)
+		} else if err != nil {
+			return classifySQL(err)
+		}
+		for _, m := range applied {
+			log.Printf("Applied migration %d %s", m.Version, m.Name)
+		}
+	}
+	for _, create := range s.create {
+		if _, err := s.db.Exec(create); err != nil {
+			return classifySQL(err)
+		}
+	}
+	s.created = true
+	return nil
+}
+
+// CheckSchema returns an UnknownSchemaError if the normalized schema was
+// migrated by a newer SQLios.
+func (s *SQL) CheckSchema() error {
+	if !s.normalized {
+		return nil
+	}
+	states, err := MigrationStatus(s.db, s.conf.Driver)
+	if err != nil {
+		return classifySQL(err)
+	}
+	return checkKnown(states)
+}
+
+// Name returns the sink's name
+func (s *SQL) Name() string {
+	if s.normalized {
+		return "sql:" + NormalizedSchema
+	}
+	return "sql:" + s.conf.Table
+}
+
+// Write copies points into staging tables and merges them into the
+// database in a single transaction. Points already written, with the same
+// nagios.Key, are skipped. Writes to the normalized schema are serialized,
+// so its dimension rows are upserted in order.
+func (s *SQL) Write(points []*client.Point) error {
+	if err := s.createTable(); err != nil {
+		return err
+	}
+	if s.normalized {
+		s.upsertMu.Lock()
+		defer s.upsertMu.Unlock()
+		return writeNormalized(s.db, s.dialect, points)
+	}
+
+	var rows = make([][]interface{}, 0, len(points))
+	for _, p := range points {
+		fields, err := p.Fields()
+		if err != nil {
+			return Rejected(err)
+		}
+		delete(fields, nagios.KeyField)
+		tagsJSON, err := json.Marshal(p.Tags())
+		if err != nil {
+			return Rejected(err)
+		}
+		fieldsJSON, err := json.Marshal(fields)
+		if err != nil {
+			return Rejected(err)
+		}
+		rows = append(rows, []interface{}{p.Time(), p.Name(), string(tagsJSON), string(fieldsJSON), nagios.Key(p)})
+	}
+
+	return inTx(s.db, func(tx *sql.Tx) error {
+		if err := s.dialect.stage(tx); err != nil {
+			return err
+		}
+		if err := s.dialect.load(tx, "sqlios_stage_json", jsonColumns, rows); err != nil {
+			return err
+		}
+		_, err := tx.Exec(s.merge)
+		return err
+	})
+}
+
+// classifySQL marks connection problems and transient server conditions, or
+// a busy or full SQLite database, as retryable, anything else is permanent.
+// Data exceptions and constraint violations are caused by the rows written,
+// other errors such as a missing table fail any write.
+func classifySQL(err error) error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*pq.Error); ok {
+		switch e.Code.Class() {
+		// connection_exception, transaction_rollback, insufficient_resources,
+		// operator_intervention, system_error
+		case "08", "40", "53", "57", "58":
+			return Retryable(err)
+		// data_exception, integrity_constraint_violation
+		case "22", "23":
+			return Rejected(err)
+		}
+		return Permanent(err)
+	}
+	if classified, ok := classifySQLite(err); ok {
+		return classified
+	}
+	if err == driver.ErrBadConn || IsRetryable(err) {
+		return Retryable(err)
+	}
+	return Permanent(err)
+}
+
+// Close closes the database connection
+func (s *SQL) Close() error {
+	return s.db.Close()
+}
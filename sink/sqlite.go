@@ -0,0 +1,209 @@
+package sink
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// sqliteDialect writes the same schema as PostgreSQL's to SQLite, a single
+// file needing no server, for analysis on a laptop and tests. It has
+// neither COPY nor DISTINCT ON, so rows are inserted into the staging
+// tables and the latest of several is picked with row_number(). SQLite
+// needs a WHERE clause on an INSERT ... SELECT with an ON CONFLICT clause.
+var sqliteDialect = &dialect{
+	migrations: mustLoadMigrations("migrations/sqlite"),
+	createMigrations: `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	name       TEXT NOT NULL,
+	applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`,
+	migrationsExist:   `SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations')`,
+	applied:           appliedSQL,
+	recordMigration:   recordMigrationSQL,
+	unrecordMigration: unrecordMigrationSQL,
+
+	createJSON: func(table string) []string {
+		return []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			time        TIMESTAMP NOT NULL,
+			measurement TEXT NOT NULL,
+			tags        TEXT NOT NULL,
+			fields      TEXT NOT NULL,
+			record_key  TEXT
+		)`, pq.QuoteIdentifier(table)),
+			fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (record_key)", pq.QuoteIdentifier(table+"_record_key_idx"), pq.QuoteIdentifier(table)),
+		}
+	},
+	mergeJSON: `INSERT INTO %s (time, measurement, tags, fields, record_key)
+	SELECT time, measurement, tags, fields, record_key FROM sqlios_stage_json WHERE true
+	ON CONFLICT (record_key) DO NOTHING`,
+
+	staging: []string{
+		`CREATE TEMP TABLE IF NOT EXISTS sqlios_stage_points (
+	time                TIMESTAMP NOT NULL,
+	instance            TEXT NOT NULL,
+	host_name           TEXT NOT NULL,
+	host_attributes     TEXT,
+	service_description TEXT,
+	check_command       TEXT,
+	service_attributes  TEXT,
+	has_result          BOOLEAN NOT NULL,
+	state               SMALLINT,
+	state_type          SMALLINT,
+	attempt             INTEGER,
+	output              TEXT,
+	latency             DOUBLE PRECISION,
+	execution_time      DOUBLE PRECISION,
+	fields              TEXT,
+	record_key          TEXT NOT NULL
+)`,
+		`CREATE TEMP TABLE IF NOT EXISTS sqlios_stage_perf (
+	time                TIMESTAMP NOT NULL,
+	instance            TEXT NOT NULL,
+	host_name           TEXT NOT NULL,
+	service_description TEXT,
+	label               TEXT NOT NULL,
+	value               DOUBLE PRECISION NOT NULL,
+	warn                DOUBLE PRECISION,
+	crit                DOUBLE PRECISION,
+	min                 DOUBLE PRECISION,
+	max                 DOUBLE PRECISION,
+	record_key          TEXT NOT NULL
+)`,
+		`CREATE TEMP TABLE IF NOT EXISTS sqlios_stage_status (
+	host_name           TEXT NOT NULL,
+	service_description TEXT NOT NULL,
+	state               SMALLINT NOT NULL,
+	state_type          SMALLINT NOT NULL,
+	output              TEXT NOT NULL,
+	last_check          TIMESTAMP,
+	acknowledged        BOOLEAN NOT NULL,
+	downtime_depth      INTEGER NOT NULL
+)`,
+		`CREATE TEMP TABLE IF NOT EXISTS sqlios_stage_json (
+	time        TIMESTAMP NOT NULL,
+	measurement TEXT NOT NULL,
+	tags        TEXT NOT NULL,
+	fields      TEXT NOT NULL,
+	record_key  TEXT NOT NULL
+)`,
+		// Temporary tables in SQLite keep their rows after a commit
+		`DELETE FROM sqlios_stage_points`,
+		`DELETE FROM sqlios_stage_perf`,
+		`DELETE FROM sqlios_stage_status`,
+		`DELETE FROM sqlios_stage_json`,
+	},
+
+	merge: []string{
+		`INSERT INTO hosts (instance, host_name, attributes)
+	SELECT instance, host_name, host_attributes FROM (
+		SELECT instance, host_name, host_attributes,
+			row_number() OVER (PARTITION BY instance, host_name ORDER BY time DESC) AS n
+		FROM sqlios_stage_points WHERE host_attributes IS NOT NULL
+	) WHERE n = 1
+	ON CONFLICT (instance, host_name) DO UPDATE
+	SET attributes = excluded.attributes, updated_at = CURRENT_TIMESTAMP
+	WHERE hosts.attributes IS NOT excluded.attributes`,
+
+		`INSERT INTO hosts (instance, host_name)
+	SELECT DISTINCT instance, host_name FROM sqlios_stage_points WHERE true
+	ON CONFLICT (instance, host_name) DO NOTHING`,
+
+		`INSERT INTO services (host_id, service_description, check_command, attributes)
+	SELECT host_id, service_description, check_command, service_attributes FROM (
+		SELECT h.host_id, s.service_description, COALESCE(s.check_command, '') AS check_command, s.service_attributes,
+			row_number() OVER (PARTITION BY h.host_id, s.service_description ORDER BY s.time DESC) AS n
+		FROM sqlios_stage_points s
+		JOIN hosts h ON h.instance = s.instance AND h.host_name = s.host_name
+		WHERE s.service_description IS NOT NULL
+	) WHERE n = 1
+	ON CONFLICT (host_id, service_description) DO UPDATE
+	SET check_command = COALESCE(NULLIF(excluded.check_command, ''), services.check_command),
+		attributes = excluded.attributes, updated_at = CURRENT_TIMESTAMP
+	WHERE (COALESCE(NULLIF(excluded.check_command, ''), services.check_command), excluded.attributes)
+		IS NOT (services.check_command, services.attributes)`,
+
+		`INSERT INTO perf_labels (label)
+	SELECT DISTINCT label FROM sqlios_stage_perf WHERE true
+	ON CONFLICT (label) DO NOTHING`,
+
+		`INSERT INTO check_results
+		(time, host_id, service_id, state, state_type, attempt, output, latency, execution_time, fields, record_key)
+	SELECT s.time, h.host_id, sv.service_id, s.state, s.state_type, s.attempt, s.output,
+		s.latency, s.execution_time, s.fields, s.record_key
+	FROM sqlios_stage_points s
+	JOIN hosts h ON h.instance = s.instance AND h.host_name = s.host_name
+	LEFT JOIN services sv ON sv.host_id = h.host_id AND sv.service_description = s.service_description
+	WHERE s.has_result
+	ON CONFLICT (record_key, time) DO NOTHING`,
+
+		`INSERT INTO perf_values
+		(time, host_id, service_id, label_id, value, warn, crit, min, max, record_key)
+	SELECT p.time, h.host_id, sv.service_id, l.label_id, p.value, p.warn, p.crit, p.min, p.max, p.record_key
+	FROM sqlios_stage_perf p
+	JOIN hosts h ON h.instance = p.instance AND h.host_name = p.host_name
+	LEFT JOIN services sv ON sv.host_id = h.host_id AND sv.service_description = p.service_description
+	JOIN perf_labels l ON l.label = p.label
+	WHERE true
+	ON CONFLICT (record_key, label_id, time) DO NOTHING`,
+	},
+
+	// A host or service listed twice is updated by its second row
+	upsertStatus: `INSERT INTO current_status
+	(instance, host_name, service_description, state, state_type, output, last_check, acknowledged, downtime_depth, updated_at)
+	SELECT $1, host_name, service_description, state, state_type, output, last_check, acknowledged, downtime_depth, $2
+	FROM sqlios_stage_status WHERE true
+	ON CONFLICT (instance, host_name, service_description) DO UPDATE
+	SET state = excluded.state, state_type = excluded.state_type, output = excluded.output,
+		last_check = excluded.last_check, acknowledged = excluded.acknowledged,
+		downtime_depth = excluded.downtime_depth, updated_at = excluded.updated_at
+	WHERE (current_status.state, current_status.state_type, current_status.output,
+		current_status.last_check, current_status.acknowledged, current_status.downtime_depth)
+	IS NOT (excluded.state, excluded.state_type, excluded.output,
+		excluded.last_check, excluded.acknowledged, excluded.downtime_depth)`,
+	deleteStatus: `DELETE FROM current_status
+	WHERE instance = $1
+	AND NOT EXISTS (
+		SELECT 1 FROM sqlios_stage_status s
+		WHERE s.host_name = current_status.host_name AND s.service_description = current_status.service_description
+	)`,
+
+	load: insertRows,
+	// A single writer, so writes wait for each other rather than failing
+	// with SQLITE_BUSY
+	maxOpenConns: 1,
+}
+
+// insertRows inserts rows into table with a prepared statement. Times are
+// stored in UTC so they sort as text.
+func insertRows(tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	var params = make([]string, len(columns))
+	for i := range params {
+		params[i] = "?"
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", pq.QuoteIdentifier(table), strings.Join(columns, ", "), strings.Join(params, ", ")))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	var values = make([]interface{}, len(columns))
+	for _, row := range rows {
+		for i, v := range row {
+			if t, ok := v.(time.Time); ok {
+				v = t.UTC()
+			}
+			values[i] = v
+		}
+		if _, err := stmt.Exec(values...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
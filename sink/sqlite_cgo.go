@@ -0,0 +1,28 @@
+//go:build cgo
+// +build cgo
+
+package sink
+
+import "github.com/mattn/go-sqlite3"
+
+// The SQLite driver is only built with cgo.
+func init() {
+	dialects["sqlite3"] = sqliteDialect
+}
+
+// classifySQLite marks a busy, locked or full SQLite database as retryable,
+// and rows violating a constraint or of the wrong type or size as rejected.
+// ok is false if err isn't from SQLite.
+func classifySQLite(err error) (classified error, ok bool) {
+	e, ok := err.(sqlite3.Error)
+	if !ok {
+		return nil, false
+	}
+	switch e.Code {
+	case sqlite3.ErrBusy, sqlite3.ErrLocked, sqlite3.ErrIoErr, sqlite3.ErrFull:
+		return Retryable(err), true
+	case sqlite3.ErrConstraint, sqlite3.ErrMismatch, sqlite3.ErrTooBig:
+		return Rejected(err), true
+	}
+	return Permanent(err), true
+}
@@ -0,0 +1,10 @@
+//go:build !cgo
+// +build !cgo
+
+package sink
+
+// Without cgo there is no SQLite driver, so the sqlite3 dialect isn't
+// registered and no error comes from SQLite.
+func classifySQLite(err error) (classified error, ok bool) {
+	return nil, false
+}
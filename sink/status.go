@@ -0,0 +1,91 @@
+package sink
+
+import (
+	"database/sql"
+
+	"github.com/bensallen/sqlios/nagios"
+)
+
+// stageStatusColumns are the columns of the staging table current_status is
+// merged from.
+var stageStatusColumns = []string{"host_name", "service_description", "state", "state_type",
+	"output", "last_check", "acknowledged", "downtime_depth"}
+
+const (
+	// createStageStatusSQL and the statements merging it are PostgreSQL's.
+	createStageStatusSQL = `CREATE TEMP TABLE IF NOT EXISTS sqlios_stage_status (
+	host_name           TEXT NOT NULL,
+	service_description TEXT NOT NULL,
+	state               SMALLINT NOT NULL,
+	state_type          SMALLINT NOT NULL,
+	output              TEXT NOT NULL,
+	last_check          TIMESTAMPTZ,
+	acknowledged        BOOLEAN NOT NULL,
+	downtime_depth      INTEGER NOT NULL
+) ON COMMIT DELETE ROWS`
+
+	// upsertStatusSQL merges the staged rows into current_status, only
+	// updating those that changed. A host or service listed twice, which
+	// Nagios doesn't do, is only written once.
+	upsertStatusSQL = `INSERT INTO current_status
+	(instance, host_name, service_description, state, state_type, output, last_check, acknowledged, downtime_depth, updated_at)
+	SELECT DISTINCT ON (host_name, service_description)
+		$1, host_name, service_description, state, state_type, output, last_check, acknowledged, downtime_depth, $2
+	FROM sqlios_stage_status
+	ORDER BY host_name, service_description
+	ON CONFLICT (instance, host_name, service_description) DO UPDATE
+	SET state = EXCLUDED.state, state_type = EXCLUDED.state_type, output = EXCLUDED.output,
+		last_check = EXCLUDED.last_check, acknowledged = EXCLUDED.acknowledged,
+		downtime_depth = EXCLUDED.downtime_depth, updated_at = EXCLUDED.updated_at
+	WHERE (current_status.state, current_status.state_type, current_status.output,
+		current_status.last_check, current_status.acknowledged, current_status.downtime_depth)
+	IS DISTINCT FROM (EXCLUDED.state, EXCLUDED.state_type, EXCLUDED.output,
+		EXCLUDED.last_check, EXCLUDED.acknowledged, EXCLUDED.downtime_depth)`
+
+	// deleteStatusSQL deletes the hosts and services of an instance missing
+	// from the staged rows.
+	deleteStatusSQL = `DELETE FROM current_status c
+	WHERE c.instance = $1
+	AND NOT EXISTS (
+		SELECT 1 FROM sqlios_stage_status s
+		WHERE s.host_name = c.host_name AND s.service_description = c.service_description
+	)`
+)
+
+// stageStatus converts status into rows of the staging table.
+func stageStatus(status *nagios.CurrentStatus) [][]interface{} {
+	var rows = make([][]interface{}, 0, len(status.Statuses))
+	for _, st := range status.Statuses {
+		var lastCheck interface{}
+		if !st.LastCheck.IsZero() {
+			lastCheck = st.LastCheck
+		}
+		rows = append(rows, []interface{}{st.HostName, st.ServiceDescription, st.State, st.StateType,
+			st.Output, lastCheck, st.Acknowledged, st.DowntimeDepth})
+	}
+	return rows
+}
+
+// WriteStatus replaces the rows of the instance in current_status with
+// status in a single transaction. Only rows that changed are updated.
+func (s *SQL) WriteStatus(status *nagios.CurrentStatus) error {
+	if err := s.createTable(); err != nil {
+		return err
+	}
+	s.upsertMu.Lock()
+	defer s.upsertMu.Unlock()
+
+	return inTx(s.db, func(tx *sql.Tx) error {
+		if err := s.dialect.stage(tx); err != nil {
+			return err
+		}
+		if err := s.dialect.load(tx, "sqlios_stage_status", stageStatusColumns, stageStatus(status)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(s.dialect.upsertStatus, status.Instance, status.Created.UTC()); err != nil {
+			return err
+		}
+		_, err := tx.Exec(s.dialect.deleteStatus, status.Instance)
+		return err
+	})
+}
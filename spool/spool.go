@@ -0,0 +1,392 @@
+package spool
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentSuffix = ".seg"
+	cursorFile    = "cursor"
+	headerSize    = 8
+)
+
+// Options controls how large and how old the spool is allowed to grow.
+type Options struct {
+	// SegmentSize is the size in bytes at which the current segment is
+	// closed and a new one started.
+	SegmentSize int64
+	// MaxSize is the total size in bytes of all segments. When exceeded the
+	// oldest segments are dropped, even if they have not been read. Zero
+	// means unbounded.
+	MaxSize int64
+	// MaxAge is how long a segment is kept after it was last written to.
+	// Zero means segments never expire.
+	MaxAge time.Duration
+}
+
+// DefaultOptions are the limits of a spool when none are configured. Open
+// only takes the SegmentSize of a zero SegmentSize from them, a zero MaxSize
+// or MaxAge leaves the spool unbounded.
+var DefaultOptions = Options{
+	SegmentSize: 16 << 20,
+	MaxSize:     1 << 30,
+	MaxAge:      24 * time.Hour,
+}
+
+// Position is a location within the spool, the segment ID and the byte
+// offset of the next record in that segment.
+type Position struct {
+	Segment uint64
+	Offset  int64
+}
+
+type segment struct {
+	id      uint64
+	size    int64
+	modTime time.Time
+}
+
+// Spool is an on-disk, segment based FIFO queue of records. Records are
+// appended to the newest segment and read back in order from a persisted
+// cursor, so a restarted process resumes where the last one left off.
+// A Spool supports many writers but only a single reader.
+type Spool struct {
+	dir  string
+	opts Options
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	segments []segment
+	w        *os.File
+	cursor   Position
+	closed   bool
+	dropped  int64
+}
+
+// Open opens or creates a spool in dir.
+func Open(dir string, opts Options) (*Spool, error) {
+	if opts.SegmentSize == 0 {
+		opts.SegmentSize = DefaultOptions.SegmentSize
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, opts: opts}
+	s.cond = sync.NewCond(&s.mu)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(fi.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, segment{id, fi.Size(), fi.ModTime()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+
+	if err := s.loadCursor(); err != nil {
+		return nil, err
+	}
+
+	// Always start writing into a fresh segment, a previous process may have
+	// left a torn record at the end of the last one.
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	s.enforce()
+
+	return s, nil
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d%s", id, segmentSuffix))
+}
+
+func (s *Spool) loadCursor() error {
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, cursorFile))
+	if os.IsNotExist(err) {
+		if len(s.segments) > 0 {
+			s.cursor = Position{Segment: s.segments[0].id}
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err = fmt.Sscanf(string(b), "%d %d", &s.cursor.Segment, &s.cursor.Offset)
+	if err != nil {
+		return fmt.Errorf("spool: corrupt cursor file in %s: %s", s.dir, err)
+	}
+	return nil
+}
+
+func (s *Spool) saveCursor() error {
+	tmp := filepath.Join(s.dir, cursorFile+".tmp")
+	err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", s.cursor.Segment, s.cursor.Offset)), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, cursorFile))
+}
+
+// rotate closes the current write segment and starts a new one. The caller
+// must hold s.mu or be the only user of s.
+func (s *Spool) rotate() error {
+	var id uint64 = 1
+	if n := len(s.segments); n > 0 {
+		id = s.segments[n-1].id + 1
+	}
+	if s.w != nil {
+		if err := s.w.Close(); err != nil {
+			return err
+		}
+	}
+	w, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.w = w
+	s.segments = append(s.segments, segment{id: id, modTime: time.Now()})
+	if s.cursor.Segment == 0 {
+		s.cursor = Position{Segment: id}
+	}
+	return nil
+}
+
+// enforce drops the oldest closed segments until the spool is within its
+// size and age limits. The caller must hold s.mu.
+func (s *Spool) enforce() {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	for len(s.segments) > 1 {
+		oldest := s.segments[0]
+		tooBig := s.opts.MaxSize > 0 && total > s.opts.MaxSize
+		tooOld := s.opts.MaxAge > 0 && time.Since(oldest.modTime) > s.opts.MaxAge
+		consumed := oldest.id < s.cursor.Segment
+		if !tooBig && !tooOld && !consumed {
+			return
+		}
+		if !consumed {
+			s.dropped++
+			log.Printf("Warning, spool: dropping unsent segment %d (%d bytes) from %s", oldest.id, oldest.size, s.dir)
+			s.cursor = Position{Segment: s.segments[1].id}
+			s.saveCursor()
+		}
+		os.Remove(s.segmentPath(oldest.id))
+		total -= oldest.size
+		s.segments = s.segments[1:]
+	}
+}
+
+// Append writes a record to the end of the spool.
+func (s *Spool) Append(rec []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("spool: append to closed spool %s", s.dir)
+	}
+
+	cur := &s.segments[len(s.segments)-1]
+	if cur.size >= s.opts.SegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		cur = &s.segments[len(s.segments)-1]
+	}
+
+	buf := make([]byte, headerSize+len(rec))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(rec)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(rec))
+	copy(buf[headerSize:], rec)
+
+	n, err := s.w.Write(buf)
+	cur.size += int64(n)
+	cur.modTime = time.Now()
+	if err != nil {
+		return err
+	}
+	s.enforce()
+	s.cond.Broadcast()
+	return nil
+}
+
+// Read blocks until at least one record is available after the cursor, then
+// returns up to max records and the position following the last of them.
+// Records are not removed until the returned position is passed to Commit,
+// so calling Read again without a Commit returns the same records. Read
+// returns io.EOF once the spool is closed and fully read.
+func (s *Spool) Read(max int) ([][]byte, Position, error) {
+	return s.ReadContext(context.Background(), max)
+}
+
+// ReadContext is Read, but stops waiting for records once ctx is done and
+// returns its error.
+func (s *Spool) ReadContext(ctx context.Context, max int) ([][]byte, Position, error) {
+	// Wake the wait below when ctx is done
+	var done = make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		recs, pos, err := s.read(max)
+		if err != nil || len(recs) > 0 {
+			return recs, pos, err
+		}
+		if s.closed {
+			return nil, pos, io.EOF
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, pos, err
+		}
+		s.cond.Wait()
+	}
+}
+
+// read reads records from the cursor onwards. The caller must hold s.mu.
+func (s *Spool) read(max int) ([][]byte, Position, error) {
+	var recs [][]byte
+	pos := s.cursor
+
+	for i, seg := range s.segments {
+		if seg.id < pos.Segment {
+			continue
+		}
+		if seg.id > pos.Segment {
+			pos = Position{Segment: seg.id}
+		}
+		if pos.Offset < seg.size {
+			f, err := os.Open(s.segmentPath(seg.id))
+			if err != nil {
+				return nil, s.cursor, err
+			}
+			recs, pos = readSegment(f, recs, pos, seg.size, max)
+			f.Close()
+		}
+		if len(recs) >= max || i == len(s.segments)-1 {
+			break
+		}
+	}
+	return recs, pos, nil
+}
+
+// readSegment appends records from f starting at pos to recs. A short or
+// corrupt record is treated as the end of the segment.
+func readSegment(f *os.File, recs [][]byte, pos Position, size int64, max int) ([][]byte, Position) {
+	if _, err := f.Seek(pos.Offset, io.SeekStart); err != nil {
+		return recs, pos
+	}
+	header := make([]byte, headerSize)
+	for len(recs) < max && pos.Offset < size {
+		if _, err := io.ReadFull(f, header); err != nil {
+			pos.Offset = size
+			break
+		}
+		rec := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(f, rec); err != nil || crc32.ChecksumIEEE(rec) != binary.BigEndian.Uint32(header[4:8]) {
+			log.Printf("Warning, spool: corrupt record in segment %d at offset %d, skipping rest of segment", pos.Segment, pos.Offset)
+			pos.Offset = size
+			break
+		}
+		recs = append(recs, rec)
+		pos.Offset += int64(headerSize + len(rec))
+	}
+	return recs, pos
+}
+
+// Commit marks all records before pos as processed, persisting the cursor
+// and removing fully consumed segments.
+func (s *Spool) Commit(pos Position) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The segment may have been dropped by enforce while the caller held
+	// the records, never move the cursor backwards.
+	if pos.Segment < s.cursor.Segment || (pos.Segment == s.cursor.Segment && pos.Offset < s.cursor.Offset) {
+		return nil
+	}
+	s.cursor = pos
+	if err := s.saveCursor(); err != nil {
+		return err
+	}
+	s.enforce()
+	return nil
+}
+
+// Len returns the number of bytes in the spool that have not been committed.
+func (s *Spool) Len() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for _, seg := range s.segments {
+		if seg.id > s.cursor.Segment {
+			n += seg.size
+		} else if seg.id == s.cursor.Segment {
+			n += seg.size - s.cursor.Offset
+		}
+	}
+	return n
+}
+
+// Dropped returns the number of unsent segments discarded because the spool
+// exceeded its size or age limits.
+func (s *Spool) Dropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Closed reports whether Close has been called.
+func (s *Spool) Closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Close stops the spool accepting new records. Pending Read calls return the
+// remaining records and then io.EOF.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.cond.Broadcast()
+	return s.w.Close()
+}
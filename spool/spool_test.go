@@ -0,0 +1,160 @@
+package spool
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func tempSpool(t *testing.T, opts Options) (*Spool, string) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func appendAll(t *testing.T, s *Spool, recs ...string) {
+	for _, rec := range recs {
+		if err := s.Append([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func toStrings(recs [][]byte) []string {
+	var out []string
+	for _, rec := range recs {
+		out = append(out, string(rec))
+	}
+	return out
+}
+
+func TestSpool_ReadCommit(t *testing.T) {
+	s, dir := tempSpool(t, Options{SegmentSize: 16})
+	defer os.RemoveAll(dir)
+
+	appendAll(t, s, "one", "two", "three", "four")
+
+	recs, pos, err := s.Read(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"one", "two", "three"}; !reflect.DeepEqual(toStrings(recs), want) {
+		t.Errorf("Read() = %v, want %v", toStrings(recs), want)
+	}
+
+	// Without a commit the same records are returned again.
+	recs, pos, _ = s.Read(3)
+	if len(recs) != 3 || string(recs[0]) != "one" {
+		t.Errorf("Read() without Commit = %v, want to start at one", toStrings(recs))
+	}
+
+	if err := s.Commit(pos); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	recs, _, err = s.Read(3)
+	if want := []string{"four"}; err != nil || !reflect.DeepEqual(toStrings(recs), want) {
+		t.Errorf("Read() after Commit = %v, %v, want %v", toStrings(recs), err, want)
+	}
+}
+
+func TestSpool_ReadContext(t *testing.T) {
+	s, dir := tempSpool(t, Options{})
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	// An empty spool waits for records until ctx is done
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, _, err := s.ReadContext(ctx, 1); err != context.Canceled {
+		t.Errorf("ReadContext() error = %v, want %v", err, context.Canceled)
+	}
+
+	// Records already there are returned even so
+	appendAll(t, s, "one")
+	recs, _, err := s.ReadContext(ctx, 1)
+	if want := []string{"one"}; err != nil || !reflect.DeepEqual(toStrings(recs), want) {
+		t.Errorf("ReadContext() = %v, %v, want %v", toStrings(recs), err, want)
+	}
+}
+
+func TestSpool_Reopen(t *testing.T) {
+	s, dir := tempSpool(t, Options{SegmentSize: 16})
+	defer os.RemoveAll(dir)
+
+	appendAll(t, s, "one", "two", "three")
+	_, pos, _ := s.Read(1)
+	s.Commit(pos)
+	s.Close()
+
+	s, err := Open(dir, Options{SegmentSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, s, "four")
+	s.Close()
+
+	var got []string
+	for {
+		recs, pos, err := s.Read(10)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, toStrings(recs)...)
+		s.Commit(pos)
+	}
+	if want := []string{"two", "three", "four"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Read() after reopen = %v, want %v", got, want)
+	}
+}
+
+func TestSpool_Limits(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{
+			name: "Unbounded",
+			opts: Options{SegmentSize: 1},
+			want: []string{"one", "two", "three"},
+		},
+		{
+			name: "MaxSize",
+			opts: Options{SegmentSize: 1, MaxSize: 24},
+			want: []string{"two", "three"},
+		},
+		{
+			name: "MaxAge",
+			opts: Options{SegmentSize: 1, MaxAge: time.Nanosecond},
+			want: []string{"three"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, dir := tempSpool(t, tt.opts)
+			defer os.RemoveAll(dir)
+
+			appendAll(t, s, "one", "two", "three")
+			s.Close()
+
+			recs, _, err := s.Read(10)
+			if err != nil || !reflect.DeepEqual(toStrings(recs), tt.want) {
+				t.Errorf("Read() = %v, %v, want %v", toStrings(recs), err, tt.want)
+			}
+		})
+	}
+}
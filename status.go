@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bensallen/sqlios/nagios"
+)
+
+// The error rate on /status is measured over errorRateWindow, sampled every
+// errorRateInterval.
+const (
+	errorRateInterval = 10 * time.Second
+	errorRateWindow   = 5 * time.Minute
+)
+
+// status is the summary served on /status, and read by sqlios check.
+type status struct {
+	// LastCreated is the created time of the newest status.dat read, and
+	// LastRead when it was read, both in Unix seconds. Zero until the first
+	// file is read.
+	LastCreated int64 `json:"last_created"`
+	LastRead    int64 `json:"last_read"`
+	// Backlog is the number of bytes waiting in every spool.
+	Backlog int64 `json:"backlog"`
+	// ErrorRate is the fraction of writes to sinks that failed over the last
+	// errorRateWindow.
+	ErrorRate   float64               `json:"error_rate"`
+	ParseErrors int64                 `json:"parse_errors"`
+	Sinks       map[string]sinkStatus `json:"sinks"`
+}
+
+type sinkStatus struct {
+	Backlog       int64  `json:"backlog"`
+	PointsWritten int64  `json:"points_written"`
+	WriteErrors   int64  `json:"write_errors"`
+	LastError     string `json:"last_error,omitempty"`
+}
+
+// errorRate tracks the fraction of failed sink writes over a sliding window.
+type errorRate struct {
+	mu      sync.Mutex
+	samples []rateSample
+}
+
+type rateSample struct {
+	writes, errors int64
+}
+
+func currentRateSample() rateSample {
+	return rateSample{writes: int64(sinkLatency.Count()), errors: sinkErrors.Sum()}
+}
+
+// run samples the write and error counters for the life of the process.
+func (r *errorRate) run() {
+	r.sample()
+	for range time.Tick(errorRateInterval) {
+		r.sample()
+	}
+}
+
+func (r *errorRate) sample() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.samples = append(r.samples, currentRateSample())
+	if max := int(errorRateWindow / errorRateInterval); len(r.samples) > max {
+		r.samples = r.samples[len(r.samples)-max:]
+	}
+}
+
+// rate returns the fraction of writes that failed since the oldest sample.
+func (r *errorRate) rate() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.samples) == 0 {
+		return 0
+	}
+	oldest, now := r.samples[0], currentRateSample()
+	writes := now.writes - oldest.writes
+	if writes <= 0 {
+		return 0
+	}
+	return float64(now.errors-oldest.errors) / float64(writes)
+}
+
+// status collects the current status of the pipeline.
+func (s *supervisor) status(rate *errorRate) status {
+	st := status{
+		ErrorRate:   rate.rate(),
+		ParseErrors: nagios.ParseErrors(),
+		Sinks:       make(map[string]sinkStatus),
+	}
+	if t := nagios.LastCreated(); !t.IsZero() {
+		st.LastCreated = t.Unix()
+	}
+	if t := nagios.LastRead(); !t.IsZero() {
+		st.LastRead = t.Unix()
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for name, o := range s.outputs {
+		ss := sinkStatus{
+			PointsWritten: sinkPoints.With(name).Value(),
+			WriteErrors:   sinkErrors.With(name).Value(),
+		}
+		if o.spool != nil {
+			ss.Backlog = o.spool.Len()
+		}
+		if err := o.err(); err != nil {
+			ss.LastError = err.Error()
+		}
+		st.Backlog += ss.Backlog
+		st.Sinks[name] = ss
+	}
+	return st
+}
+
+// statusHandler serves the status of sup as JSON.
+func statusHandler(sup *supervisor, rate *errorRate) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sup.status(rate))
+	})
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/bensallen/sqlios/config"
+	"github.com/bensallen/sqlios/fswatch"
+	"github.com/bensallen/sqlios/nagios"
+	"github.com/bensallen/sqlios/sink"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// supervisor owns the inputs and outputs of a running pipeline, and starts
+// and stops them as the configuration changes. The block parsers and
+// Uploaders between them are shared and keep running across reloads.
+type supervisor struct {
+	// ctx is the parent of every input, drainCtx of every output.
+	ctx      context.Context
+	drainCtx context.Context
+
+	blockc    chan nagios.Block
+	endOfFile chan bool
+	errc      chan error
+
+	rules      *nagios.RuleSet
+	schema     *nagios.Schema
+	deadLetter *sink.DeadLetter
+
+	// cfg, inputs and checkpoints are only used by the goroutine calling
+	// apply. outputs is also read by the Uploaders through write.
+	cfg     *config.Config
+	inputs  map[string]*runningInput
+	mu      sync.RWMutex
+	outputs map[string]*output
+	started bool
+	// checkpoints outlive the inputs they belong to, so an input restarted
+	// by a reload carries on without uploading duplicates.
+	checkpoints map[string]*nagios.Checkpoint
+}
+
+// runningInput is a running Reader and Watcher for one config.Input.
+type runningInput struct {
+	conf   config.Input
+	cancel context.CancelFunc
+	done   chan struct{}
+	// start starts the input, close closes one that was never started.
+	start func()
+	close func()
+}
+
+func newSupervisor(ctx, drainCtx context.Context, blockc chan nagios.Block, endOfFile chan bool, errc chan error, deadLetter *sink.DeadLetter) *supervisor {
+	return &supervisor{
+		ctx:         ctx,
+		drainCtx:    drainCtx,
+		blockc:      blockc,
+		endOfFile:   endOfFile,
+		errc:        errc,
+		rules:       nagios.NewRuleSet(nil),
+		schema:      nagios.NewSchema(),
+		deadLetter:  deadLetter,
+		inputs:      make(map[string]*runningInput),
+		outputs:     make(map[string]*output),
+		checkpoints: make(map[string]*nagios.Checkpoint),
+	}
+}
+
+// apply brings the running inputs and outputs in line with cfg. Only those
+// whose configuration changed are replaced. The new ones are all created
+// before any running one is stopped, so if any fails to start the running
+// configuration is kept as it was.
+func (s *supervisor) apply(cfg *config.Config) error {
+	if err := s.start(cfg); err != nil {
+		return err
+	}
+	s.cfg = cfg
+	return nil
+}
+
+// start creates the inputs and outputs of cfg that differ from those
+// running, or aren't running, then swaps them in and stops those they
+// replace and those cfg has no more.
+func (s *supervisor) start(cfg *config.Config) error {
+	rules, err := newRules(cfg, s.schema)
+	if err != nil {
+		return err
+	}
+
+	old := s.cfg
+	if old != nil && old.DeadLetter != cfg.DeadLetter {
+		log.Printf("Warning, dead_letter changed from %s to %s, this requires a restart", old.DeadLetter, cfg.DeadLetter)
+	}
+	if old != nil && old.Batch != cfg.Batch {
+		log.Printf("Warning, batch changed from %+v to %+v, this requires a restart", old.Batch, cfg.Batch)
+	}
+	if old != nil && old.Listen != cfg.Listen {
+		log.Printf("Warning, listen changed from %s to %s, this requires a restart", old.Listen, cfg.Listen)
+	}
+
+	var outputs = make(map[string]*output)
+	var inputs = make(map[string]*runningInput)
+	closeNew := func() {
+		for _, in := range inputs {
+			in.close()
+		}
+		for _, o := range outputs {
+			o.halt()
+		}
+	}
+
+	var wanted = make(map[string]config.Sink, len(cfg.Sinks))
+	for _, conf := range cfg.Sinks {
+		wanted[conf.Name] = conf
+		// Spool and retry settings are part of every output.
+		if o, ok := s.outputs[conf.Name]; ok && reflect.DeepEqual(conf, o.conf) && reflect.DeepEqual(cfg.Spool, o.spoolConf) && reflect.DeepEqual(cfg.Retry, o.retryConf) {
+			continue
+		}
+		o, err := newOutput(s.drainCtx, cfg, conf, s.deadLetter)
+		if err != nil {
+			closeNew()
+			return fmt.Errorf("sink %s: %s", conf.Name, err)
+		}
+		outputs[conf.Name] = o
+		// A spool still open by the output being replaced is handed over
+		if running, ok := s.outputs[conf.Name]; ok && running.spoolPath() == o.spoolPath() {
+			continue
+		}
+		if err := o.openSpool(); err != nil {
+			closeNew()
+			return fmt.Errorf("sink %s: %s", conf.Name, err)
+		}
+	}
+
+	var wantedInputs = make(map[string]config.Input, len(cfg.Inputs))
+	for _, conf := range cfg.Inputs {
+		wantedInputs[conf.Name] = conf
+		if in, ok := s.inputs[conf.Name]; ok && reflect.DeepEqual(conf, in.conf) {
+			continue
+		}
+		in, err := s.newInput(conf)
+		if err != nil {
+			closeNew()
+			return fmt.Errorf("input %s: %s", conf.Path, err)
+		}
+		inputs[conf.Name] = in
+	}
+
+	// Everything new has started, replace the running configuration
+	s.rules.Store(rules)
+	for name, in := range s.inputs {
+		if _, ok := inputs[name]; !ok {
+			if _, ok := wantedInputs[name]; ok {
+				continue
+			}
+		}
+		log.Printf("Stopping input %s", in.conf.Path)
+		in.cancel()
+		<-in.done
+		delete(s.inputs, name)
+		s.saveCheckpoint(in.conf)
+	}
+
+	var stopped []*output
+	s.mu.Lock()
+	for name, o := range s.outputs {
+		if _, ok := outputs[name]; !ok {
+			if _, ok := wanted[name]; ok {
+				continue
+			}
+		}
+		log.Printf("Stopping sink %s", name)
+		delete(s.outputs, name)
+		if n, ok := outputs[name]; ok && n.spool == nil && n.spoolPath() != "" {
+			// Halted rather than drained, the replacement takes over
+			// the spool
+			if err := o.halt(); err != nil {
+				s.errc <- err
+			}
+			continue
+		}
+		stopped = append(stopped, o)
+	}
+	for name, o := range outputs {
+		if o.spool == nil && o.spoolPath() != "" {
+			if err := o.openSpool(); err != nil {
+				// The spool was open until just now, so this is a
+				// failing disk rather than a bad configuration
+				s.errc <- fmt.Errorf("sink %s: %s, writing without a spool", name, err)
+			}
+		}
+		log.Printf("Starting sink %s", name)
+		o.run(s.deadLetter, s.errc)
+		s.outputs[name] = o
+	}
+	s.started = true
+	s.mu.Unlock()
+
+	for name, in := range inputs {
+		log.Printf("Starting input %s", in.conf.Path)
+		in.start()
+		s.inputs[name] = in
+	}
+
+	// Outputs replaced or removed drain their spools to the old sinks
+	for _, o := range stopped {
+		if err := o.stop(); err != nil {
+			s.errc <- err
+		}
+		if n, ok := s.outputs[o.conf.Name]; !ok || n.spool == nil {
+			spoolBytes.Delete(o.conf.Name)
+		}
+	}
+	return nil
+}
+
+// ready returns an error unless the pipeline is running and the last write
+// to every sink succeeded.
+func (s *supervisor) ready() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.started {
+		return fmt.Errorf("not started")
+	}
+	for name, o := range s.outputs {
+		if err := o.err(); err != nil {
+			return fmt.Errorf("sink %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// newInput returns the input for conf, having opened what it reads from.
+// Started, a status input runs a Reader, and a Watcher unless running once.
+func (s *supervisor) newInput(conf config.Input) (*runningInput, error) {
+	switch conf.Type {
+	case config.PerfdataInput, config.CheckResultInput:
+		return s.newSpoolInput(conf)
+	case config.LogInput:
+		return s.newLogInput(conf)
+	}
+
+	file, err := os.Open(conf.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint, ok := s.checkpoints[conf.Name]
+	if !ok {
+		checkpoint, err = nagios.LoadCheckpoint(conf.Checkpoint)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		s.checkpoints[conf.Name] = checkpoint
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	in := &runningInput{conf: conf, cancel: cancel, done: make(chan struct{})}
+	in.close = func() {
+		cancel()
+		file.Close()
+	}
+	in.start = func() { s.runInput(ctx, in, file, checkpoint) }
+	return in, nil
+}
+
+// runInput runs the Reader and Watcher of a status input, file being the
+// status.dat opened when it was created.
+func (s *supervisor) runInput(ctx context.Context, in *runningInput, file *os.File, checkpoint *nagios.Checkpoint) {
+	conf := in.conf
+
+	var filec = make(chan io.ReadCloser, 10)
+	var statusc = make(chan *nagios.CurrentStatus, 1)
+	var readerDone = make(chan struct{})
+	var statusDone = make(chan struct{})
+	go func() {
+		nagios.Reader(ctx, checkpoint, inputTags(conf), s.blockc, filec, s.endOfFile, statusc, s.errc)
+		close(readerDone)
+	}()
+	go func() {
+		// The checkpoint is saved as each file is read, a file behind so
+		// the points of the last one have had time to be batched and
+		// spooled by the outputs.
+		var previous int64
+		for status := range statusc {
+			if previous != 0 && conf.Checkpoint != "" {
+				if err := (&nagios.Checkpoint{Created: previous}).Save(conf.Checkpoint); err != nil {
+					log.Printf("Error, saving checkpoint: %s", err)
+				}
+			}
+			previous = status.Created.Unix()
+			s.saveSchema()
+			s.writeStatus(status.Filter(s.rules.Load()))
+		}
+		close(statusDone)
+	}()
+
+	if conf.OnStart || *oneshot {
+		filec <- file
+	} else {
+		file.Close()
+	}
+
+	go func() {
+		if !*oneshot {
+			switch conf.Watch {
+			case config.PollWatch:
+				fswatch.Poller(ctx, &conf.Path, conf.PollInterval, filec, s.errc)
+			case config.NotifyWatch:
+				fswatch.Watcher(ctx, &conf.Path, 0, filec, s.errc)
+			default:
+				fswatch.Watcher(ctx, &conf.Path, conf.PollInterval, filec, s.errc)
+			}
+		}
+		//Close filec so Reader will exit
+		close(filec)
+		<-readerDone
+		close(statusc)
+		<-statusDone
+		close(in.done)
+	}()
+}
+
+// newSpoolInput returns an input claiming the files in the perfdata or check
+// result spool directory of conf one at a time. Each is written straight to
+// the sinks rather than through the Uploaders, so it is only acknowledged
+// once every sink has taken it. A file released after a failure is only
+// written again to the sinks that didn't take it.
+func (s *supervisor) newSpoolInput(conf config.Input) (*runningInput, error) {
+	spool := &fswatch.SpoolDir{
+		Dir:        conf.Path,
+		WorkDir:    conf.WorkDir,
+		ArchiveDir: conf.ArchiveDir,
+		Interval:   conf.PollInterval,
+		Poll:       conf.Watch == config.PollWatch,
+		Once:       *oneshot,
+	}
+	if conf.Type == config.CheckResultInput {
+		spool.Ready = ".ok"
+	}
+	if err := spool.Init(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	in := &runningInput{conf: conf, cancel: cancel, done: make(chan struct{}), close: cancel}
+	in.start = func() {
+		var claimc = make(chan *fswatch.Claim)
+		go spool.Run(ctx, claimc, s.errc)
+		go s.runSpoolInput(in, spool, claimc)
+	}
+	return in, nil
+}
+
+// runSpoolInput processes the files claimed by the spool directory of in.
+func (s *supervisor) runSpoolInput(in *runningInput, spool *fswatch.SpoolDir, claimc chan *fswatch.Claim) {
+	conf := in.conf
+
+	// How many points of each released file every sink has taken
+	var acked = make(map[string]map[string]int)
+	for claim := range claimc {
+		if claim.Recovered {
+			log.Printf("Recovering %s, left claimed by a previous run", claim.Path)
+		}
+		name := filepath.Base(claim.Path)
+		if acked[name] == nil {
+			acked[name] = make(map[string]int)
+		}
+		if err := s.processClaim(conf, claim, acked[name]); err != nil {
+			log.Printf("Warning, releasing %s to retry later: %s", claim.Path, err)
+			if err := spool.Release(claim); err != nil {
+				s.errc <- err
+			}
+			continue
+		}
+		delete(acked, name)
+		if err := spool.Ack(claim); err != nil {
+			s.errc <- err
+		}
+		s.saveSchema()
+	}
+	close(in.done)
+}
+
+// processClaim parses a claimed perfdata or check result file and writes it
+// to every sink that hasn't taken it according to acked.
+func (s *supervisor) processClaim(conf config.Input, claim *fswatch.Claim, acked map[string]int) error {
+	file, err := os.Open(claim.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	parse := nagios.ParsePerfdata
+	if conf.Type == config.CheckResultInput {
+		parse = nagios.ParseCheckResults
+	}
+	points, err := parse(file, s.rules.Load(), inputTags(conf), func(err error) {
+		s.errc <- fmt.Errorf("%s: %s", claim.Path, err)
+	})
+	if err != nil {
+		return err
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	return s.writeAcked(points, acked)
+}
+
+// newLogInput returns an input following the log of conf. Like a perfdata input each batch of
+// lines is written straight to the sinks, the offset saved to the checkpoint
+// only moves past lines every sink has taken. When a batch fails it is
+// handed over again with any lines added since, and the sinks that took it
+// are only given the new lines.
+func (s *supervisor) newLogInput(conf config.Input) (*runningInput, error) {
+	tailer := &fswatch.Tailer{
+		Path:      conf.Path,
+		StatePath: conf.Checkpoint,
+		Interval:  conf.PollInterval,
+		Poll:      conf.Watch == config.PollWatch,
+		Once:      *oneshot,
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	in := &runningInput{conf: conf, cancel: cancel, done: make(chan struct{}), close: cancel}
+	in.start = func() { go s.runLogInput(ctx, in, tailer) }
+	return in, nil
+}
+
+// runLogInput follows the log of in with tailer.
+func (s *supervisor) runLogInput(ctx context.Context, in *runningInput, tailer *fswatch.Tailer) {
+	conf := in.conf
+
+	// The lines of the failed batch, their points and how many of them
+	// each sink has taken
+	var pending []string
+	var points []*client.Point
+	var acked = make(map[string]int)
+	tailer.Run(ctx, func(lines []string) error {
+		if !hasPrefix(lines, pending) {
+			pending, points, acked = nil, nil, make(map[string]int)
+		}
+		points = append(points, nagios.ParseLog(lines[len(pending):], s.rules.Load(), inputTags(conf), func(err error) {
+			s.errc <- fmt.Errorf("%s: %s", conf.Path, err)
+		})...)
+		pending = append([]string(nil), lines...)
+
+		if len(points) > 0 {
+			if err := s.writeAcked(points, acked); err != nil {
+				return err
+			}
+		}
+		pending, points, acked = nil, nil, make(map[string]int)
+		s.saveSchema()
+		return nil
+	}, s.errc)
+	close(in.done)
+}
+
+// wait blocks until every input has finished, which only happens on its own
+// when running once.
+func (s *supervisor) wait() {
+	for _, in := range s.inputs {
+		<-in.done
+	}
+}
+
+// stopInputs stops every input, letting each finish the file it is on.
+func (s *supervisor) stopInputs() {
+	for _, in := range s.inputs {
+		in.cancel()
+	}
+	s.wait()
+}
+
+// stopOutputs stops every output, draining their spools.
+func (s *supervisor) stopOutputs() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, o := range s.outputs {
+		if err := o.stop(); err != nil {
+			s.errc <- err
+		}
+		spoolBytes.Delete(name)
+		delete(s.outputs, name)
+	}
+}
+
+// saveCheckpoints saves the checkpoint of every configured input, and the
+// schema.
+func (s *supervisor) saveCheckpoints() {
+	for _, conf := range s.cfg.Inputs {
+		s.saveCheckpoint(conf)
+	}
+	s.saveSchema()
+}
+
+// saveCheckpoint saves the checkpoint of a status input, log inputs save
+// their own as they go.
+func (s *supervisor) saveCheckpoint(conf config.Input) {
+	if conf.Type != config.StatusInput || conf.Checkpoint == "" {
+		return
+	}
+	if err := s.checkpoints[conf.Name].Save(conf.Checkpoint); err != nil {
+		log.Printf("Error, saving checkpoint: %s", err)
+	}
+}
+
+// saveSchema saves the field types locked so far, if the schema has a
+// checkpoint.
+func (s *supervisor) saveSchema() {
+	if err := s.schema.Save(); err != nil {
+		log.Printf("Error, saving schema: %s", err)
+	}
+}
+
+// writeStatus writes the current status of an instance to every running
+// output that keeps it. A failed write isn't retried, the next status.dat
+// replaces it.
+func (s *supervisor) writeStatus(status *nagios.CurrentStatus) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for name, o := range s.outputs {
+		w, ok := o.sink.(sink.StatusWriter)
+		if !ok {
+			continue
+		}
+		if err := w.WriteStatus(status); err != nil {
+			s.errc <- fmt.Errorf("%s: current status: %s", name, err)
+		}
+	}
+}
+
+// writeAcked writes to each running output the points it hasn't taken yet,
+// acked holding how many of points each output has, and moves acked on for
+// the outputs the rest are written to.
+func (s *supervisor) writeAcked(points []*client.Point, acked map[string]int) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var firstErr error
+	for name, o := range s.outputs {
+		if acked[name] >= len(points) {
+			continue
+		}
+		if err := o.write(points[acked[name]:]); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %s", name, err)
+			}
+			continue
+		}
+		acked[name] = len(points)
+	}
+	return firstErr
+}
+
+// hasPrefix reports whether lines starts with prefix.
+func hasPrefix(lines, prefix []string) bool {
+	if len(lines) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if lines[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// write is the WriteFunc used by the Uploaders, it writes each batch to
+// every running output.
+func (s *supervisor) write(points []*client.Point) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var firstErr error
+	for name, o := range s.outputs {
+		if err := o.write(points); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return firstErr
+}